@@ -0,0 +1,418 @@
+package blog
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// datetimeLocal is the format of an <input type="datetime-local">. The post
+// editor's timestamps are in UTC.
+const datetimeLocal = "2006-01-02T15:04"
+
+// adminURL returns the URL of the post admin, joined with elems.
+func (blg *Blog) adminURL(elems ...string) string {
+	return "/" + strings.Join(append([]string{blg.namespace, "admin", "posts"}, elems...), "/")
+}
+
+// PostsGet lists every post, drafts included.
+func (blg *Blog) PostsGet(w http.ResponseWriter, r *http.Request) {
+	posts, err := blg.ListPosts()
+	if err != nil {
+		blg.render.InternalServerError(w, r, err)
+		return
+	}
+	format, err := blg.postURLFormat()
+	if err != nil {
+		blg.render.InternalServerError(w, r, err)
+		return
+	}
+	type postRow struct {
+		Post
+		URL string
+	}
+	rows := make([]postRow, len(posts))
+	for i, post := range posts {
+		rows[i] = postRow{Post: post, URL: blg.postURL(format, post)}
+	}
+	pending, err := blg.CountComments(commentPending)
+	if err != nil {
+		blg.render.InternalServerError(w, r, err)
+		return
+	}
+	data := map[string]interface{}{
+		"Posts":           rows,
+		"AdminURL":        blg.adminURL(),
+		"SettingsURL":     "/" + blg.namespace + "/admin/settings",
+		"CommentsURL":     blg.commentsAdminURL(),
+		"PendingComments": pending,
+		"Now":             now(),
+	}
+	err = blg.render.Page(w, r, data, "admin_posts.html")
+	if err != nil {
+		blg.render.InternalServerError(w, r, err)
+		return
+	}
+}
+
+// PostEditorGet shows the post editor, for a new post or for the post in the
+// URL.
+func (blg *Blog) PostEditorGet(w http.ResponseWriter, r *http.Request) {
+	var post Post
+	if chi.URLParam(r, "postID") != "" {
+		postID, err := strconv.ParseInt(chi.URLParam(r, "postID"), 10, 64)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		post, err = blg.GetPost(postID)
+		if errors.Is(err, ErrPostNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			blg.render.InternalServerError(w, r, err)
+			return
+		}
+	}
+	blg.renderEditor(w, r, post, nil)
+}
+
+// PostEditorPost creates a new post, or saves the post in the URL. Submitting
+// the form with action=publish publishes the post immediately if it has no
+// publish date.
+func (blg *Blog) PostEditorPost(w http.ResponseWriter, r *http.Request) {
+	var post Post
+	var err error
+	if chi.URLParam(r, "postID") != "" {
+		post.PostID, err = strconv.ParseInt(chi.URLParam(r, "postID"), 10, 64)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+	}
+	err = r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	post.Title = r.PostForm.Get("title")
+	post.Slug = r.PostForm.Get("slug")
+	post.Summary = r.PostForm.Get("summary")
+	post.Body = strings.ReplaceAll(r.PostForm.Get("body"), "\r\n", "\n")
+	post.Meta, err = parseMeta(r.PostForm.Get("meta"))
+	if err == nil {
+		post.PublishedOn, err = parseDatetimeLocal("published_on", r.PostForm.Get("published_on"))
+	}
+	if err == nil {
+		post.UnpublishedOn, err = parseDatetimeLocal("unpublished_on", r.PostForm.Get("unpublished_on"))
+	}
+	if err != nil {
+		blg.renderEditor(w, r, post, err)
+		return
+	}
+	if r.PostForm.Get("action") == "publish" && !post.PublishedOn.Valid {
+		post.PublishedOn = sql.NullTime{Time: now(), Valid: true}
+	}
+	if post.PostID == 0 {
+		post, err = blg.CreatePost(post)
+	} else {
+		post, err = blg.UpdatePost(post)
+	}
+	if errors.Is(err, ErrPostNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	var postErr *PostError
+	if errors.As(err, &postErr) {
+		blg.renderEditor(w, r, post, err)
+		return
+	}
+	if err != nil {
+		blg.render.InternalServerError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, blg.adminURL(strconv.FormatInt(post.PostID, 10)), http.StatusSeeOther)
+}
+
+// PostDeletePost deletes the post in the URL.
+func (blg *Blog) PostDeletePost(w http.ResponseWriter, r *http.Request) {
+	postID, err := strconv.ParseInt(chi.URLParam(r, "postID"), 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	err = blg.DeletePost(postID)
+	if errors.Is(err, ErrPostNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		blg.render.InternalServerError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, blg.adminURL(), http.StatusSeeOther)
+}
+
+// renderEditor renders the post editor. If err is not nil the form is being
+// shown again because it failed validation.
+func (blg *Blog) renderEditor(w http.ResponseWriter, r *http.Request, post Post, err error) {
+	data := map[string]interface{}{
+		"Post":     post,
+		"Meta":     formatMeta(post.Meta),
+		"AdminURL": blg.adminURL(),
+		"FormURL":  blg.adminURL("new"),
+	}
+	if post.PostID != 0 {
+		data["FormURL"] = blg.adminURL(strconv.FormatInt(post.PostID, 10))
+	}
+	var rw http.ResponseWriter = w
+	if err != nil {
+		data["Error"] = err.Error()
+		data["Meta"] = r.PostForm.Get("meta") // as typed, in case it is what failed
+		rw = &statusWriter{ResponseWriter: w, status: http.StatusBadRequest}
+	}
+	err = blg.render.Page(rw, r, data, "admin_post.html")
+	if err != nil {
+		blg.render.InternalServerError(w, r, err)
+		return
+	}
+}
+
+// parseDatetimeLocal parses the value of an <input type="datetime-local"> as
+// UTC. An empty value is a null time.
+func parseDatetimeLocal(field, value string) (sql.NullTime, error) {
+	if value == "" {
+		return sql.NullTime{}, nil
+	}
+	t, err := time.ParseInLocation(datetimeLocal, value, time.UTC)
+	if err != nil {
+		return sql.NullTime{}, &PostError{Field: field, Msg: "not a valid date and time"}
+	}
+	return sql.NullTime{Time: t, Valid: true}, nil
+}
+
+// postURLFormats are suggested in the settings form, see checkPostURLFormat.
+var postURLFormats = []string{
+	"{slug}",
+	"{year}/{month}/{day}/{slug}",
+	"{year}-{month}-{day}/{slug}",
+	"{year}/{month}/{slug}",
+	"{year}-{month}/{slug}",
+	"{year}/{slug}",
+}
+
+// settingKeys are the blog settings in the settings form.
+var settingKeys = []string{
+	configTitle, configAuthor, configPostURL,
+	configPostIndex, configPost, configSearch, configGroup,
+	configPagination, configPostsPerPage, configFeedContent, configComments,
+	configSiteURL,
+}
+
+// SettingsGet shows the blog settings form.
+func (blg *Blog) SettingsGet(w http.ResponseWriter, r *http.Request) {
+	settings := make(map[string]string)
+	for _, key := range settingKeys {
+		value, err := blg.config(key)
+		if err != nil {
+			blg.render.InternalServerError(w, r, err)
+			return
+		}
+		settings[key] = value
+	}
+	blg.renderSettings(w, r, settings, nil)
+}
+
+// SettingsPost saves the blog settings. Changing the post URL format
+// redirects the old URLs of published posts to their new ones.
+func (blg *Blog) SettingsPost(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	settings := make(map[string]string)
+	for _, key := range settingKeys {
+		settings[key] = strings.TrimSpace(r.PostForm.Get(key))
+	}
+	err = checkPostURLFormat(settings[configPostURL])
+	for _, key := range []string{configPostIndex, configPost, configSearch, configGroup} {
+		if _, statErr := fs.Stat(blg.Themes, settings[key]); err == nil && statErr != nil {
+			err = fmt.Errorf("%s: no such theme template %q", key, settings[key])
+		}
+	}
+	if settings[configPagination] != "numbered" && settings[configPagination] != "all" && err == nil {
+		err = fmt.Errorf(`%s: must be "numbered" or "all"`, configPagination)
+	}
+	if n, atoiErr := strconv.Atoi(settings[configPostsPerPage]); (atoiErr != nil || n <= 0) && err == nil {
+		err = fmt.Errorf("%s: must be a positive number", configPostsPerPage)
+	}
+	if settings[configFeedContent] != "full" && settings[configFeedContent] != "summary" && err == nil {
+		err = fmt.Errorf(`%s: must be "full" or "summary"`, configFeedContent)
+	}
+	if c := settings[configComments]; c != "moderated" && c != "open" && c != "closed" && err == nil {
+		err = fmt.Errorf(`%s: must be "moderated", "open" or "closed"`, configComments)
+	}
+	if siteURL, siteErr := checkSiteURL(settings[configSiteURL]); err == nil {
+		settings[configSiteURL], err = siteURL, siteErr
+	}
+	if err != nil {
+		blg.renderSettings(w, r, settings, err)
+		return
+	}
+	for _, key := range settingKeys {
+		if key == configPostURL {
+			err = blg.SetPostURLFormat(settings[key])
+		} else {
+			err = blg.kvSet(key, settings[key])
+		}
+		if err != nil {
+			blg.render.InternalServerError(w, r, err)
+			return
+		}
+	}
+	http.Redirect(w, r, "/"+blg.namespace+"/admin/settings", http.StatusSeeOther)
+}
+
+// renderSettings renders the settings form. If err is not nil the form is
+// being shown again because it failed validation.
+func (blg *Blog) renderSettings(w http.ResponseWriter, r *http.Request, settings map[string]string, err error) {
+	data := map[string]interface{}{
+		"Settings":       settings,
+		"PostURLFormats": postURLFormats,
+		"AdminURL":       blg.adminURL(),
+	}
+	var rw http.ResponseWriter = w
+	if err != nil {
+		data["Error"] = err.Error()
+		rw = &statusWriter{ResponseWriter: w, status: http.StatusBadRequest}
+	}
+	err = blg.render.Page(rw, r, data, "admin_settings.html")
+	if err != nil {
+		blg.render.InternalServerError(w, r, err)
+		return
+	}
+}
+
+// commentsAdminURL returns the URL of the comment moderation queue.
+func (blg *Blog) commentsAdminURL() string {
+	return "/" + blg.namespace + "/admin/comments"
+}
+
+// commentStatuses are the tabs of the comment moderation queue.
+var commentStatuses = []string{commentPending, commentApproved, commentSpam}
+
+// CommentsGet lists the comments with the status in the status query
+// parameter, pending comments by default, newest first.
+func (blg *Blog) CommentsGet(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = commentPending
+	}
+	if status != commentPending && status != commentApproved && status != commentSpam {
+		http.NotFound(w, r)
+		return
+	}
+	comments, err := blg.ListComments(status)
+	if err != nil {
+		blg.render.InternalServerError(w, r, err)
+		return
+	}
+	format, err := blg.postURLFormat()
+	if err != nil {
+		blg.render.InternalServerError(w, r, err)
+		return
+	}
+	type commentRow struct {
+		Comment
+		Content   template.HTML
+		PostTitle string
+		URL       string // the comment on its post
+	}
+	posts := make(map[int64]Post)
+	rows := make([]commentRow, len(comments))
+	for i, comment := range comments {
+		post, ok := posts[comment.PostID]
+		if !ok {
+			post, err = blg.GetPost(comment.PostID)
+			if err != nil {
+				blg.render.InternalServerError(w, r, err)
+				return
+			}
+			posts[comment.PostID] = post
+		}
+		content, err := blg.Render.MarkdownHTML([]byte(comment.Body))
+		if err != nil {
+			blg.render.InternalServerError(w, r, err)
+			return
+		}
+		rows[i] = commentRow{
+			Comment:   comment,
+			Content:   content,
+			PostTitle: post.Title,
+			URL:       blg.postURL(format, post) + "#" + commentAnchor(comment.CommentID),
+		}
+	}
+	data := map[string]interface{}{
+		"Comments":    rows,
+		"Status":      status,
+		"Statuses":    commentStatuses,
+		"CommentsURL": blg.commentsAdminURL(),
+		"AdminURL":    blg.adminURL(),
+	}
+	err = blg.render.Page(w, r, data, "admin_comments.html")
+	if err != nil {
+		blg.render.InternalServerError(w, r, err)
+		return
+	}
+}
+
+// CommentModeratePost approves (action=approve), marks as spam (action=spam)
+// or deletes (action=delete) the comment in the URL, then goes back to the
+// moderation queue it was in.
+func (blg *Blog) CommentModeratePost(w http.ResponseWriter, r *http.Request) {
+	commentID, err := strconv.ParseInt(chi.URLParam(r, "commentID"), 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	err = r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch r.PostForm.Get("action") {
+	case "approve":
+		err = blg.SetCommentStatus(commentID, commentApproved)
+	case "spam":
+		err = blg.SetCommentStatus(commentID, commentSpam)
+	case "delete":
+		err = blg.DeleteComment(commentID)
+	default:
+		http.Error(w, "action: must be approve, spam or delete", http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, ErrCommentNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		blg.render.InternalServerError(w, r, err)
+		return
+	}
+	redirect := blg.commentsAdminURL()
+	if status := r.PostForm.Get("status"); status != "" {
+		redirect += "?status=" + url.QueryEscape(status)
+	}
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
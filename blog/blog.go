@@ -2,6 +2,9 @@ package blog
 
 import (
 	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
 	"net/http"
 	"os"
 
@@ -17,21 +20,41 @@ type Blog struct {
 	namespace string // URL prefix
 	render    *renderly.Renderly
 	cache     *ristretto.Cache
+	// searchable is whether SQLite has FTS5, which search needs (see
+	// initSearch).
+	searchable bool
 }
 
-var builtin = os.DirFS(renderly.AbsDir("."))
+//go:embed blog.html edit_mode.css edit_mode.js style.css tachyons.css admin_posts.html admin_post.html admin_settings.html admin_comments.html
+var embedded embed.FS
+
+// builtin is the blog's embedded files (the "embedded" layer), overridden
+// file-by-file by any files of the same name in ./themes/blog (the
+// "overrides" layer).
+var builtin = renderly.NewLayeredFS(
+	renderly.Layer{Name: "overrides", FS: os.DirFS("./themes/blog")},
+	renderly.Layer{Name: "embedded", FS: embedded},
+)
 
 func New(namespace string) func(*pagemanager.PageManager) (pagemanager.Plugin, error) {
 	return func(pm *pagemanager.PageManager) (pagemanager.Plugin, error) {
 		var err error
 		blg := &Blog{
 			PageManager: pm,
+			namespace:   namespace,
+		}
+		err = blg.migrate()
+		if err != nil {
+			return blg, fmt.Errorf("migrating the blog tables: %w", err)
+		}
+		err = blg.initSearch()
+		if err != nil {
+			return blg, fmt.Errorf("creating the blog search tables: %w", err)
 		}
-		templatesDir := os.DirFS("./templates/plainsimple")
 		blg.render, err = renderly.New(
 			builtin,
+			renderly.TemplateFuncs(renderly.FuncMap()),
 			renderly.GlobalCSS(builtin, "tachyons.css", "style.css"),
-			renderly.AltFS("templates", templatesDir),
 		)
 		if err != nil {
 			return blg, erro.Wrap(err)
@@ -45,19 +68,63 @@ func New(namespace string) func(*pagemanager.PageManager) (pagemanager.Plugin, e
 		if err != nil {
 			return blg, err
 		}
+		pm.Render.AddPrehook("", namespace+".feeds", blg.feedsPrehook)
 		return blg, nil
 	}
 }
 
+// Blog settings, stored in blg_config.
+const (
+	configPostIndex    = "post-index"     // theme template of the post index
+	configPost         = "post"           // theme template of a post
+	configSearch       = "search"         // theme template of the search page
+	configGroup        = "group"          // theme template of a group page
+	configPostsPerPage = "posts-per-page" // posts on each page of the index
+	configPagination   = "pagination"     // "numbered", or "all" for every post on one page
+	configPostURL      = "post-url"       // post URL format, see checkPostURLFormat
+	configTitle        = "title"          // title of the blog's feeds
+	configAuthor       = "author"         // author of the blog's feeds, the title if empty
+	configFeedContent  = "feed-content"   // "full" posts or only their "summary" in the feeds
+	configComments     = "comments"       // "moderated", "open" (no approval needed) or "closed"
+	configSiteURL      = "site-url"       // scheme and host the feeds link to and make their entry IDs from, see feedBase
+)
+
+var defaultConfig = map[string]string{
+	configPostIndex:    "plainsimple/post-index.html",
+	configPost:         "plainsimple/post.html",
+	configSearch:       "plainsimple/search.html",
+	configGroup:        "plainsimple/group.html",
+	configPostsPerPage: "10",
+	configPagination:   "numbered",
+	configPostURL:      "{slug}",
+	configTitle:        "My Blog",
+	configAuthor:       "",
+	configFeedContent:  "full",
+	configComments:     "moderated",
+}
+
+// config returns the value of a blog setting, or its default if it is not
+// set.
+func (blg *Blog) config(key string) (string, error) {
+	value, err := blg.kvGet(key)
+	if err != nil {
+		return "", err
+	}
+	if !value.Valid || value.String == "" {
+		return defaultConfig[key], nil
+	}
+	return value.String, nil
+}
+
 func (blg *Blog) kvGet(key string) (sql.NullString, error) {
 	data, found := blg.cache.Get(key)
 	value, ok := data.(sql.NullString)
 	if found && ok {
 		return value, nil
 	}
-	query := "SELECT value FROM blg_kv WHERE key = ?"
+	query := "SELECT value FROM blg_config WHERE key = ?"
 	err := blg.DB.QueryRow(query, key).Scan(&value)
-	if err != nil {
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
 		return value, err
 	}
 	_ = blg.cache.Set(key, value, 0)
@@ -65,24 +132,18 @@ func (blg *Blog) kvGet(key string) (sql.NullString, error) {
 }
 
 func (blg *Blog) kvSet(key, value string) error {
-	query := "INSERT INTO blg_kv (key, value) VALUES (?, ?) ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value"
+	query := "INSERT INTO blg_config (key, value) VALUES (?, ?) ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value"
 	_, err := blg.DB.Exec(query, key, value)
 	if err != nil {
 		return err
 	}
-	_ = blg.cache.Set(key, value, 0)
+	blg.cache.Del(key)
 	return nil
 }
 
 func (blg *Blog) AddRoutes() error {
-	blg.Router.Route("/blog", func(r chi.Router) {
-		r.Get("/", func(w http.ResponseWriter, r *http.Request) {
-			err := blg.render.Page(w, r, nil, "blog.html")
-			if err != nil {
-				blg.render.InternalServerError(w, r, err)
-				return
-			}
-		})
+	blg.Router.Route("/"+blg.namespace, func(r chi.Router) {
+		r.Get("/", blg.PostIndexGet)
 		r.Get("/edit", func(w http.ResponseWriter, r *http.Request) {
 			err := blg.render.Page(w, r, nil, "blog.html", "edit_mode.css", "edit_mode.js")
 			if err != nil {
@@ -90,30 +151,54 @@ func (blg *Blog) AddRoutes() error {
 				return
 			}
 		})
+		r.Get("/search", blg.SearchGet)
+		r.Get("/{feed:rss\\.xml|atom\\.xml|feed\\.json}", blg.FeedGet)
+		r.Get("/groups/{key}/{value}", blg.GroupGet)
+		r.Get("/groups/{key}/{value}/{feed:rss\\.xml|atom\\.xml|feed\\.json}", blg.FeedGet)
+		r.Post("/comments", blg.CommentPost)
+		r.Get("/comments/{commentID:[0-9]+}", blg.CommentGet)
+		r.Get("/comments/posts/{postID:[0-9]+}.atom", blg.CommentFeedGet)
+		r.Route("/admin/posts", func(r chi.Router) {
+			r.Use(blg.RequireAdmin, pagemanager.SameOrigin)
+			r.Get("/", blg.PostsGet)
+			r.Get("/new", blg.PostEditorGet)
+			r.Post("/new", blg.PostEditorPost)
+			r.Get("/{postID}", blg.PostEditorGet)
+			r.Post("/{postID}", blg.PostEditorPost)
+			r.Post("/{postID}/delete", blg.PostDeletePost)
+		})
+		r.Route("/admin/comments", func(r chi.Router) {
+			r.Use(blg.RequireAdmin, pagemanager.SameOrigin)
+			r.Get("/", blg.CommentsGet)
+			r.Post("/{commentID}", blg.CommentModeratePost)
+		})
+		r.Route("/admin/settings", func(r chi.Router) {
+			r.Use(blg.RequireAdmin, pagemanager.SameOrigin)
+			r.Get("/", blg.SettingsGet)
+			r.Post("/", blg.SettingsPost)
+		})
+		r.Get("/*", blg.PostGet)
 	})
 	return nil
 }
 
-const (
-	configPostIndex = "post-index"
-	configpost      = "post"
-)
+// statusWriter sends status along with the first write instead of right away,
+// so that the headers set by renderly while rendering (such as the
+// Content-Security-Policy) are not lost.
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
 
-func (blg *Blog) postIndexFilenames() ([]string, error) {
-	var templateName string
-	value, err := blg.kvGet(configPostIndex)
-	if err != nil {
-		return nil, err
+func (sw *statusWriter) WriteHeader(status int) {
+	if !sw.wroteHeader {
+		sw.wroteHeader = true
+		sw.ResponseWriter.WriteHeader(status)
 	}
-	if value.Valid {
-		templateName = value.String
-	} else {
-		templateName = "blog.html" // default template
-	}
-	var filenames = resolve(templateName)
-	return filenames, nil
 }
 
-func resolve(name string) []string {
-	return nil
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	sw.WriteHeader(sw.status)
+	return sw.ResponseWriter.Write(p)
 }
@@ -0,0 +1,1040 @@
+package blog
+
+import (
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bokwoon95/weblog/pagemanager"
+	"github.com/matryer/is"
+)
+
+// newTestBlog returns a blog backed by an in-memory database, with the admin
+// credentials admin:hunter2.
+func newTestBlog(t *testing.T) *Blog {
+	is := is.New(t)
+	os.Setenv("PM_ADMIN_USER", "admin")
+	os.Setenv("PM_ADMIN_PASSWORD", "hunter2")
+	pm, err := pagemanager.New("sqlite3", ":memory:")
+	os.Unsetenv("PM_ADMIN_USER")
+	os.Unsetenv("PM_ADMIN_PASSWORD")
+	is.NoErr(err)
+	t.Cleanup(func() { pm.DB.Close() })
+	pm.DB.SetMaxOpenConns(1) // every connection to :memory: is a new database
+	plugin, err := New("blog")(pm)
+	is.NoErr(err)
+	is.NoErr(pm.AddPlugins(func(*pagemanager.PageManager) (pagemanager.Plugin, error) { return plugin, nil }))
+	return plugin.(*Blog)
+}
+
+func stubNow(t *testing.T, s string) {
+	tm, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := now
+	now = func() time.Time { return tm }
+	t.Cleanup(func() { now = prev })
+}
+
+// baselineSchema is the blog part of the original init.sql, minus the
+// full-text search tables in baselineFTSSchema (FTS5 is not compiled into the
+// sqlite3 driver by default).
+const baselineSchema = `
+CREATE TABLE blg_config (
+    key TEXT NOT NULL PRIMARY KEY
+    ,value TEXT
+);
+CREATE TABLE blg_posts (
+    post_id BIGINT NOT NULL PRIMARY KEY
+    ,slug TEXT
+    ,title TEXT
+    ,summary TEXT
+    ,body TEXT
+    ,published_on TIMESTAMPTZ
+    ,unpublished_on TIMESTAMPTZ
+    ,created_at TIMESTAMPTZ
+    ,updated_at TIMESTAMPTZ
+);
+INSERT INTO blg_posts (post_id, slug, title, body, published_on, created_at, updated_at) VALUES
+    (1, 'hello', 'Hello', 'first', '2020-06-01 00:00:00', '2020-06-01 00:00:00', '2020-06-02 00:00:00')
+    ,(2, NULL, NULL, NULL, NULL, '2020-06-03 00:00:00', NULL)
+    ,(3, 'hello', 'Hello again', NULL, NULL, NULL, NULL)
+;
+`
+
+// baselineFTSSchema is the full-text search part of the original init.sql,
+// with its broken triggers.
+const baselineFTSSchema = `
+CREATE VIRTUAL TABLE blg_posts_fts USING FTS5 (
+    title
+    ,summary
+    ,body
+    ,content='blg_posts'
+    ,content_rowid='post_id'
+);
+CREATE TRIGGER blg_posts_after_insert AFTER INSERT ON blg_posts
+BEGIN
+    INSERT INTO blg_posts_fts (rowid, title, summary, body) VALUES (NEW.post_id, NEW.title, NEW.summary, NEW.body);
+END;
+CREATE TRIGGER blg_posts_after_delete AFTER DELETE ON blg_posts
+BEGIN
+    INSERT INTO blg_posts_fts (blg_posts_fts, rowid, title, summary, body) VALUES ('delete', OLD.id, OLD.title, OLD.summary, OLD.body);
+END;
+CREATE TRIGGER blg_posts_after_update AFTER UPDATE ON blg_posts
+BEGIN
+    INSERT INTO blg_posts_fts (blg_posts_fts, rowid, title, summary, body) VALUES ('delete', OLD.id, OLD.title, OLD.summary, OLD.body);
+    INSERT INTO blg_posts_fts (rowid, title, summary, body) VALUES (NEW.id, NEW.title, NEW.summary, NEW.body);
+END;
+`
+
+func Test_migrate(t *testing.T) {
+	is := is.New(t)
+	stubNow(t, "2020-06-18T10:00:00Z")
+	dataSourceName := filepath.Join(t.TempDir(), "database.sqlite3")
+	db, err := sql.Open("sqlite3", dataSourceName)
+	is.NoErr(err)
+	_, err = db.Exec(baselineSchema)
+	is.NoErr(err)
+	if fts5 {
+		_, err = db.Exec(baselineFTSSchema)
+		is.NoErr(err)
+	}
+	is.NoErr(db.Close())
+	newBlog := func() *Blog {
+		pm, err := pagemanager.New("sqlite3", dataSourceName)
+		is.NoErr(err)
+		t.Cleanup(func() { pm.DB.Close() })
+		plugin, err := New("blog")(pm)
+		is.NoErr(err)
+		return plugin.(*Blog)
+	}
+
+	blg := newBlog()
+	var version int
+	is.NoErr(blg.DB.QueryRow("SELECT value FROM blg_config WHERE key = ?", schemaVersionKey).Scan(&version))
+	names, err := fs.Glob(migrations, "migrations/*.sql")
+	is.NoErr(err)
+	is.Equal(version, len(names))
+	post, err := blg.GetPost(1)
+	is.NoErr(err) // the posts are kept
+	is.Equal(post.Slug, "hello")
+	is.Equal(post.Body, "first")
+	is.True(post.PublishedOn.Valid && post.PublishedOn.Time.Equal(time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)))
+	post, err = blg.GetPost(2)
+	is.NoErr(err)
+	is.Equal(post.Slug, "post-2") // every post has a slug
+	is.True(post.UpdatedAt.Equal(post.CreatedAt))
+	post, err = blg.GetPost(3)
+	is.NoErr(err)
+	is.Equal(post.Slug, "post-3") // that is unique
+	post, err = blg.CreatePost(Post{Title: "New"})
+	is.NoErr(err)
+	is.Equal(post.PostID, int64(4)) // post_id is assigned by SQLite
+	if fts5 {
+		count, err := blg.CountSearch(now(), SearchOptions{Query: "first"})
+		is.NoErr(err)
+		is.Equal(count, 1) // the old posts are indexed
+		post, err = blg.GetPost(1)
+		is.NoErr(err)
+		post.Body = "updated"
+		_, err = blg.UpdatePost(post)
+		is.NoErr(err) // the triggers work
+		count, err = blg.CountSearch(now(), SearchOptions{Query: "first"})
+		is.NoErr(err)
+		is.Equal(count, 0)
+	}
+
+	blg = newBlog() // migrations only run once
+	posts, err := blg.ListPosts()
+	is.NoErr(err)
+	is.Equal(len(posts), 4)
+}
+
+func Test_Posts(t *testing.T) {
+	is := is.New(t)
+	blg := newTestBlog(t)
+	stubNow(t, "2020-06-18T10:00:00Z")
+
+	post, err := blg.CreatePost(Post{Title: "  Hello, World! "})
+	is.NoErr(err)
+	is.Equal(post.Title, "Hello, World!")
+	is.Equal(post.Slug, "hello-world")
+	is.True(post.CreatedAt.Equal(now()))
+	is.True(post.UpdatedAt.Equal(now()))
+
+	post2, err := blg.CreatePost(Post{Title: "Hello world"})
+	is.NoErr(err)
+	is.Equal(post2.Slug, "hello-world-2") // generated slugs are made unique
+
+	_, err = blg.CreatePost(Post{Title: "Another", Slug: "Hello World"})
+	var postErr *PostError
+	is.True(errors.As(err, &postErr)) // chosen slugs must be unique
+	is.Equal(postErr.Field, "slug")
+
+	_, err = blg.CreatePost(Post{Title: "!!!"})
+	is.True(errors.As(err, &postErr))
+	is.Equal(postErr.Field, "slug")
+
+	_, err = blg.CreatePost(Post{Title: ""})
+	is.True(errors.As(err, &postErr))
+	is.Equal(postErr.Field, "title")
+
+	published := time.Date(2020, 6, 18, 0, 0, 0, 0, time.UTC)
+	_, err = blg.CreatePost(Post{
+		Title:         "Backwards",
+		PublishedOn:   sql.NullTime{Time: published, Valid: true},
+		UnpublishedOn: sql.NullTime{Time: published.Add(-time.Hour), Valid: true},
+	})
+	is.True(errors.As(err, &postErr))
+	is.Equal(postErr.Field, "unpublished_on")
+
+	stubNow(t, "2020-06-19T10:00:00Z")
+	post.Body = "# Hello"
+	post.PublishedOn = sql.NullTime{Time: published, Valid: true}
+	post.CreatedAt = time.Time{} // ignored
+	post, err = blg.UpdatePost(post)
+	is.NoErr(err)
+	got, err := blg.GetPost(post.PostID)
+	is.NoErr(err)
+	is.Equal(got.Slug, "hello-world") // a post keeps its own slug
+	is.Equal(got.Body, "# Hello")
+	is.True(got.PublishedOn.Valid && got.PublishedOn.Time.Equal(published))
+	is.True(got.CreatedAt.Equal(time.Date(2020, 6, 18, 10, 0, 0, 0, time.UTC)))
+	is.True(got.UpdatedAt.Equal(now()))
+
+	posts, err := blg.ListPosts()
+	is.NoErr(err)
+	is.Equal(len(posts), 2)
+	is.Equal(posts[0].PostID, post.PostID) // most recently updated first
+
+	_, err = blg.UpdatePost(Post{PostID: 1000, Title: "Nope"})
+	is.True(errors.Is(err, ErrPostNotFound))
+	is.NoErr(blg.DeletePost(post.PostID))
+	is.True(errors.Is(blg.DeletePost(post.PostID), ErrPostNotFound))
+	_, err = blg.GetPost(post.PostID)
+	is.True(errors.Is(err, ErrPostNotFound))
+}
+
+func Test_PostEditor(t *testing.T) {
+	is := is.New(t)
+	blg := newTestBlog(t)
+
+	r := httptest.NewRequest("GET", "/blog/admin/posts/new", nil)
+	w := httptest.NewRecorder()
+	blg.Router.ServeHTTP(w, r)
+	is.Equal(w.Code, http.StatusUnauthorized)
+
+	form := url.Values{"title": {"My first post"}, "body": {"hi"}, "action": {"publish"}}
+	r = httptest.NewRequest("POST", "/blog/admin/posts/new", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.SetBasicAuth("admin", "hunter2")
+	w = httptest.NewRecorder()
+	blg.Router.ServeHTTP(w, r)
+	is.Equal(w.Code, http.StatusSeeOther)
+	is.Equal(w.Header().Get("Location"), "/blog/admin/posts/1")
+	post, err := blg.GetPost(1)
+	is.NoErr(err)
+	is.Equal(post.Slug, "my-first-post")
+	is.True(post.PublishedOn.Valid) // published right away
+
+	form = url.Values{"title": {"My first post"}, "published_on": {"yesterday"}}
+	r = httptest.NewRequest("POST", "/blog/admin/posts/1", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.SetBasicAuth("admin", "hunter2")
+	w = httptest.NewRecorder()
+	blg.Router.ServeHTTP(w, r)
+	is.Equal(w.Code, http.StatusBadRequest)
+	is.True(w.Header().Get("Content-Security-Policy") != "")
+	is.True(strings.Contains(w.Body.String(), "published_on: not a valid date and time"))
+
+	r = httptest.NewRequest("GET", "/blog/admin/posts", nil)
+	r.SetBasicAuth("admin", "hunter2")
+	w = httptest.NewRecorder()
+	blg.Router.ServeHTTP(w, r)
+	is.Equal(w.Code, http.StatusOK)
+	is.True(strings.Contains(w.Body.String(), `href="/blog/admin/posts/1"`))
+
+	// another site cannot post the admin's forms, even with the admin's
+	// credentials
+	r = httptest.NewRequest("POST", "/blog/admin/posts/1/delete", nil)
+	r.Header.Set("Origin", "https://evil.example.com")
+	r.SetBasicAuth("admin", "hunter2")
+	w = httptest.NewRecorder()
+	blg.Router.ServeHTTP(w, r)
+	is.Equal(w.Code, http.StatusForbidden)
+	_, err = blg.GetPost(1)
+	is.NoErr(err)
+
+	r = httptest.NewRequest("POST", "/blog/admin/posts/1/delete", nil)
+	r.Header.Set("Origin", "http://example.com")
+	r.SetBasicAuth("admin", "hunter2")
+	w = httptest.NewRecorder()
+	blg.Router.ServeHTTP(w, r)
+	is.Equal(w.Code, http.StatusSeeOther)
+	_, err = blg.GetPost(1)
+	is.True(errors.Is(err, ErrPostNotFound))
+}
+
+func Test_PostPages(t *testing.T) {
+	is := is.New(t)
+	blg := newTestBlog(t)
+	day := func(d int) sql.NullTime {
+		return sql.NullTime{Time: time.Date(2020, 6, d, 0, 0, 0, 0, time.UTC), Valid: true}
+	}
+	for _, post := range []Post{
+		{Title: "First", PublishedOn: day(1)},
+		{Title: "Second", PublishedOn: day(2), Body: "**bold**"},
+		{Title: "Third", PublishedOn: day(3)},
+		{Title: "Draft"},
+		{Title: "Scheduled", PublishedOn: day(30)},
+		{Title: "Taken down", PublishedOn: day(1), UnpublishedOn: day(5)},
+	} {
+		_, err := blg.CreatePost(post)
+		is.NoErr(err)
+	}
+	stubNow(t, "2020-06-10T00:00:00Z")
+	is.NoErr(blg.kvSet(configPostsPerPage, "2"))
+	get := func(target string, admin bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", target, nil)
+		if admin {
+			r.SetBasicAuth("admin", "hunter2")
+		}
+		w := httptest.NewRecorder()
+		blg.Router.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("/blog", false)
+	is.Equal(w.Code, http.StatusOK)
+	body := w.Body.String()
+	is.True(strings.Contains(body, `<a href="/blog/third">Third</a>`)) // most recent first
+	is.True(strings.Contains(body, `<a href="/blog/second">Second</a>`))
+	is.True(!strings.Contains(body, "First")) // on page 2
+	is.True(strings.Contains(body, `<a href="/blog?page=2">next</a>`))
+	for _, title := range []string{"Draft", "Scheduled", "Taken down"} {
+		is.True(!strings.Contains(body, title)) // not published
+	}
+	body = get("/blog?page=2", false).Body.String()
+	is.True(strings.Contains(body, `<a href="/blog/first">First</a>`))
+	is.True(strings.Contains(body, `<a href="/blog?page=1">back</a>`))
+
+	is.NoErr(blg.kvSet(configPagination, "all"))
+	body = get("/blog", false).Body.String()
+	is.True(strings.Contains(body, "First") && strings.Contains(body, "Third"))
+	is.True(!strings.Contains(body, "next"))
+
+	w = get("/blog/second", false)
+	is.Equal(w.Code, http.StatusOK)
+	is.True(strings.Contains(w.Body.String(), "<h1>Second</h1>"))
+	is.True(strings.Contains(w.Body.String(), "<strong>bold</strong>"))
+	is.True(strings.Contains(w.Body.String(), "Tuesday, June 2, 2020")) // theme args
+
+	is.Equal(get("/blog/draft", false).Code, http.StatusNotFound)
+	is.Equal(get("/blog/scheduled", false).Code, http.StatusNotFound)
+	is.Equal(get("/blog/taken-down", false).Code, http.StatusNotFound)
+	is.Equal(get("/blog/nonexistent", false).Code, http.StatusNotFound)
+	is.Equal(get("/blog/draft", true).Code, http.StatusOK) // admins can preview
+}
+
+func Test_checkPostURLFormat(t *testing.T) {
+	is := is.New(t)
+	for _, format := range postURLFormats {
+		is.NoErr(checkPostURLFormat(format))
+	}
+	for _, format := range []string{"", "/{slug}", "{slug}/", "{year}", "{slug}/{slug}", "{slug}/{hour}", "{year/{slug}", "{slug}?x=1"} {
+		is.True(checkPostURLFormat(format) != nil)
+	}
+	re := postURLRegexp("{year}-{month}/{slug}.html")
+	is.Equal(re.FindStringSubmatch("2020-06/hello.html"), []string{"2020-06/hello.html", "hello"})
+	is.True(re.FindStringSubmatch("2020-06/hello") == nil)
+	is.True(re.FindStringSubmatch("2020/06/hello.html") == nil)
+}
+
+func Test_PostRedirects(t *testing.T) {
+	is := is.New(t)
+	blg := newTestBlog(t)
+	stubNow(t, "2020-06-10T00:00:00Z")
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		blg.Router.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		return w
+	}
+	redirects := func() map[string]string {
+		rows, err := blg.DB.Query("SELECT url, redirect_url FROM pm_routes")
+		is.NoErr(err)
+		defer rows.Close()
+		m := make(map[string]string)
+		for rows.Next() {
+			var url, redirectURL string
+			is.NoErr(rows.Scan(&url, &redirectURL))
+			m[url] = redirectURL
+		}
+		return m
+	}
+
+	post, err := blg.CreatePost(Post{
+		Title:       "Hello",
+		PublishedOn: sql.NullTime{Time: time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC), Valid: true},
+	})
+	is.NoErr(err)
+	draft, err := blg.CreatePost(Post{Title: "Draft"})
+	is.NoErr(err)
+	is.Equal(get("/blog/hello").Code, http.StatusOK)
+
+	post.Slug = "hi"
+	post, err = blg.UpdatePost(post)
+	is.NoErr(err)
+	draft.Slug = "still-a-draft"
+	_, err = blg.UpdatePost(draft)
+	is.NoErr(err)
+	is.Equal(redirects(), map[string]string{"/blog/hello": "/blog/hi"}) // drafts were never linked to
+	w := get("/blog/hello")
+	is.Equal(w.Code, http.StatusMovedPermanently)
+	is.Equal(w.Header().Get("Location"), "/blog/hi")
+
+	post.Slug = "hello"
+	post, err = blg.UpdatePost(post)
+	is.NoErr(err)
+	is.Equal(redirects(), map[string]string{"/blog/hi": "/blog/hello"}) // no loops
+	is.Equal(get("/blog/hello").Code, http.StatusOK)
+
+	// a new post, or a draft, can take the URL that a post moved away from
+	other, err := blg.CreatePost(Post{Title: "Hi", PublishedOn: post.PublishedOn})
+	is.NoErr(err)
+	is.Equal(other.Slug, "hi")
+	is.Equal(redirects(), map[string]string{})
+	is.Equal(get("/blog/hi").Code, http.StatusOK)
+	is.NoErr(blg.DeletePost(other.PostID))
+	post.Slug = "hi"
+	post, err = blg.UpdatePost(post)
+	is.NoErr(err)
+	post.Slug = "hello"
+	post, err = blg.UpdatePost(post)
+	is.NoErr(err)
+	draft.Slug = "hi"
+	draft, err = blg.UpdatePost(draft)
+	is.NoErr(err)
+	is.Equal(redirects(), map[string]string{})
+	is.NoErr(blg.DeletePost(draft.PostID))
+	post.Slug = "hi"
+	post, err = blg.UpdatePost(post)
+	is.NoErr(err)
+	post.Slug = "hello"
+	post, err = blg.UpdatePost(post)
+	is.NoErr(err)
+	is.Equal(redirects(), map[string]string{"/blog/hi": "/blog/hello"})
+
+	is.NoErr(blg.SetPostURLFormat("{year}/{month}/{day}/{slug}"))
+	is.Equal(redirects(), map[string]string{ // no chains
+		"/blog/hi":    "/blog/2020/06/01/hello",
+		"/blog/hello": "/blog/2020/06/01/hello",
+	})
+	is.Equal(get("/blog/2020/06/01/hello").Code, http.StatusOK)
+	is.Equal(get("/blog/2020/06/02/hello").Code, http.StatusNotFound) // wrong date
+	is.True(strings.Contains(get("/blog").Body.String(), `href="/blog/2020/06/01/hello"`))
+
+	post.PublishedOn.Time = time.Date(2020, 6, 2, 0, 0, 0, 0, time.UTC)
+	_, err = blg.UpdatePost(post)
+	is.NoErr(err)
+	w = get("/blog/2020/06/01/hello")
+	is.Equal(w.Code, http.StatusMovedPermanently)
+	is.Equal(w.Header().Get("Location"), "/blog/2020/06/02/hello")
+
+	form := url.Values{
+		"post-url":       {"{slug}/{year"},
+		"post-index":     {"plainsimple/post-index.html"},
+		"post":           {"plainsimple/post.html"},
+		"search":         {"plainsimple/search.html"},
+		"group":          {"plainsimple/group.html"},
+		"title":          {"My Blog"},
+		"feed-content":   {"full"},
+		"comments":       {"moderated"},
+		"pagination":     {"numbered"},
+		"posts-per-page": {"10"},
+	}
+	r := httptest.NewRequest("POST", "/blog/admin/settings", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.SetBasicAuth("admin", "hunter2")
+	w = httptest.NewRecorder()
+	blg.Router.ServeHTTP(w, r)
+	is.Equal(w.Code, http.StatusBadRequest)
+	is.True(strings.Contains(w.Body.String(), "unclosed placeholder"))
+
+	form.Set("post-url", "{slug}")
+	r = httptest.NewRequest("POST", "/blog/admin/settings", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Sec-Fetch-Site", "cross-site")
+	r.SetBasicAuth("admin", "hunter2")
+	w = httptest.NewRecorder()
+	blg.Router.ServeHTTP(w, r)
+	is.Equal(w.Code, http.StatusForbidden)
+	r = httptest.NewRequest("POST", "/blog/admin/settings", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.SetBasicAuth("admin", "hunter2")
+	w = httptest.NewRecorder()
+	blg.Router.ServeHTTP(w, r)
+	is.Equal(w.Code, http.StatusSeeOther)
+	w = get("/blog/2020/06/02/hello")
+	is.Equal(w.Code, http.StatusMovedPermanently)
+	is.Equal(w.Header().Get("Location"), "/blog/hello")
+	is.Equal(get("/blog/hello").Code, http.StatusOK)
+}
+
+func Test_ftsQuery(t *testing.T) {
+	is := is.New(t)
+	tests := []struct {
+		q    string
+		want string
+	}{
+		{``, ``},
+		{`hello world`, `"hello" "world"`},
+		{`"hello world" foo`, `"hello world" "foo"`},
+		{`hel* "hello wor"*`, `"hel"* "hello wor"*`},
+		{`cats OR dogs`, `"cats" OR "dogs"`},
+		{`OR cats OR OR dogs OR`, `"cats" "dogs"`},
+		{`NOT cats AND dogs`, `"NOT" "cats" "AND" "dogs"`},
+		{`title:x (y) -z ^a "b`, `"title:x" "(y)" "-z" "^a" "b"`},
+		{`* "" !! "`, ``},
+		{`say"hi"`, `"say" "hi"`},
+	}
+	for _, tt := range tests {
+		is.Equal(ftsQuery(tt.q), tt.want) // ftsQuery(tt.q)
+	}
+}
+
+func Test_Search(t *testing.T) {
+	is := is.New(t)
+	blg := newTestBlog(t)
+	stubNow(t, "2020-06-18T10:00:00Z")
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		blg.Router.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		return w
+	}
+	is.Equal(blg.searchable, fts5) // search works exactly when FTS5 is built in
+	if !fts5 {
+		w := get("/blog/search?q=hello")
+		is.Equal(w.Code, http.StatusNotFound)
+		is.True(strings.Contains(w.Body.String(), "Search is not available on this site."))
+		is.True(!strings.Contains(w.Body.String(), "<form"))
+		is.True(!strings.Contains(get("/blog").Body.String(), `href="/blog/search"`))
+		return
+	}
+	is.True(strings.Contains(get("/blog").Body.String(), `href="/blog/search"`))
+	publish := func(title, body string, day int) Post {
+		post, err := blg.CreatePost(Post{
+			Title:       title,
+			Body:        body,
+			PublishedOn: sql.NullTime{Time: time.Date(2020, 6, day, 0, 0, 0, 0, time.UTC), Valid: true},
+		})
+		is.NoErr(err)
+		return post
+	}
+	gophers := publish("The gopher", "All about the <b>gopher</b>, a burrowing rodent.", 1)
+	publish("Rodents", "Squirrels, beavers and a gopher or two.", 2)
+	publish("Ferrets", "Not a rodent at all.", 3)
+	_, err := blg.CreatePost(Post{Title: "Gopher drafts", Body: "gopher"})
+	is.NoErr(err)
+
+	results, err := blg.Search(now(), SearchOptions{Query: "gopher"})
+	is.NoErr(err)
+	is.Equal(len(results), 2)               // drafts are not searched
+	is.Equal(results[0].Slug, "the-gopher") // matches in the title rank first
+	is.Equal(string(results[0].Snippet), "All about the &lt;b&gt;<mark>gopher</mark>&lt;/b&gt;, a burrowing rodent.")
+
+	count, err := blg.CountSearch(now(), SearchOptions{Query: "rodent*"})
+	is.NoErr(err)
+	is.Equal(count, 3)
+	count, err = blg.CountSearch(now(), SearchOptions{Query: `"burrowing rodent"`})
+	is.NoErr(err)
+	is.Equal(count, 1)
+	count, err = blg.CountSearch(now(), SearchOptions{Query: "ferrets OR squirrels"})
+	is.NoErr(err)
+	is.Equal(count, 2)
+	count, err = blg.CountSearch(now(), SearchOptions{
+		Query: "rodent*",
+		From:  time.Date(2020, 6, 2, 0, 0, 0, 0, time.UTC),
+		To:    time.Date(2020, 6, 3, 0, 0, 0, 0, time.UTC),
+	})
+	is.NoErr(err)
+	is.Equal(count, 1)
+
+	// the index follows updates
+	gophers.Title = "Moles"
+	gophers.Body = "Moles are not rodents."
+	_, err = blg.UpdatePost(gophers)
+	is.NoErr(err)
+	count, err = blg.CountSearch(now(), SearchOptions{Query: "gopher"})
+	is.NoErr(err)
+	is.Equal(count, 1)
+
+	w := get("/blog/search?q=" + url.QueryEscape(`rodent* NOT "(`))
+	is.Equal(w.Code, http.StatusOK)
+	w = get("/blog/search?q=squirrels")
+	is.Equal(w.Code, http.StatusOK)
+	is.True(strings.Contains(w.Body.String(), `<mark>Squirrels</mark>`))
+	is.True(strings.Contains(w.Body.String(), `href="/blog/rodents"`))
+	w = get("/blog/search?q=squirrels&from=June")
+	is.Equal(w.Code, http.StatusBadRequest)
+	w = get("/blog/search?q=squirrels&from=2020-06-03")
+	is.Equal(w.Code, http.StatusOK)
+	is.True(strings.Contains(w.Body.String(), "No posts found."))
+}
+
+func Test_PostMeta(t *testing.T) {
+	is := is.New(t)
+	blg := newTestBlog(t)
+	stubNow(t, "2020-06-10T00:00:00Z")
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		blg.Router.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		return w
+	}
+
+	meta, err := parseMeta(" Tag : go\r\n\ntag:  web dev \ncategory:tutorials\ntag: go")
+	is.NoErr(err)
+	post, err := blg.CreatePost(Post{Title: "Go for the web", PublishedOn: sql.NullTime{Time: now(), Valid: true}, Meta: meta})
+	is.NoErr(err)
+	is.Equal(post.Meta, url.Values{"tag": {"go", "web dev"}, "category": {"tutorials"}}) // normalized
+	post, err = blg.GetPost(post.PostID)
+	is.NoErr(err)
+	is.Equal(post.Meta, url.Values{"tag": {"go", "web dev"}, "category": {"tutorials"}})
+	is.Equal(formatMeta(post.Meta), "category: tutorials\ntag: go\ntag: web dev\n")
+	_, err = parseMeta("tag")
+	var postErr *PostError
+	is.True(errors.As(err, &postErr))
+	_, err = blg.CreatePost(Post{Title: "Bad", Meta: url.Values{"a/b": {"c"}}})
+	is.True(errors.As(err, &postErr))
+
+	_, err = blg.CreatePost(Post{Title: "Go basics", PublishedOn: sql.NullTime{Time: now(), Valid: true}, Meta: url.Values{"tag": {"go"}}})
+	is.NoErr(err)
+	_, err = blg.CreatePost(Post{Title: "Go draft", Meta: url.Values{"tag": {"go", "draft"}}})
+	is.NoErr(err)
+
+	groups, err := blg.Groups(now())
+	is.NoErr(err)
+	is.Equal(groups["tag"], []Group{ // drafts don't count
+		{Key: "tag", Value: "go", Count: 2, URL: "/blog/groups/tag/go"},
+		{Key: "tag", Value: "web dev", Count: 1, URL: "/blog/groups/tag/web%20dev"},
+	})
+	count, err := blg.CountPublishedPosts(now(), url.Values{"tag": {"go", "web dev"}})
+	is.NoErr(err)
+	is.Equal(count, 1)
+
+	body := get("/blog?tag=go").Body.String()
+	is.True(strings.Contains(body, "Go for the web") && strings.Contains(body, "Go basics"))
+	body = get("/blog?tag=web+dev").Body.String()
+	is.True(strings.Contains(body, "Go for the web") && !strings.Contains(body, "Go basics"))
+	body = get("/blog?TAG=web+dev&utm_source=x&theme=plainsimple").Body.String() // only metadata keys filter
+	is.True(strings.Contains(body, "Go for the web") && !strings.Contains(body, "Go basics"))
+	query := url.Values{"tag": {"go"}}
+	for i := 0; i < 1000; i++ {
+		query.Add("tag", strconv.Itoa(i))
+	}
+	filter, err := blg.indexFilter(query)
+	is.NoErr(err)
+	is.Equal(len(filter["tag"]), maxFilters)
+	is.Equal(get("/blog?"+query.Encode()).Code, http.StatusOK)
+	is.True(strings.Contains(body, `href="/blog/groups/tag/web%20dev">web dev</a> (1)`)) // tag cloud
+
+	w := get("/blog/groups/tag/web%20dev")
+	is.Equal(w.Code, http.StatusOK)
+	is.True(strings.Contains(w.Body.String(), "Go for the web"))
+	is.True(!strings.Contains(w.Body.String(), "Go basics"))
+	is.Equal(get("/blog/groups/tag/draft").Code, http.StatusNotFound)
+	is.Equal(get("/blog/groups/tag/nonexistent").Code, http.StatusNotFound)
+	is.True(strings.Contains(get("/blog/go-for-the-web").Body.String(), `href="/blog/groups/tag/go">#go</a>`))
+
+	form := url.Values{"title": {"Go for the web"}, "meta": {"tag: go\noops"}}
+	r := httptest.NewRequest("POST", "/blog/admin/posts/"+strconv.FormatInt(post.PostID, 10), strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.SetBasicAuth("admin", "hunter2")
+	w = httptest.NewRecorder()
+	blg.Router.ServeHTTP(w, r)
+	is.Equal(w.Code, http.StatusBadRequest)
+	is.True(strings.Contains(w.Body.String(), "tag: go\noops</textarea>")) // kept as typed
+
+	is.NoErr(blg.DeletePost(post.PostID))
+	var n int
+	is.NoErr(blg.DB.QueryRow("SELECT COUNT(*) FROM blg_post_meta WHERE post_id = ?", post.PostID).Scan(&n))
+	is.Equal(n, 0)
+}
+
+func Test_Feeds(t *testing.T) {
+	is := is.New(t)
+	blg := newTestBlog(t)
+	stubNow(t, "2020-06-10T00:00:00Z")
+	get := func(target string, header ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", target, nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		blg.Router.ServeHTTP(w, r)
+		return w
+	}
+	_, err := blg.CreatePost(Post{
+		Title:       "Old news",
+		Body:        "old",
+		PublishedOn: sql.NullTime{Time: time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC), Valid: true},
+	})
+	is.NoErr(err)
+	stubNow(t, "2020-06-11T00:00:00Z")
+	_, err = blg.CreatePost(Post{
+		Title:       "Scheduled <b>news</b>",
+		Summary:     "In short",
+		Body:        "**big** news",
+		PublishedOn: sql.NullTime{Time: time.Date(2020, 6, 15, 0, 0, 0, 0, time.UTC), Valid: true},
+		Meta:        url.Values{"tag": {"news"}},
+	})
+	is.NoErr(err)
+	_, err = blg.CreatePost(Post{Title: "Draft"})
+	is.NoErr(err)
+	stubNow(t, "2020-06-20T00:00:00Z")
+
+	w := get("/blog/atom.xml")
+	is.Equal(w.Code, http.StatusOK)
+	is.Equal(w.Header().Get("Content-Type"), "application/atom+xml; charset=utf-8")
+	is.Equal(w.Header().Get("Last-Modified"), "Mon, 15 Jun 2020 00:00:00 GMT") // when the scheduled post went up
+	var atom atomFeed
+	is.NoErr(xml.Unmarshal(w.Body.Bytes(), &atom))
+	is.Equal(atom.Title, "My Blog")
+	is.Equal(atom.Updated, "2020-06-15T00:00:00Z")
+	is.Equal(len(atom.Entries), 2) // no drafts
+	entry := atom.Entries[0]
+	is.Equal(entry.Title, "Scheduled <b>news</b>")
+	is.Equal(entry.ID, "tag:example.com,2020-06-11:blog/2")
+	is.Equal(entry.Links[0].Href, "http://example.com/blog/scheduled-b-news-b")
+	r := httptest.NewRequest("GET", "/blog/atom.xml", nil)
+	r.Host = "www.example.com"
+	www := httptest.NewRecorder()
+	blg.Router.ServeHTTP(www, r)
+	var wwwAtom atomFeed
+	is.NoErr(xml.Unmarshal(www.Body.Bytes(), &wwwAtom))
+	is.Equal(wwwAtom.Entries[0].ID, entry.ID) // the same entry on the www domain
+	is.NoErr(blg.kvSet(configSiteURL, "https://blog.example.org"))
+	var siteAtom atomFeed
+	is.NoErr(xml.Unmarshal(get("/blog/atom.xml").Body.Bytes(), &siteAtom))
+	is.Equal(siteAtom.Entries[0].ID, "tag:blog.example.org,2020-06-11:blog/2")
+	is.Equal(siteAtom.Entries[0].Links[0].Href, "https://blog.example.org/blog/scheduled-b-news-b")
+	is.NoErr(blg.kvSet(configSiteURL, ""))
+	siteURL, err := checkSiteURL("https://example.com/")
+	is.NoErr(err)
+	is.Equal(siteURL, "https://example.com")
+	_, err = checkSiteURL("example.com/blog")
+	is.True(err != nil)
+	is.Equal(entry.Content.Body, "<p><strong>big</strong> news</p>\n")
+	is.Equal(entry.Summary.Body, "In short")
+	is.Equal(entry.Categories, []atomCategory{{Term: "news"}})
+
+	etag := w.Header().Get("ETag")
+	is.True(etag != "")
+	is.Equal(get("/blog/atom.xml", "If-None-Match", etag).Code, http.StatusNotModified)
+	is.Equal(get("/blog/atom.xml", "If-Modified-Since", "Mon, 15 Jun 2020 00:00:00 GMT").Code, http.StatusNotModified)
+	is.Equal(get("/blog/atom.xml", "If-Modified-Since", "Sun, 14 Jun 2020 00:00:00 GMT").Code, http.StatusOK)
+
+	w = get("/blog/rss.xml")
+	is.Equal(w.Header().Get("Content-Type"), "application/rss+xml; charset=utf-8")
+	var rss rssFeed
+	is.NoErr(xml.Unmarshal(w.Body.Bytes(), &rss))
+	is.Equal(len(rss.Channel.Items), 2)
+	is.Equal(rss.Channel.Items[1].Title, "Old news")
+	is.Equal(rss.Channel.Items[1].PubDate, "Mon, 01 Jun 2020 00:00:00 +0000")
+
+	is.NoErr(blg.kvSet(configFeedContent, "summary"))
+	w = get("/blog/feed.json")
+	is.Equal(w.Header().Get("Content-Type"), "application/feed+json; charset=utf-8")
+	var jf jsonFeed
+	is.NoErr(json.Unmarshal(w.Body.Bytes(), &jf))
+	is.Equal(jf.FeedURL, "http://example.com/blog/feed.json")
+	is.Equal(jf.Items[0].ContentHTML, "<p>In short</p>")
+	is.Equal(jf.Items[1].ContentHTML, "<p>old</p>\n") // no summary to show instead
+
+	w = get("/blog/groups/tag/news/rss.xml")
+	is.Equal(w.Code, http.StatusOK)
+	rss = rssFeed{}
+	is.NoErr(xml.Unmarshal(w.Body.Bytes(), &rss))
+	is.Equal(rss.Channel.Title, "My Blog - tag: news")
+	is.Equal(len(rss.Channel.Items), 1)
+	is.Equal(get("/blog/groups/tag/nonexistent/rss.xml").Code, http.StatusNotFound)
+
+	body := get("/blog").Body.String()
+	is.True(strings.Contains(body, `<link rel="alternate" type="application/atom+xml" title="My Blog (Atom)" href="/blog/atom.xml">`))
+	body = get("/blog/groups/tag/news").Body.String()
+	is.True(strings.Contains(body, `href="/blog/atom.xml"`))
+	is.True(strings.Contains(body, `href="/blog/groups/tag/news/atom.xml"`))
+}
+
+func Test_Sitemap(t *testing.T) {
+	is := is.New(t)
+	blg := newTestBlog(t)
+	stubNow(t, "2020-06-10T00:00:00Z")
+	published := sql.NullTime{Time: time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC), Valid: true}
+	_, err := blg.CreatePost(Post{Title: "Hello", PublishedOn: published, Meta: url.Values{"tag": {"go"}}})
+	is.NoErr(err)
+	_, err = blg.CreatePost(Post{Title: "Secret", PublishedOn: published})
+	is.NoErr(err)
+	_, err = blg.CreatePost(Post{Title: "Draft"})
+	is.NoErr(err)
+	_, err = blg.DB.Exec("INSERT INTO pm_routes (url, noindex) VALUES ('/blog/secret', TRUE)")
+	is.NoErr(err)
+
+	urls, err := blg.PageManager.SitemapURLs()
+	is.NoErr(err)
+	updated := time.Date(2020, 6, 10, 0, 0, 0, 0, time.UTC)
+	is.Equal(urls, []pagemanager.SitemapURL{
+		{Path: "/blog", LastMod: updated},
+		{Path: "/blog/groups/tag/go"},
+		{Path: "/blog/hello", LastMod: updated},
+	})
+
+	w := httptest.NewRecorder()
+	blg.Router.ServeHTTP(w, httptest.NewRequest("GET", "/blog/secret", nil))
+	is.Equal(w.Code, http.StatusOK)
+	is.True(strings.Contains(w.Body.String(), `<meta name="robots" content="noindex">`))
+	w = httptest.NewRecorder()
+	blg.Router.ServeHTTP(w, httptest.NewRequest("GET", "/blog/hello", nil))
+	is.True(!strings.Contains(w.Body.String(), `name="robots"`))
+}
+
+func Test_Export(t *testing.T) {
+	is := is.New(t)
+	blg := newTestBlog(t)
+	stubNow(t, "2020-06-10T00:00:00Z")
+	published := sql.NullTime{Time: time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC), Valid: true}
+	hello, err := blg.CreatePost(Post{Title: "Hello", PublishedOn: published, Meta: url.Values{"tag": {"go"}}})
+	is.NoErr(err)
+	_, err = blg.CreatePost(Post{Title: "Secret", PublishedOn: published})
+	is.NoErr(err)
+	_, err = blg.CreatePost(Post{Title: "Draft"})
+	is.NoErr(err)
+	_, err = blg.DB.Exec("INSERT INTO pm_routes (url, noindex) VALUES ('/blog/secret', TRUE)")
+	is.NoErr(err)
+	comment, err := blg.CreateComment(Comment{PostID: hello.PostID, Author: "Alice", Body: "First!", IP: "192.0.2.1"})
+	is.NoErr(err)
+	is.NoErr(blg.SetCommentStatus(comment.CommentID, commentApproved))
+
+	dir := t.TempDir()
+	report, err := blg.PageManager.Export(dir, pagemanager.ExportOptions{BaseURL: "https://example.com"})
+	is.NoErr(err)
+	is.Equal(report.Files, []string{
+		"blog/atom.xml",
+		"blog/comments/1/index.html", // the permalink of the comment
+		"blog/comments/posts/1.atom",
+		"blog/comments/posts/2.atom",
+		"blog/feed.json",
+		"blog/groups/tag/go/atom.xml",
+		"blog/groups/tag/go/feed.json",
+		"blog/groups/tag/go/index.html",
+		"blog/groups/tag/go/rss.xml",
+		"blog/hello/index.html",
+		"blog/index.html",
+		"blog/rss.xml",
+		"blog/secret/index.html",
+		"robots.txt",
+		"sitemap.xml",
+	})
+	is.Equal(len(report.Skipped), 0)
+	read := func(name string) string {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		is.NoErr(err)
+		return string(b)
+	}
+	page := read("blog/hello/index.html")
+	is.True(!strings.Contains(page, "nonce-"))
+	is.True(strings.Contains(page, `href="/blog/rss.xml"`))
+	is.True(strings.Contains(page, "First!"))
+	is.True(!strings.Contains(page, "<form"))         // static pages cannot take comments
+	is.True(!strings.Contains(page, "?reply="))       // nor replies
+	is.True(!strings.Contains(page, `/blog/search"`)) // nor search
+	is.Equal(blg.DynamicURLs(), []string{"/blog/search", "/blog/edit", "/blog/admin"})
+	is.True(strings.Contains(read("blog/secret/index.html"), `<meta name="robots" content="noindex">`))
+	_, err = blg.PageManager.Export(dir, pagemanager.ExportOptions{BaseURL: "https://example.com"})
+	is.NoErr(err)
+	is.Equal(read("blog/hello/index.html"), page) // the same every time
+}
+
+func Test_Comments(t *testing.T) {
+	is := is.New(t)
+	blg := newTestBlog(t)
+	stubNow(t, "2020-06-10T00:00:00Z")
+	published := sql.NullTime{Time: time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC), Valid: true}
+	post, err := blg.CreatePost(Post{Title: "Hello", PublishedOn: published})
+	is.NoErr(err)
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		blg.Router.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		return w
+	}
+	postForm := func(target string, form url.Values, admin bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", target, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if admin {
+			r.SetBasicAuth("admin", "hunter2")
+		}
+		w := httptest.NewRecorder()
+		blg.Router.ServeHTTP(w, r)
+		return w
+	}
+	comment := func(author, body string, parentID int64) *httptest.ResponseRecorder {
+		form := url.Values{
+			"post_id": {strconv.FormatInt(post.PostID, 10)},
+			"author":  {author},
+			"body":    {body},
+		}
+		if parentID != 0 {
+			form.Set("parent_id", strconv.FormatInt(parentID, 10))
+		}
+		return postForm("/blog/comments", form, false)
+	}
+	moderate := func(commentID int64, action string) *httptest.ResponseRecorder {
+		return postForm("/blog/admin/comments/"+strconv.FormatInt(commentID, 10), url.Values{"action": {action}}, true)
+	}
+
+	// new comments await approval
+	w := comment("Alice", "First! <script>alert(1)</script>", 0)
+	is.Equal(w.Code, http.StatusSeeOther)
+	is.Equal(w.Header().Get("Location"), "/blog/hello?comment=pending#comments")
+	body := get("/blog/hello?comment=pending").Body.String()
+	is.True(strings.Contains(body, "once it is approved"))
+	is.True(!strings.Contains(body, "First!"))
+	is.Equal(get("/blog/comments/1").Code, http.StatusNotFound)
+	count, err := blg.CountComments(commentPending)
+	is.NoErr(err)
+	is.Equal(count, 1)
+
+	r := httptest.NewRequest("GET", "/blog/admin/comments", nil)
+	r.SetBasicAuth("admin", "hunter2")
+	w = httptest.NewRecorder()
+	blg.Router.ServeHTTP(w, r)
+	is.Equal(w.Code, http.StatusOK)
+	is.True(strings.Contains(w.Body.String(), "Alice"))
+
+	r = httptest.NewRequest("POST", "/blog/admin/comments/1", strings.NewReader("action=approve"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Sec-Fetch-Site", "cross-site")
+	r.SetBasicAuth("admin", "hunter2")
+	w = httptest.NewRecorder()
+	blg.Router.ServeHTTP(w, r)
+	is.Equal(w.Code, http.StatusForbidden)
+	w = moderate(1, "approve")
+	is.Equal(w.Code, http.StatusSeeOther)
+	is.Equal(moderate(99, "approve").Code, http.StatusNotFound)
+	body = get("/blog/hello").Body.String()
+	is.True(strings.Contains(body, `id="comment-1"`))
+	is.True(strings.Contains(body, "First!"))
+	is.True(!strings.Contains(body, "<script>")) // sanitized
+	is.True(strings.Contains(body, `href="/blog/comments/posts/1.atom"`))
+
+	// replies are nested under their comment
+	w = comment("Bob", "Second!", 1)
+	is.Equal(w.Code, http.StatusSeeOther)
+	is.Equal(moderate(2, "approve").Code, http.StatusSeeOther)
+	comments, err := blg.PostComments(post.PostID, commentApproved)
+	is.NoErr(err)
+	threads, err := blg.commentThreads(comments)
+	is.NoErr(err)
+	is.Equal(len(threads), 1)
+	is.Equal(len(threads[0].Replies), 1)
+	is.Equal(threads[0].Replies[0].Author, "Bob")
+	is.True(strings.Contains(get("/blog/hello?reply=1").Body.String(), "Replying to Alice"))
+	is.Equal(comment("Bob", "Reply to nothing", 42).Code, http.StatusBadRequest)
+
+	// permalinks and the comment feed
+	w = get("/blog/comments/2")
+	is.Equal(w.Code, http.StatusFound)
+	is.Equal(w.Header().Get("Location"), "/blog/hello#comment-2")
+	w = get("/blog/comments/posts/1.atom")
+	is.Equal(w.Code, http.StatusOK)
+	is.True(strings.Contains(w.Body.String(), "Second!"))
+
+	// invalid comments show the form again as submitted
+	w = comment("", "Who am I?", 0)
+	is.Equal(w.Code, http.StatusBadRequest)
+	is.True(strings.Contains(w.Body.String(), "Who am I?"))
+
+	// bots fill in the honeypot, and their comments are dropped
+	w = postForm("/blog/comments", url.Values{
+		"post_id":       {strconv.FormatInt(post.PostID, 10)},
+		"author":        {"Bot"},
+		"body":          {"Buy now"},
+		commentHoneypot: {"bot@example.com"},
+	}, false)
+	is.Equal(w.Code, http.StatusSeeOther)
+	count, err = blg.CountComments(commentPending)
+	is.NoErr(err)
+	is.Equal(count, 0)
+
+	// rate limit
+	for i := 0; i < commentLimit-2; i++ {
+		is.Equal(comment("Carol", "Again", 0).Code, http.StatusSeeOther)
+	}
+	is.Equal(comment("Carol", "Again", 0).Code, http.StatusTooManyRequests)
+	stubNow(t, "2020-06-10T00:11:00Z")
+	is.Equal(comment("Carol", "Later", 0).Code, http.StatusSeeOther)
+
+	// deleting a comment keeps its replies
+	is.Equal(moderate(1, "delete").Code, http.StatusSeeOther)
+	reply, err := blg.GetComment(2)
+	is.NoErr(err)
+	is.True(!reply.ParentID.Valid)
+	_, err = blg.GetComment(1)
+	is.True(errors.Is(err, ErrCommentNotFound))
+
+	is.NoErr(blg.kvSet(configComments, "closed"))
+	is.Equal(comment("Dave", "Hello?", 0).Code, http.StatusForbidden)
+	is.True(strings.Contains(get("/blog/hello").Body.String(), "Comments are closed"))
+
+	is.NoErr(blg.DeletePost(post.PostID))
+	count, err = blg.CountComments(commentPending)
+	is.NoErr(err)
+	is.Equal(count, 0)
+}
+
+func Test_CommentLimit(t *testing.T) {
+	is := is.New(t)
+	blg := newTestBlog(t)
+	stubNow(t, "2020-06-10T00:00:00Z")
+	published := sql.NullTime{Time: time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC), Valid: true}
+	post, err := blg.CreatePost(Post{Title: "Hello", PublishedOn: published})
+	is.NoErr(err)
+
+	// comments posted at the same time cannot get past the limit together
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*commentLimit)
+	for i := 0; i < 2*commentLimit; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := blg.CreateComment(Comment{PostID: post.PostID, Author: "Carol", Body: "Again", IP: "192.0.2.1"})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	var limited int
+	for err := range errs {
+		if errors.Is(err, ErrTooManyComments) {
+			limited++
+		} else {
+			is.NoErr(err)
+		}
+	}
+	is.Equal(limited, commentLimit)
+	count, err := blg.CountComments(commentPending)
+	is.NoErr(err)
+	is.Equal(count, commentLimit)
+}
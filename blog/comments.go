@@ -0,0 +1,626 @@
+package blog
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi"
+)
+
+// Comment is a row in blg_comments. Timestamps are in UTC.
+type Comment struct {
+	CommentID int64
+	PostID    int64
+	ParentID  sql.NullInt64 // the comment replied to
+	Author    string
+	Website   string // may be empty
+	Body      string // markdown
+	Status    string // commentPending, commentApproved or commentSpam
+	IP        string // the address the comment was posted from
+	CreatedAt time.Time
+}
+
+// The statuses of a comment. Only approved comments are shown on the post.
+const (
+	commentPending  = "pending"
+	commentApproved = "approved"
+	commentSpam     = "spam"
+)
+
+// Spam protection: no more than commentLimit comments can be posted from an
+// IP address (see pagemanager.ClientIP) every commentWindow.
+const (
+	commentLimit  = 5
+	commentWindow = 10 * time.Minute
+)
+
+// commentHoneypot is the comment form field hidden from people. Only bots
+// fill it in, and their comments are thrown away.
+const commentHoneypot = "email"
+
+var (
+	// ErrCommentNotFound is returned when a comment does not exist.
+	ErrCommentNotFound = errors.New("comment not found")
+	// ErrCommentsClosed is returned when a comment is posted while the
+	// comments setting is "closed", or to a post that is not published.
+	ErrCommentsClosed = errors.New("comments are closed")
+	// ErrTooManyComments is returned when an IP address goes over the
+	// comment rate limit.
+	ErrTooManyComments = errors.New("too many comments, please try again later")
+)
+
+// CommentError is returned when a comment fails validation. Field is the name
+// of the offending field in the comment form.
+type CommentError struct {
+	Field string
+	Msg   string
+}
+
+func (e *CommentError) Error() string {
+	return e.Field + ": " + e.Msg
+}
+
+const commentColumns = "comment_id, post_id, parent_id, author, website, body, status, ip, created_at"
+
+func scanComment(row interface{ Scan(...interface{}) error }) (Comment, error) {
+	var comment Comment
+	err := row.Scan(
+		&comment.CommentID, &comment.PostID, &comment.ParentID, &comment.Author, &comment.Website,
+		&comment.Body, &comment.Status, &comment.IP, &comment.CreatedAt,
+	)
+	return comment, err
+}
+
+func (blg *Blog) queryComments(query string, args ...interface{}) ([]Comment, error) {
+	rows, err := blg.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var comments []Comment
+	for rows.Next() {
+		comment, err := scanComment(rows)
+		if err != nil {
+			return nil, err
+		}
+		comments = append(comments, comment)
+	}
+	return comments, rows.Err()
+}
+
+// GetComment returns the comment with the given id.
+func (blg *Blog) GetComment(commentID int64) (Comment, error) {
+	comment, err := scanComment(blg.DB.QueryRow("SELECT "+commentColumns+" FROM blg_comments WHERE comment_id = ?", commentID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return comment, ErrCommentNotFound
+	}
+	return comment, err
+}
+
+// PostComments returns the comments on a post with the given status, oldest
+// first.
+func (blg *Blog) PostComments(postID int64, status string) ([]Comment, error) {
+	return blg.queryComments(
+		"SELECT "+commentColumns+" FROM blg_comments WHERE post_id = ? AND status = ? ORDER BY created_at, comment_id",
+		postID, status,
+	)
+}
+
+// ListComments returns the comments with the given status on every post,
+// newest first.
+func (blg *Blog) ListComments(status string) ([]Comment, error) {
+	return blg.queryComments(
+		"SELECT "+commentColumns+" FROM blg_comments WHERE status = ? ORDER BY created_at DESC, comment_id DESC",
+		status,
+	)
+}
+
+// CountComments returns the number of comments with the given status.
+func (blg *Blog) CountComments(status string) (int, error) {
+	var count int
+	err := blg.DB.QueryRow("SELECT COUNT(*) FROM blg_comments WHERE status = ?", status).Scan(&count)
+	return count, err
+}
+
+// CreateComment saves a new comment on a published post. The comment is
+// pending until approved, unless the comments setting is "open". A reply must
+// be to an approved comment on the same post.
+func (blg *Blog) CreateComment(comment Comment) (Comment, error) {
+	mode, err := blg.config(configComments)
+	if err != nil {
+		return comment, err
+	}
+	if mode == "closed" {
+		return comment, ErrCommentsClosed
+	}
+	comment.Status = commentPending
+	if mode == "open" {
+		comment.Status = commentApproved
+	}
+	comment, err = prepareComment(comment)
+	if err != nil {
+		return comment, err
+	}
+	post, err := blg.GetPost(comment.PostID)
+	if err != nil {
+		return comment, err
+	}
+	t := now()
+	if !post.IsPublished(t) {
+		return comment, ErrCommentsClosed
+	}
+	if comment.ParentID.Valid {
+		parent, err := blg.GetComment(comment.ParentID.Int64)
+		if errors.Is(err, ErrCommentNotFound) || err == nil && (parent.PostID != comment.PostID || parent.Status != commentApproved) {
+			return comment, &CommentError{Field: "parent_id", Msg: "no such comment to reply to"}
+		}
+		if err != nil {
+			return comment, err
+		}
+	}
+	// the count and the insert are in one transaction, so that comments
+	// posted at the same time cannot all get under the limit
+	tx, err := blg.DB.Begin()
+	if err != nil {
+		return comment, err
+	}
+	defer tx.Rollback()
+	var count int
+	err = tx.QueryRow("SELECT COUNT(*) FROM blg_comments WHERE ip = ? AND created_at > ?", comment.IP, t.Add(-commentWindow)).Scan(&count)
+	if err != nil {
+		return comment, err
+	}
+	if count >= commentLimit {
+		return comment, ErrTooManyComments
+	}
+	comment.CreatedAt = t
+	result, err := tx.Exec(
+		"INSERT INTO blg_comments (post_id, parent_id, author, website, body, status, ip, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		comment.PostID, comment.ParentID, comment.Author, comment.Website, comment.Body, comment.Status, comment.IP, comment.CreatedAt,
+	)
+	if err != nil {
+		return comment, err
+	}
+	comment.CommentID, err = result.LastInsertId()
+	if err != nil {
+		return comment, err
+	}
+	return comment, tx.Commit()
+}
+
+// prepareComment validates the comment and normalizes its fields for saving.
+func prepareComment(comment Comment) (Comment, error) {
+	comment.Author = strings.TrimSpace(comment.Author)
+	if comment.Author == "" {
+		return comment, &CommentError{Field: "author", Msg: "please give a name"}
+	}
+	if utf8.RuneCountInString(comment.Author) > 100 {
+		return comment, &CommentError{Field: "author", Msg: "must be at most 100 characters"}
+	}
+	comment.Website = strings.TrimSpace(comment.Website)
+	if comment.Website != "" {
+		u, err := url.Parse(comment.Website)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || len(comment.Website) > 200 {
+			return comment, &CommentError{Field: "website", Msg: "must be an http or https URL of at most 200 characters"}
+		}
+	}
+	comment.Body = strings.TrimSpace(strings.ReplaceAll(comment.Body, "\r\n", "\n"))
+	if comment.Body == "" {
+		return comment, &CommentError{Field: "body", Msg: "a comment needs a body"}
+	}
+	if utf8.RuneCountInString(comment.Body) > 10000 {
+		return comment, &CommentError{Field: "body", Msg: "must be at most 10000 characters"}
+	}
+	return comment, nil
+}
+
+// SetCommentStatus approves a comment or marks it as spam (or back as
+// pending).
+func (blg *Blog) SetCommentStatus(commentID int64, status string) error {
+	if status != commentPending && status != commentApproved && status != commentSpam {
+		return fmt.Errorf("invalid comment status %q", status)
+	}
+	result, err := blg.DB.Exec("UPDATE blg_comments SET status = ? WHERE comment_id = ?", status, commentID)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrCommentNotFound
+	}
+	return nil
+}
+
+// DeleteComment deletes a comment. Its replies become replies to the comment
+// it replied to, so that they stay in the thread.
+func (blg *Blog) DeleteComment(commentID int64) error {
+	tx, err := blg.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(
+		"UPDATE blg_comments SET parent_id = (SELECT parent_id FROM blg_comments WHERE comment_id = ?) WHERE parent_id = ?",
+		commentID, commentID,
+	)
+	if err != nil {
+		return err
+	}
+	result, err := tx.Exec("DELETE FROM blg_comments WHERE comment_id = ?", commentID)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrCommentNotFound
+	}
+	return tx.Commit()
+}
+
+// commentURL returns the permalink of a comment, which redirects to the
+// comment on its post (see CommentGet).
+func (blg *Blog) commentURL(commentID int64) string {
+	return "/" + blg.namespace + "/comments/" + strconv.FormatInt(commentID, 10)
+}
+
+// commentFeedURL returns the URL of the Atom feed of the comments on a post.
+func (blg *Blog) commentFeedURL(postID int64) string {
+	return "/" + blg.namespace + "/comments/posts/" + strconv.FormatInt(postID, 10) + ".atom"
+}
+
+// commentAnchor is the id of the comment's element on the post page.
+func commentAnchor(commentID int64) string {
+	return "comment-" + strconv.FormatInt(commentID, 10)
+}
+
+// CommentData is a comment as seen by the theme templates.
+type CommentData struct {
+	CommentID int64
+	Author    string
+	Website   string
+	Content   template.HTML // the body converted from markdown
+	Created   time.Time
+	URL       string // the permalink
+	Anchor    string // the id of the comment's element on the post page
+	ReplyURL  string // empty if the comment form is not shown
+	Replies   []CommentData
+}
+
+// CommentForm is the comment form of a post, with the values that were
+// submitted if it is being shown again.
+type CommentForm struct {
+	PostID    int64
+	ParentID  int64  // the comment being replied to, 0 for none
+	ReplyTo   string // the author of the comment being replied to
+	Author    string
+	Website   string
+	Body      string
+	Honeypot  string // the name of the field that must be left empty
+	CancelURL string // the post without the reply
+}
+
+// CommentsData is the comment section of a post as seen by the theme
+// templates.
+type CommentsData struct {
+	Open    bool          // whether new comments are taken
+	Static  bool          // whether the post is exported as a static page, which cannot take comments
+	Count   int           // the number of approved comments
+	Threads []CommentData // the top-level comments, with their replies
+	FormURL string
+	FeedURL string
+	Form    CommentForm
+	Error   string // why the submitted comment was not taken
+	Pending bool   // whether a comment was just posted and awaits approval
+}
+
+// commentThreads converts the approved comments of a post for the theme
+// templates, nesting the replies under their comment. Replies to a comment
+// that is no longer approved become top-level comments.
+func (blg *Blog) commentThreads(comments []Comment) ([]CommentData, error) {
+	replies := make(map[int64][]Comment)
+	approved := make(map[int64]bool)
+	for _, comment := range comments {
+		approved[comment.CommentID] = true
+	}
+	var top []Comment
+	for _, comment := range comments {
+		if comment.ParentID.Valid && approved[comment.ParentID.Int64] {
+			replies[comment.ParentID.Int64] = append(replies[comment.ParentID.Int64], comment)
+		} else {
+			top = append(top, comment)
+		}
+	}
+	var convert func([]Comment) ([]CommentData, error)
+	convert = func(comments []Comment) ([]CommentData, error) {
+		var data []CommentData
+		for _, comment := range comments {
+			content, err := blg.Render.MarkdownHTML([]byte(comment.Body))
+			if err != nil {
+				return nil, err
+			}
+			children, err := convert(replies[comment.CommentID])
+			if err != nil {
+				return nil, err
+			}
+			data = append(data, CommentData{
+				CommentID: comment.CommentID,
+				Author:    comment.Author,
+				Website:   comment.Website,
+				Content:   content,
+				Created:   comment.CreatedAt,
+				URL:       blg.commentURL(comment.CommentID),
+				Anchor:    commentAnchor(comment.CommentID),
+				ReplyURL:  "?reply=" + strconv.FormatInt(comment.CommentID, 10) + "#comment-form",
+				Replies:   children,
+			})
+		}
+		return data, nil
+	}
+	return convert(top)
+}
+
+// commentsData returns the comment section of a post at postURL. form is the
+// comment form, and commentErr why it was not taken if it is being shown
+// again. static is whether the post is exported as a static page (see
+// pagemanager.IsExport), which leaves out the comment form.
+func (blg *Blog) commentsData(postURL string, post Post, form CommentForm, commentErr error, static bool) (CommentsData, error) {
+	mode, err := blg.config(configComments)
+	if err != nil {
+		return CommentsData{}, err
+	}
+	comments, err := blg.PostComments(post.PostID, commentApproved)
+	if err != nil {
+		return CommentsData{}, err
+	}
+	threads, err := blg.commentThreads(comments)
+	if err != nil {
+		return CommentsData{}, err
+	}
+	form.PostID = post.PostID
+	form.Honeypot = commentHoneypot
+	form.CancelURL = postURL + "#comment-form"
+	for _, comment := range comments {
+		if comment.CommentID == form.ParentID {
+			form.ReplyTo = comment.Author
+		}
+	}
+	if form.ReplyTo == "" {
+		form.ParentID = 0
+	}
+	data := CommentsData{
+		Open:    mode != "closed",
+		Static:  static,
+		Count:   len(comments),
+		Threads: threads,
+		FormURL: "/" + blg.namespace + "/comments",
+		FeedURL: blg.commentFeedURL(post.PostID),
+		Form:    form,
+	}
+	if commentErr != nil {
+		data.Error = commentErr.Error()
+	}
+	if !data.Open || data.Static {
+		removeReplyURLs(data.Threads)
+	}
+	return data, nil
+}
+
+// removeReplyURLs clears the reply links of the comments and their replies.
+func removeReplyURLs(comments []CommentData) {
+	for i := range comments {
+		comments[i].ReplyURL = ""
+		removeReplyURLs(comments[i].Replies)
+	}
+}
+
+// commentFeedLink returns the auto-discovery <link> tag of the comment feed
+// of a post.
+func commentFeedLink(postTitle, href string) template.HTML {
+	return template.HTML(fmt.Sprintf(`<link rel="alternate" type="%s" title="%s" href="%s">`+"\n",
+		feedTypes[feedAtom],
+		template.HTMLEscapeString("Comments on "+postTitle),
+		template.HTMLEscapeString(href),
+	))
+}
+
+// CommentPost takes a comment from the comment form of a post. The comment
+// shows up at once if it is approved, otherwise the post is shown with a
+// notice that the comment awaits approval. A comment that is not taken shows
+// the post with the form as submitted and the reason.
+func (blg *Blog) CommentPost(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	postID, err := strconv.ParseInt(r.PostForm.Get("post_id"), 10, 64)
+	if err != nil {
+		blg.Router.NotFoundHandler().ServeHTTP(w, r)
+		return
+	}
+	post, err := blg.GetPost(postID)
+	if errors.Is(err, ErrPostNotFound) || err == nil && !post.IsPublished(now()) {
+		blg.Router.NotFoundHandler().ServeHTTP(w, r)
+		return
+	}
+	if err != nil {
+		blg.render.InternalServerError(w, r, err)
+		return
+	}
+	format, err := blg.postURLFormat()
+	if err != nil {
+		blg.render.InternalServerError(w, r, err)
+		return
+	}
+	postURL := blg.postURL(format, post)
+	if r.PostForm.Get(commentHoneypot) != "" {
+		// a bot, let it believe that the comment awaits approval
+		http.Redirect(w, r, postURL+"?comment=pending#comments", http.StatusSeeOther)
+		return
+	}
+	form := CommentForm{
+		Author:  r.PostForm.Get("author"),
+		Website: r.PostForm.Get("website"),
+		Body:    r.PostForm.Get("body"),
+	}
+	comment := Comment{PostID: postID, Author: form.Author, Website: form.Website, Body: form.Body, IP: blg.ClientIP(r)}
+	if parentID, err := strconv.ParseInt(r.PostForm.Get("parent_id"), 10, 64); err == nil && parentID != 0 {
+		form.ParentID = parentID
+		comment.ParentID = sql.NullInt64{Int64: parentID, Valid: true}
+	}
+	comment, err = blg.CreateComment(comment)
+	var commentErr *CommentError
+	if errors.As(err, &commentErr) || errors.Is(err, ErrCommentsClosed) || errors.Is(err, ErrTooManyComments) {
+		blg.renderPost(w, r, post, form, err)
+		return
+	}
+	if err != nil {
+		blg.render.InternalServerError(w, r, err)
+		return
+	}
+	if comment.Status != commentApproved {
+		http.Redirect(w, r, postURL+"?comment=pending#comments", http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, postURL+"#"+commentAnchor(comment.CommentID), http.StatusSeeOther)
+}
+
+// CommentGet is the permalink of a comment. It redirects to the comment on
+// its post, wherever the post URL format puts the post.
+func (blg *Blog) CommentGet(w http.ResponseWriter, r *http.Request) {
+	commentID, err := strconv.ParseInt(chi.URLParam(r, "commentID"), 10, 64)
+	if err != nil {
+		blg.Router.NotFoundHandler().ServeHTTP(w, r)
+		return
+	}
+	comment, err := blg.GetComment(commentID)
+	if errors.Is(err, ErrCommentNotFound) || err == nil && comment.Status != commentApproved {
+		blg.Router.NotFoundHandler().ServeHTTP(w, r)
+		return
+	}
+	if err != nil {
+		blg.render.InternalServerError(w, r, err)
+		return
+	}
+	post, err := blg.GetPost(comment.PostID)
+	if err != nil {
+		blg.render.InternalServerError(w, r, err)
+		return
+	}
+	if !post.IsPublished(now()) {
+		blg.Router.NotFoundHandler().ServeHTTP(w, r)
+		return
+	}
+	format, err := blg.postURLFormat()
+	if err != nil {
+		blg.render.InternalServerError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, blg.postURL(format, post)+"#"+commentAnchor(comment.CommentID), http.StatusFound)
+}
+
+// CommentFeedGet serves the Atom feed of the latest approved comments on a
+// published post, so that commenters can follow the replies without handing
+// out an email address.
+func (blg *Blog) CommentFeedGet(w http.ResponseWriter, r *http.Request) {
+	postID, err := strconv.ParseInt(chi.URLParam(r, "postID"), 10, 64)
+	if err != nil {
+		blg.Router.NotFoundHandler().ServeHTTP(w, r)
+		return
+	}
+	post, err := blg.GetPost(postID)
+	if errors.Is(err, ErrPostNotFound) || err == nil && !post.IsPublished(now()) {
+		blg.Router.NotFoundHandler().ServeHTTP(w, r)
+		return
+	}
+	if err != nil {
+		blg.render.InternalServerError(w, r, err)
+		return
+	}
+	f, err := blg.buildCommentFeed(r, post)
+	if err != nil {
+		blg.render.InternalServerError(w, r, err)
+		return
+	}
+	base, _, err := blg.feedBase(r)
+	if err != nil {
+		blg.render.InternalServerError(w, r, err)
+		return
+	}
+	b, err := encodeAtom(f, base+blg.commentFeedURL(post.PostID))
+	if err != nil {
+		blg.render.InternalServerError(w, r, err)
+		return
+	}
+	serveFeed(w, r, feedTypes[feedAtom], b, f.Updated)
+}
+
+// buildCommentFeed returns the feed of the latest approved comments on the
+// post, newest first.
+func (blg *Blog) buildCommentFeed(r *http.Request, post Post) (feed, error) {
+	comments, err := blg.queryComments(
+		"SELECT "+commentColumns+" FROM blg_comments WHERE post_id = ? AND status = ?"+
+			" ORDER BY created_at DESC, comment_id DESC LIMIT ?",
+		post.PostID, commentApproved, feedSize,
+	)
+	if err != nil {
+		return feed{}, err
+	}
+	format, err := blg.postURLFormat()
+	if err != nil {
+		return feed{}, err
+	}
+	author, err := blg.config(configAuthor)
+	if err != nil {
+		return feed{}, err
+	}
+	if author == "" {
+		author, err = blg.config(configTitle)
+		if err != nil {
+			return feed{}, err
+		}
+	}
+	base, hostname, err := blg.feedBase(r)
+	if err != nil {
+		return feed{}, err
+	}
+	postURL := base + blg.postURL(format, post)
+	f := feed{Title: "Comments on " + post.Title, Author: author, HomeURL: postURL}
+	for _, comment := range comments {
+		content, err := blg.Render.MarkdownHTML([]byte(comment.Body))
+		if err != nil {
+			return feed{}, err
+		}
+		title := comment.Author + " commented on " + post.Title
+		if comment.ParentID.Valid {
+			title = comment.Author + " replied to a comment on " + post.Title
+		}
+		entry := feedEntry{
+			ID:        "tag:" + hostname + "," + comment.CreatedAt.Format("2006-01-02") + ":" + blg.namespace + "/comments/" + strconv.FormatInt(comment.CommentID, 10),
+			URL:       postURL + "#" + commentAnchor(comment.CommentID),
+			Title:     title,
+			Content:   string(content),
+			Published: comment.CreatedAt,
+			Updated:   comment.CreatedAt,
+		}
+		if entry.Updated.After(f.Updated) {
+			f.Updated = entry.Updated
+		}
+		f.Entries = append(f.Entries, entry)
+	}
+	return f, nil
+}
@@ -0,0 +1,454 @@
+package blog
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/weblog/pagemanager"
+	"github.com/go-chi/chi"
+)
+
+// The feeds of the blog are served at /rss.xml, /atom.xml and /feed.json under
+// the blog, and those of a group under its group page (e.g.
+// /groups/tag/javascript/atom.xml).
+const (
+	feedRSS  = "rss.xml"
+	feedAtom = "atom.xml"
+	feedJSON = "feed.json"
+)
+
+// feedTypes are the content types of the feeds.
+var feedTypes = map[string]string{
+	feedRSS:  "application/rss+xml",
+	feedAtom: "application/atom+xml",
+	feedJSON: "application/feed+json",
+}
+
+// feedSize is the number of posts in a feed.
+const feedSize = 20
+
+// feed is a feed of the blog or of a group, before it is encoded into one of
+// the feed formats. URLs are absolute.
+type feed struct {
+	Title   string
+	Author  string
+	HomeURL string // the page the feed is the feed of
+	Updated time.Time
+	Entries []feedEntry
+}
+
+type feedEntry struct {
+	ID        string // a tag URI, see entryID
+	URL       string
+	Title     string
+	Summary   string // plain text, may be empty
+	Content   string // HTML, the whole post or its summary
+	Published time.Time
+	Updated   time.Time
+	Tags      []string
+}
+
+// entryID returns a tag URI (RFC 4151) that identifies the post for as long
+// as the blog stays on the same host (see feedBase), even if its URL changes.
+func (blg *Blog) entryID(hostname string, post Post) string {
+	return "tag:" + hostname + "," + post.CreatedAt.Format("2006-01-02") + ":" + blg.namespace + "/" + strconv.FormatInt(post.PostID, 10)
+}
+
+// feedBase returns the scheme and host that the feeds link to, and the
+// hostname that their entry IDs are made from. Both come from the site-url
+// setting if it is set. Otherwise they come from the request, minus a leading
+// "www." for the hostname so that the www and bare domains give feed readers
+// the same IDs.
+func (blg *Blog) feedBase(r *http.Request) (base, hostname string, err error) {
+	siteURL, err := blg.config(configSiteURL)
+	if err != nil {
+		return "", "", err
+	}
+	if siteURL != "" {
+		u, err := url.Parse(siteURL)
+		if err != nil {
+			return "", "", err
+		}
+		return siteURL, u.Hostname(), nil
+	}
+	hostname = (&url.URL{Host: r.Host}).Hostname()
+	return pagemanager.BaseURL(r), strings.TrimPrefix(hostname, "www."), nil
+}
+
+// checkSiteURL checks that the site-url setting is empty or a scheme and
+// host, and returns it without a trailing slash.
+func checkSiteURL(siteURL string) (string, error) {
+	if siteURL == "" {
+		return "", nil
+	}
+	u, err := url.Parse(strings.TrimSuffix(siteURL, "/"))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" {
+		return siteURL, fmt.Errorf("%s: must be a scheme and host like https://example.com", configSiteURL)
+	}
+	return u.String(), nil
+}
+
+// buildFeed returns the feed of the latest posts published at t with every
+// key/value pair in filter. title is the title of the feed and path is the
+// path of the page it is the feed of.
+func (blg *Blog) buildFeed(r *http.Request, t time.Time, filter url.Values, title, path string) (feed, error) {
+	posts, err := blg.PublishedPosts(t, filter, feedSize, 0)
+	if err != nil {
+		return feed{}, err
+	}
+	format, err := blg.postURLFormat()
+	if err != nil {
+		return feed{}, err
+	}
+	author, err := blg.config(configAuthor)
+	if err != nil {
+		return feed{}, err
+	}
+	if author == "" {
+		author = title
+	}
+	mode, err := blg.config(configFeedContent)
+	if err != nil {
+		return feed{}, err
+	}
+	base, hostname, err := blg.feedBase(r)
+	if err != nil {
+		return feed{}, err
+	}
+	f := feed{Title: title, Author: author, HomeURL: base + path}
+	for _, post := range posts {
+		entry := feedEntry{
+			ID:        blg.entryID(hostname, post),
+			URL:       base + blg.postURL(format, post),
+			Title:     post.Title,
+			Summary:   post.Summary,
+			Published: post.PublishedOn.Time,
+			Updated:   post.UpdatedAt,
+			Tags:      post.Meta["tag"],
+		}
+		// A post scheduled in advance shows up in the feed when it is
+		// published, not when it was last edited
+		if entry.Published.After(entry.Updated) {
+			entry.Updated = entry.Published
+		}
+		if mode == "summary" && post.Summary != "" {
+			entry.Content = "<p>" + template.HTMLEscapeString(post.Summary) + "</p>"
+		} else {
+			content, err := blg.Render.MarkdownHTML([]byte(post.Body))
+			if err != nil {
+				return feed{}, err
+			}
+			entry.Content = string(content)
+		}
+		if entry.Updated.After(f.Updated) {
+			f.Updated = entry.Updated
+		}
+		f.Entries = append(f.Entries, entry)
+	}
+	return f, nil
+}
+
+// FeedGet serves the RSS 2.0, Atom 1.0 or JSON Feed 1.1 feed of the blog, or
+// of the group in the URL. The feed-content setting decides whether entries carry the
+// whole post or only its summary. Feeds support conditional GETs with both
+// If-None-Match and If-Modified-Since.
+func (blg *Blog) FeedGet(w http.ResponseWriter, r *http.Request) {
+	kind := chi.URLParam(r, "feed")
+	title, err := blg.config(configTitle)
+	if err != nil {
+		blg.render.InternalServerError(w, r, err)
+		return
+	}
+	path := "/" + blg.namespace
+	var filter url.Values
+	if chi.URLParam(r, "key") != "" {
+		key, value, ok := groupParams(r)
+		if !ok {
+			blg.Router.NotFoundHandler().ServeHTTP(w, r)
+			return
+		}
+		filter = url.Values{key: {value}}
+		title += " - " + key + ": " + value
+		path = blg.groupURL(key, value)
+	}
+	f, err := blg.buildFeed(r, now(), filter, title, path)
+	if err != nil {
+		blg.render.InternalServerError(w, r, err)
+		return
+	}
+	if filter != nil && len(f.Entries) == 0 {
+		blg.Router.NotFoundHandler().ServeHTTP(w, r)
+		return
+	}
+	self := f.HomeURL + "/" + kind // HomeURL is base + path, see buildFeed
+	var b []byte
+	switch kind {
+	case feedRSS:
+		b, err = encodeRSS(f, self)
+	case feedAtom:
+		b, err = encodeAtom(f, self)
+	case feedJSON:
+		b, err = encodeJSONFeed(f, self)
+	default:
+		blg.Router.NotFoundHandler().ServeHTTP(w, r)
+		return
+	}
+	if err != nil {
+		blg.render.InternalServerError(w, r, err)
+		return
+	}
+	serveFeed(w, r, feedTypes[kind], b, f.Updated)
+}
+
+// serveFeed serves an encoded feed that was last updated at updated, with an
+// ETag so that it supports conditional GETs with both If-None-Match and
+// If-Modified-Since.
+func serveFeed(w http.ResponseWriter, r *http.Request, contentType string, b []byte, updated time.Time) {
+	sum := sha256.Sum256(b)
+	w.Header().Set("Content-Type", contentType+"; charset=utf-8")
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	// ServeContent answers conditional GETs, and leaves out Last-Modified if
+	// the feed is empty (updated is zero)
+	http.ServeContent(w, r, "", updated, bytes.NewReader(b))
+}
+
+// feedLinks returns the auto-discovery <link> tags of the feeds under path,
+// which is the blog or a group page.
+func feedLinks(title, path string) template.HTML {
+	var b bytes.Buffer
+	for _, link := range []struct{ kind, name string }{
+		{feedRSS, "RSS"},
+		{feedAtom, "Atom"},
+		{feedJSON, "JSON Feed"},
+	} {
+		fmt.Fprintf(&b, `<link rel="alternate" type="%s" title="%s" href="%s">`+"\n",
+			feedTypes[link.kind],
+			template.HTMLEscapeString(title+" ("+link.name+")"),
+			template.HTMLEscapeString(path+"/"+link.kind),
+		)
+	}
+	return template.HTML(b.String())
+}
+
+// feedsPrehook adds the auto-discovery <link> tags of the blog's feeds to
+// every page rendered with a map, as .__feeds__, unless the page already has
+// them (a group page links to its own feeds as well).
+func (blg *Blog) feedsPrehook(w io.Writer, r *http.Request, input interface{}) (interface{}, error) {
+	data, ok := input.(map[string]interface{})
+	if !ok {
+		return input, nil
+	}
+	if _, ok := data["__feeds__"]; ok {
+		return input, nil
+	}
+	title, err := blg.config(configTitle)
+	if err != nil {
+		return input, err
+	}
+	data["__feeds__"] = feedLinks(title, "/"+blg.namespace)
+	return data, nil
+}
+
+type rssFeed struct {
+	XMLName   xml.Name   `xml:"rss"`
+	Version   string     `xml:"version,attr"`
+	AtomXMLNS string     `xml:"xmlns:atom,attr"`
+	Channel   rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	AtomLink      atomLink  `xml:"atom:link"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string   `xml:"title"`
+	Link        string   `xml:"link"`
+	GUID        rssGUID  `xml:"guid"`
+	PubDate     string   `xml:"pubDate"`
+	Description string   `xml:"description"`
+	Categories  []string `xml:"category"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+func encodeRSS(f feed, self string) ([]byte, error) {
+	rss := rssFeed{
+		Version:   "2.0",
+		AtomXMLNS: "http://www.w3.org/2005/Atom",
+		Channel: rssChannel{
+			Title:       f.Title,
+			Link:        f.HomeURL,
+			Description: f.Title,
+			AtomLink:    atomLink{Rel: "self", Type: feedTypes[feedRSS], Href: self},
+		},
+	}
+	if !f.Updated.IsZero() {
+		rss.Channel.LastBuildDate = f.Updated.UTC().Format(time.RFC1123Z)
+	}
+	for _, entry := range f.Entries {
+		rss.Channel.Items = append(rss.Channel.Items, rssItem{
+			Title:       entry.Title,
+			Link:        entry.URL,
+			GUID:        rssGUID{Value: entry.ID},
+			PubDate:     entry.Published.UTC().Format(time.RFC1123Z),
+			Description: entry.Content,
+			Categories:  entry.Tags,
+		})
+	}
+	return encodeXML(rss)
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Author  atomPerson  `xml:"author"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type atomEntry struct {
+	Title      string         `xml:"title"`
+	ID         string         `xml:"id"`
+	Links      []atomLink     `xml:"link"`
+	Published  string         `xml:"published"`
+	Updated    string         `xml:"updated"`
+	Summary    *atomText      `xml:"summary,omitempty"`
+	Content    atomText       `xml:"content"`
+	Categories []atomCategory `xml:"category"`
+}
+
+func encodeAtom(f feed, self string) ([]byte, error) {
+	atom := atomFeed{
+		Title:   f.Title,
+		ID:      f.HomeURL,
+		Updated: f.Updated.UTC().Format(time.RFC3339), // the zero time if the feed is empty
+		Author:  atomPerson{Name: f.Author},
+		Links: []atomLink{
+			{Rel: "self", Type: feedTypes[feedAtom], Href: self},
+			{Rel: "alternate", Type: "text/html", Href: f.HomeURL},
+		},
+	}
+	for _, entry := range f.Entries {
+		e := atomEntry{
+			Title:     entry.Title,
+			ID:        entry.ID,
+			Links:     []atomLink{{Rel: "alternate", Type: "text/html", Href: entry.URL}},
+			Published: entry.Published.UTC().Format(time.RFC3339),
+			Updated:   entry.Updated.UTC().Format(time.RFC3339),
+			Content:   atomText{Type: "html", Body: entry.Content},
+		}
+		if entry.Summary != "" {
+			e.Summary = &atomText{Type: "text", Body: entry.Summary}
+		}
+		for _, tag := range entry.Tags {
+			e.Categories = append(e.Categories, atomCategory{Term: tag})
+		}
+		atom.Entries = append(atom.Entries, e)
+	}
+	return encodeXML(atom)
+}
+
+func encodeXML(v interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	enc := xml.NewEncoder(&b)
+	enc.Indent("", "  ")
+	err := enc.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	b.WriteString("\n")
+	return b.Bytes(), nil
+}
+
+type jsonFeed struct {
+	Version     string         `json:"version"`
+	Title       string         `json:"title"`
+	HomePageURL string         `json:"home_page_url"`
+	FeedURL     string         `json:"feed_url"`
+	Authors     []jsonAuthor   `json:"authors"`
+	Items       []jsonFeedItem `json:"items"`
+}
+
+type jsonAuthor struct {
+	Name string `json:"name"`
+}
+
+type jsonFeedItem struct {
+	ID            string   `json:"id"`
+	URL           string   `json:"url"`
+	Title         string   `json:"title"`
+	ContentHTML   string   `json:"content_html"`
+	Summary       string   `json:"summary,omitempty"`
+	DatePublished string   `json:"date_published"`
+	DateModified  string   `json:"date_modified"`
+	Tags          []string `json:"tags,omitempty"`
+}
+
+func encodeJSONFeed(f feed, self string) ([]byte, error) {
+	jf := jsonFeed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       f.Title,
+		HomePageURL: f.HomeURL,
+		FeedURL:     self,
+		Authors:     []jsonAuthor{{Name: f.Author}},
+		Items:       []jsonFeedItem{},
+	}
+	for _, entry := range f.Entries {
+		jf.Items = append(jf.Items, jsonFeedItem{
+			ID:            entry.ID,
+			URL:           entry.URL,
+			Title:         entry.Title,
+			ContentHTML:   entry.Content,
+			Summary:       entry.Summary,
+			DatePublished: entry.Published.UTC().Format(time.RFC3339),
+			DateModified:  entry.Updated.UTC().Format(time.RFC3339),
+			Tags:          entry.Tags,
+		})
+	}
+	b, err := json.MarshalIndent(jf, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
@@ -0,0 +1,53 @@
+-- https://kimsereylam.com/sqlite/2020/03/06/full-text-search-with-sqlite.html
+-- FTS5 needs the sqlite_fts5 build tag (go build -tags sqlite_fts5), search is
+-- not available without it.
+CREATE VIRTUAL TABLE IF NOT EXISTS blg_posts_fts USING FTS5 (
+    title
+    ,summary
+    ,body
+    ,content='blg_posts'
+    ,content_rowid='post_id'
+);
+
+-- The triggers are made anew every time, so that they are always the ones
+-- below and not, say, those of the original init.sql, which refer to OLD.id
+-- and NEW.id that blg_posts never had.
+DROP TRIGGER IF EXISTS blg_posts_after_insert;
+DROP TRIGGER IF EXISTS blg_posts_after_delete;
+DROP TRIGGER IF EXISTS blg_posts_after_update;
+
+CREATE TRIGGER blg_posts_after_insert AFTER INSERT ON blg_posts
+BEGIN
+    INSERT INTO blg_posts_fts
+        (rowid, title, summary, body)
+    VALUES
+        (NEW.post_id, NEW.title, NEW.summary, NEW.body)
+    ;
+END;
+
+CREATE TRIGGER blg_posts_after_delete AFTER DELETE ON blg_posts
+BEGIN
+    INSERT INTO blg_posts_fts
+        (blg_posts_fts, rowid, title, summary, body)
+    VALUES
+        ('delete', OLD.post_id, OLD.title, OLD.summary, OLD.body)
+    ;
+END;
+
+CREATE TRIGGER blg_posts_after_update AFTER UPDATE ON blg_posts
+BEGIN
+    INSERT INTO blg_posts_fts
+        (blg_posts_fts, rowid, title, summary, body)
+    VALUES
+        ('delete', OLD.post_id, OLD.title, OLD.summary, OLD.body)
+    ;
+    INSERT INTO blg_posts_fts
+        (rowid, title, summary, body)
+    VALUES
+        (NEW.post_id, NEW.title, NEW.summary, NEW.body)
+    ;
+END;
+
+-- The posts may have changed without the triggers: while the database was
+-- used by a binary without FTS5, or when blg_posts was rebuilt by a migration.
+INSERT INTO blg_posts_fts (blg_posts_fts) VALUES ('rebuild');
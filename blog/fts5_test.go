@@ -0,0 +1,8 @@
+//go:build sqlite_fts5 || fts5
+// +build sqlite_fts5 fts5
+
+package blog
+
+// fts5 is whether the tests are built with FTS5, and so whether search has to
+// work.
+const fts5 = true
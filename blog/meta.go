@@ -0,0 +1,291 @@
+package blog
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Posts carry url.Values style metadata: any number of keys, each with any
+// number of values, stored in blg_post_meta. The metadata is free-form, but
+// its main use is grouping posts into tags, categories or anything else, e.g.
+//
+//	tag: javascript
+//	tag: short
+//	category: tutorials
+//
+// Every key/value pair is a group, listed on its group page and counted in
+// the tag clouds handed to the theme templates.
+
+// Group is a key/value pair and the posts that have it.
+type Group struct {
+	Key   string
+	Value string
+	Count int    // the number of published posts in the group
+	URL   string // the group page
+}
+
+// parseMeta parses the metadata textarea of the post editor, one "key: value"
+// pair per line. Blank lines are skipped.
+func parseMeta(s string) (url.Values, error) {
+	meta := make(url.Values)
+	for i, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		colon := strings.IndexByte(line, ':')
+		if colon < 0 {
+			return meta, &PostError{Field: "meta", Msg: fmt.Sprintf("line %d: %q is not a key: value pair", i+1, line)}
+		}
+		meta.Add(line[:colon], line[colon+1:])
+	}
+	return meta, nil
+}
+
+// formatMeta is the inverse of parseMeta, with the keys in sorted order.
+func formatMeta(meta url.Values) string {
+	keys := make([]string, 0, len(meta))
+	for key := range meta {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, key := range keys {
+		for _, value := range meta[key] {
+			b.WriteString(key + ": " + value + "\n")
+		}
+	}
+	return b.String()
+}
+
+// normalizeMeta trims the keys and values and lowercases the keys, dropping
+// empty and repeated values. Keys must not be empty or contain a colon or a
+// slash (the key is a path segment of its group pages). Keys that become the
+// same key are merged in sorted order.
+func normalizeMeta(meta url.Values) (url.Values, error) {
+	keys := make([]string, 0, len(meta))
+	for key := range meta {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	normalized := make(url.Values)
+	for _, rawKey := range keys {
+		values := meta[rawKey]
+		key := strings.ToLower(strings.TrimSpace(rawKey))
+		if key == "" || strings.ContainsAny(key, ":/") {
+			return meta, &PostError{Field: "meta", Msg: fmt.Sprintf("invalid key %q", key)}
+		}
+		for _, value := range values {
+			value = strings.TrimSpace(value)
+			if value == "" || containsString(normalized[key], value) {
+				continue
+			}
+			normalized[key] = append(normalized[key], value)
+		}
+	}
+	return normalized, nil
+}
+
+func containsString(values []string, s string) bool {
+	for _, value := range values {
+		if value == s {
+			return true
+		}
+	}
+	return false
+}
+
+// setPostMeta replaces the metadata of a post.
+func setPostMeta(tx *sql.Tx, postID int64, meta url.Values) error {
+	_, err := tx.Exec("DELETE FROM blg_post_meta WHERE post_id = ?", postID)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(meta))
+	for key := range meta {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, value := range meta[key] {
+			_, err = tx.Exec("INSERT INTO blg_post_meta (post_id, key, value) VALUES (?, ?, ?)", postID, key, value)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// loadMeta fills in the metadata of the posts.
+func (blg *Blog) loadMeta(posts []Post) error {
+	const batch = 500 // stay well under SQLite's limit on query parameters
+	index := make(map[int64]int, len(posts))
+	for i := range posts {
+		posts[i].Meta = make(url.Values)
+		index[posts[i].PostID] = i
+	}
+	for start := 0; start < len(posts); start += batch {
+		end := start + batch
+		if end > len(posts) {
+			end = len(posts)
+		}
+		args := make([]interface{}, 0, end-start)
+		for _, post := range posts[start:end] {
+			args = append(args, post.PostID)
+		}
+		rows, err := blg.DB.Query(
+			"SELECT post_id, key, value FROM blg_post_meta WHERE post_id IN (?"+strings.Repeat(", ?", len(args)-1)+") ORDER BY rowid",
+			args...,
+		)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var postID int64
+			var key, value string
+			err = rows.Scan(&postID, &key, &value)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			posts[index[postID]].Meta.Add(key, value)
+		}
+		err = rows.Close()
+		if err != nil {
+			return err
+		}
+		err = rows.Err()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxFilters is the most key/value pairs that the post index is filtered by.
+const maxFilters = 8
+
+// indexFilter returns the key/value pairs of the query that filter the post
+// index: the ones whose key, lowercased, is a metadata key of some post.
+// Everything else (page, the theme preview parameter, the utm_source and such
+// that links pick up when shared) is ignored, and so are the pairs after the
+// first maxFilters.
+func (blg *Blog) indexFilter(query url.Values) (url.Values, error) {
+	rows, err := blg.DB.Query("SELECT DISTINCT key FROM blg_post_meta")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	known := make(map[string]bool)
+	for rows.Next() {
+		var key string
+		err = rows.Scan(&key)
+		if err != nil {
+			return nil, err
+		}
+		known[key] = true
+	}
+	err = rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	delete(known, "page")
+	delete(known, "theme")
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	filter := make(url.Values)
+	n := 0
+	for _, rawKey := range keys {
+		key := strings.ToLower(strings.TrimSpace(rawKey))
+		if !known[key] {
+			continue
+		}
+		for _, value := range query[rawKey] {
+			value = strings.TrimSpace(value)
+			if value == "" || containsString(filter[key], value) {
+				continue
+			}
+			if n == maxFilters {
+				return filter, nil
+			}
+			filter[key] = append(filter[key], value)
+			n++
+		}
+	}
+	return filter, nil
+}
+
+// metaFilter returns the SQL condition for a post having every key/value pair
+// in filter, and its arguments. It is empty if filter is.
+func metaFilter(filter url.Values) (string, []interface{}) {
+	keys := make([]string, 0, len(filter))
+	for key := range filter {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var conds []string
+	var args []interface{}
+	for _, key := range keys {
+		for _, value := range filter[key] {
+			conds = append(conds, "post_id IN (SELECT post_id FROM blg_post_meta WHERE key = ? AND value = ?)")
+			args = append(args, key, value)
+		}
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+// groupURL returns the URL of the group page of a key/value pair.
+func (blg *Blog) groupURL(key, value string) string {
+	return "/" + blg.namespace + "/groups/" + url.PathEscape(key) + "/" + url.PathEscape(value)
+}
+
+// postGroups returns the post's key/value pairs as groups, without counts.
+func (blg *Blog) postGroups(meta url.Values) map[string][]Group {
+	groups := make(map[string][]Group, len(meta))
+	for key, values := range meta {
+		for _, value := range values {
+			groups[key] = append(groups[key], Group{Key: key, Value: value, URL: blg.groupURL(key, value)})
+		}
+	}
+	return groups
+}
+
+// Groups returns every group with posts published at t, by key. The groups of
+// each key are sorted by count (largest first) and then by value, ready for a
+// tag cloud.
+func (blg *Blog) Groups(t time.Time) (map[string][]Group, error) {
+	t = t.UTC()
+	rows, err := blg.DB.Query(
+		"SELECT key, value, COUNT(*) FROM blg_post_meta"+
+			" WHERE post_id IN (SELECT post_id FROM blg_posts WHERE "+isPublished+")"+
+			" GROUP BY key, value ORDER BY key, COUNT(*) DESC, value",
+		t, t,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	groups := make(map[string][]Group)
+	for rows.Next() {
+		var group Group
+		err = rows.Scan(&group.Key, &group.Value, &group.Count)
+		if err != nil {
+			return nil, err
+		}
+		group.URL = blg.groupURL(group.Key, group.Value)
+		groups[group.Key] = append(groups[group.Key], group)
+	}
+	return groups, rows.Err()
+}
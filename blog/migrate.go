@@ -0,0 +1,45 @@
+package blog
+
+import (
+	"database/sql"
+	"embed"
+	"errors"
+	"io/fs"
+
+	"github.com/bokwoon95/weblog/pagemanager"
+)
+
+// migrations are the changes to the blog tables since the original init.sql,
+// one .sql file each.
+//
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// schemaVersionKey is the blg_config key of the number of migrations that the
+// database has had. The database's user_version already belongs to the
+// pagemanager tables.
+const schemaVersionKey = "schema-version"
+
+// migrate brings the blog tables up to date (see pagemanager.Migrate).
+func (blg *Blog) migrate() error {
+	_, err := blg.DB.Exec("CREATE TABLE IF NOT EXISTS blg_config (key TEXT NOT NULL PRIMARY KEY, value TEXT)")
+	if err != nil {
+		return err
+	}
+	var version int
+	err = blg.DB.QueryRow("SELECT value FROM blg_config WHERE key = ?", schemaVersionKey).Scan(&version)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	fsys, err := fs.Sub(migrations, "migrations")
+	if err != nil {
+		return err
+	}
+	return pagemanager.Migrate(blg.DB, fsys, version, func(tx *sql.Tx, version int) error {
+		_, err := tx.Exec(
+			"INSERT INTO blg_config (key, value) VALUES (?, ?) ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value",
+			schemaVersionKey, version,
+		)
+		return err
+	})
+}
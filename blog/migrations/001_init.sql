@@ -0,0 +1,14 @@
+-- The blog tables of the original init.sql, which databases made from it
+-- already have. blg_config is made before the migrations run, since it holds
+-- the number of migrations run so far (see Blog.migrate).
+CREATE TABLE IF NOT EXISTS blg_posts (
+    post_id BIGINT NOT NULL PRIMARY KEY
+    ,slug TEXT
+    ,title TEXT
+    ,summary TEXT
+    ,body TEXT
+    ,published_on TIMESTAMPTZ
+    ,unpublished_on TIMESTAMPTZ
+    ,created_at TIMESTAMPTZ
+    ,updated_at TIMESTAMPTZ
+);
@@ -0,0 +1,44 @@
+-- post_id becomes an alias of the rowid so that new posts are numbered by
+-- SQLite, and every post must have a unique slug and a title. The columns of
+-- a table can't be changed in place, so the posts are copied into a new
+-- blg_posts. Posts without a slug, or with the slug of an earlier post, are
+-- given 'post-' || post_id. Dropping the old table also drops its triggers.
+--
+-- Timestamps are stored in UTC. A post is a draft until published_on, and is
+-- taken down again at unpublished_on.
+CREATE TABLE blg_posts_new (
+    post_id INTEGER PRIMARY KEY
+    ,slug TEXT NOT NULL UNIQUE
+    ,title TEXT NOT NULL
+    ,summary TEXT NOT NULL DEFAULT ''
+    ,body TEXT NOT NULL DEFAULT '' -- markdown
+    ,published_on DATETIME
+    ,unpublished_on DATETIME
+    ,created_at DATETIME NOT NULL
+    ,updated_at DATETIME NOT NULL
+);
+
+INSERT INTO blg_posts_new
+    (post_id, slug, title, summary, body, published_on, unpublished_on, created_at, updated_at)
+SELECT
+    post_id
+    ,CASE
+        WHEN COALESCE(slug, '') = '' OR EXISTS (
+            SELECT 1 FROM blg_posts AS earlier WHERE earlier.slug = blg_posts.slug AND earlier.post_id < blg_posts.post_id
+        ) THEN 'post-' || post_id
+        ELSE slug
+    END
+    ,COALESCE(title, '')
+    ,COALESCE(summary, '')
+    ,COALESCE(body, '')
+    ,published_on
+    ,unpublished_on
+    ,COALESCE(created_at, updated_at, CURRENT_TIMESTAMP)
+    ,COALESCE(updated_at, created_at, CURRENT_TIMESTAMP)
+FROM
+    blg_posts
+;
+
+DROP TABLE blg_posts;
+
+ALTER TABLE blg_posts_new RENAME TO blg_posts;
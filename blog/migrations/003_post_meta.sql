@@ -0,0 +1,11 @@
+-- url.Values style key/values of a post, e.g. (tag, javascript). Every
+-- key/value pair is a group of posts.
+CREATE TABLE blg_post_meta (
+    post_id INTEGER NOT NULL REFERENCES blg_posts (post_id)
+    ,key TEXT NOT NULL
+    ,value TEXT NOT NULL
+
+    ,UNIQUE(post_id, key, value)
+);
+
+CREATE INDEX blg_post_meta_key_value ON blg_post_meta (key, value);
@@ -0,0 +1,18 @@
+-- comments on posts, threaded through parent_id. Comments are pending until
+-- approved by the admin (unless the comments setting is "open"), and spam is
+-- kept out of sight. ip is where the comment was posted from, for rate
+-- limiting.
+CREATE TABLE blg_comments (
+    comment_id INTEGER PRIMARY KEY
+    ,post_id INTEGER NOT NULL REFERENCES blg_posts (post_id)
+    ,parent_id INTEGER REFERENCES blg_comments (comment_id)
+    ,author TEXT NOT NULL
+    ,website TEXT NOT NULL DEFAULT ''
+    ,body TEXT NOT NULL -- markdown
+    ,status TEXT NOT NULL -- 'pending', 'approved' or 'spam'
+    ,ip TEXT NOT NULL DEFAULT ''
+    ,created_at DATETIME NOT NULL
+);
+
+CREATE INDEX blg_comments_post_id ON blg_comments (post_id, status);
+CREATE INDEX blg_comments_ip ON blg_comments (ip, created_at);
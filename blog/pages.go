@@ -0,0 +1,450 @@
+package blog
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/weblog/pagemanager"
+	"github.com/bokwoon95/weblog/pagemanager/renderly"
+	"github.com/go-chi/chi"
+)
+
+// PostData is a post as seen by the theme templates.
+type PostData struct {
+	PostID    int64
+	Slug      string
+	URL       string
+	Title     string
+	Summary   string
+	Content   template.HTML // the body converted from markdown
+	Published time.Time
+	Updated   time.Time
+	Meta      url.Values         // the post's key/values, see meta.go
+	Groups    map[string][]Group // Meta as groups, without counts
+}
+
+// postData converts the post for the theme templates, format is the post URL
+// format.
+func (blg *Blog) postData(format string, post Post) (PostData, error) {
+	content, err := blg.Render.MarkdownHTML([]byte(post.Body))
+	if err != nil {
+		return PostData{}, err
+	}
+	return PostData{
+		PostID:    post.PostID,
+		Slug:      post.Slug,
+		URL:       blg.postURL(format, post),
+		Title:     post.Title,
+		Summary:   post.Summary,
+		Content:   content,
+		Published: post.PublishedOn.Time,
+		Updated:   post.UpdatedAt,
+		Meta:      post.Meta,
+		Groups:    blg.postGroups(post.Meta),
+	}, nil
+}
+
+// PostIndexGet lists the published posts, one page at a time unless the
+// pagination setting is "all". The page number is in the page query
+// parameter, and query parameters named after a metadata key narrow the posts
+// down to those with that key/value pair (e.g. ?tag=javascript, see
+// indexFilter). It renders the post-index template with:
+//
+//	.Posts      []PostData
+//	.Pagination renderly.Pagination
+//	.Filter     url.Values         // the key/value pairs of the query
+//	.PageURL    string             // the URL of a page, minus its number
+//	.Groups     map[string][]Group // every group, for tag clouds
+//	.BlogURL    string
+//	.Searchable bool               // whether there is a search page, see SearchGet
+func (blg *Blog) PostIndexGet(w http.ResponseWriter, r *http.Request) {
+	t := now()
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	filter, err := blg.indexFilter(r.URL.Query())
+	if err != nil {
+		blg.render.InternalServerError(w, r, err)
+		return
+	}
+	perPage, err := blg.postsPerPage()
+	if err != nil {
+		blg.render.InternalServerError(w, r, err)
+		return
+	}
+	total, err := blg.CountPublishedPosts(t, filter)
+	if err != nil {
+		blg.render.InternalServerError(w, r, err)
+		return
+	}
+	pagination := renderly.Paginate(total, perPage, page)
+	posts, err := blg.PublishedPosts(t, filter, pagination.PerPage, pagination.Offset())
+	if err != nil {
+		blg.render.InternalServerError(w, r, err)
+		return
+	}
+	postdata, err := blg.postsData(posts)
+	if err != nil {
+		blg.render.InternalServerError(w, r, err)
+		return
+	}
+	groups, err := blg.Groups(t)
+	if err != nil {
+		blg.render.InternalServerError(w, r, err)
+		return
+	}
+	template, err := blg.config(configPostIndex)
+	if err != nil {
+		blg.render.InternalServerError(w, r, err)
+		return
+	}
+	pageURL := "/" + blg.namespace + "?"
+	if len(filter) > 0 {
+		pageURL += filter.Encode() + "&"
+	}
+	err = blg.RenderTemplate(w, r, blg.namespace, template, map[string]interface{}{
+		"Posts":      postdata,
+		"Pagination": pagination,
+		"Filter":     filter,
+		"PageURL":    pageURL + "page=",
+		"Groups":     groups,
+		"BlogURL":    "/" + blg.namespace,
+		"Searchable": blg.searchable,
+	})
+	if err != nil {
+		blg.render.InternalServerError(w, r, err)
+		return
+	}
+}
+
+// postsData converts the posts for the theme templates.
+func (blg *Blog) postsData(posts []Post) ([]PostData, error) {
+	format, err := blg.postURLFormat()
+	if err != nil {
+		return nil, err
+	}
+	postdata := make([]PostData, len(posts))
+	for i, post := range posts {
+		postdata[i], err = blg.postData(format, post)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return postdata, nil
+}
+
+// GroupGet lists every published post in the group in the URL, i.e. every
+// post with the key/value pair /groups/{key}/{value}. It renders the group
+// template with:
+//
+//	.Group      Group
+//	.Posts      []PostData
+//	.Groups     map[string][]Group // every group, for tag clouds
+//	.BlogURL    string
+//	.Searchable bool
+func (blg *Blog) GroupGet(w http.ResponseWriter, r *http.Request) {
+	key, value, ok := groupParams(r)
+	if !ok {
+		blg.Router.NotFoundHandler().ServeHTTP(w, r)
+		return
+	}
+	t := now()
+	posts, err := blg.PublishedPosts(t, url.Values{key: {value}}, 0, 0)
+	if err != nil {
+		blg.render.InternalServerError(w, r, err)
+		return
+	}
+	if len(posts) == 0 {
+		blg.Router.NotFoundHandler().ServeHTTP(w, r)
+		return
+	}
+	postdata, err := blg.postsData(posts)
+	if err != nil {
+		blg.render.InternalServerError(w, r, err)
+		return
+	}
+	groups, err := blg.Groups(t)
+	if err != nil {
+		blg.render.InternalServerError(w, r, err)
+		return
+	}
+	title, err := blg.config(configTitle)
+	if err != nil {
+		blg.render.InternalServerError(w, r, err)
+		return
+	}
+	template, err := blg.config(configGroup)
+	if err != nil {
+		blg.render.InternalServerError(w, r, err)
+		return
+	}
+	err = blg.RenderTemplate(w, r, blg.namespace, template, map[string]interface{}{
+		"Group": Group{
+			Key:   key,
+			Value: value,
+			Count: len(posts),
+			URL:   blg.groupURL(key, value),
+		},
+		"Posts":      postdata,
+		"Groups":     groups,
+		"BlogURL":    "/" + blg.namespace,
+		"Searchable": blg.searchable,
+		"__feeds__":  feedLinks(title, "/"+blg.namespace) + feedLinks(title+" - "+key+": "+value, blg.groupURL(key, value)),
+	})
+	if err != nil {
+		blg.render.InternalServerError(w, r, err)
+		return
+	}
+}
+
+// postsPerPage returns the number of posts on each page of the index, 0 if
+// every post goes on one page.
+func (blg *Blog) postsPerPage() (int, error) {
+	pagination, err := blg.config(configPagination)
+	if err != nil {
+		return 0, err
+	}
+	if pagination == "all" {
+		return 0, nil
+	}
+	value, err := blg.config(configPostsPerPage)
+	if err != nil {
+		return 0, err
+	}
+	perPage, err := strconv.Atoi(value)
+	if err != nil || perPage <= 0 {
+		perPage, _ = strconv.Atoi(defaultConfig[configPostsPerPage])
+	}
+	return perPage, nil
+}
+
+// groupParams returns the key and value of the group in the URL.
+func groupParams(r *http.Request) (key, value string, ok bool) {
+	key, value = chi.URLParam(r, "key"), chi.URLParam(r, "value")
+	if r.URL.RawPath == "" {
+		return key, value, true
+	}
+	// chi routes on the escaped path if there is one
+	key, err := url.PathUnescape(key)
+	if err != nil {
+		return "", "", false
+	}
+	value, err = url.PathUnescape(value)
+	if err != nil {
+		return "", "", false
+	}
+	return key, value, true
+}
+
+// PostGet shows the post at the URL if it is published. The URL must be the
+// post's URL under the post URL format. Admins can also see drafts, scheduled
+// and unpublished posts. The comment form replies to the comment in the reply
+// query parameter, and ?comment=pending shows that a comment awaits approval.
+// It renders the post template with:
+//
+//	.Post       PostData
+//	.Comments   CommentsData
+//	.Groups     map[string][]Group // every group, for tag clouds
+//	.BlogURL    string
+//	.Searchable bool
+func (blg *Blog) PostGet(w http.ResponseWriter, r *http.Request) {
+	format, err := blg.postURLFormat()
+	if err != nil {
+		blg.render.InternalServerError(w, r, err)
+		return
+	}
+	match := postURLRegexp(format).FindStringSubmatch(chi.URLParam(r, "*"))
+	if match == nil {
+		blg.Router.NotFoundHandler().ServeHTTP(w, r)
+		return
+	}
+	post, err := blg.GetPostBySlug(match[1])
+	if errors.Is(err, ErrPostNotFound) || err == nil && r.URL.Path != blg.postURL(format, post) {
+		blg.Router.NotFoundHandler().ServeHTTP(w, r)
+		return
+	}
+	if err != nil {
+		blg.render.InternalServerError(w, r, err)
+		return
+	}
+	if !post.IsPublished(now()) && !blg.IsAdmin(r) {
+		blg.Router.NotFoundHandler().ServeHTTP(w, r)
+		return
+	}
+	var form CommentForm
+	form.ParentID, _ = strconv.ParseInt(r.URL.Query().Get("reply"), 10, 64)
+	blg.renderPost(w, r, post, form, nil)
+}
+
+// renderPost renders the post template. If commentErr is not nil the comment
+// form is being shown again because the comment was not taken.
+func (blg *Blog) renderPost(w http.ResponseWriter, r *http.Request, post Post, form CommentForm, commentErr error) {
+	format, err := blg.postURLFormat()
+	if err != nil {
+		blg.render.InternalServerError(w, r, err)
+		return
+	}
+	postdata, err := blg.postData(format, post)
+	if err != nil {
+		blg.render.InternalServerError(w, r, err)
+		return
+	}
+	comments, err := blg.commentsData(postdata.URL, post, form, commentErr, pagemanager.IsExport(r))
+	if err != nil {
+		blg.render.InternalServerError(w, r, err)
+		return
+	}
+	comments.Pending = commentErr == nil && r.URL.Query().Get("comment") == "pending"
+	groups, err := blg.Groups(now())
+	if err != nil {
+		blg.render.InternalServerError(w, r, err)
+		return
+	}
+	title, err := blg.config(configTitle)
+	if err != nil {
+		blg.render.InternalServerError(w, r, err)
+		return
+	}
+	template, err := blg.config(configPost)
+	if err != nil {
+		blg.render.InternalServerError(w, r, err)
+		return
+	}
+	var rw http.ResponseWriter = w
+	if commentErr != nil {
+		status := http.StatusBadRequest
+		switch {
+		case errors.Is(commentErr, ErrCommentsClosed):
+			status = http.StatusForbidden
+		case errors.Is(commentErr, ErrTooManyComments):
+			status = http.StatusTooManyRequests
+		}
+		rw = &statusWriter{ResponseWriter: w, status: status}
+	}
+	err = blg.RenderTemplate(rw, r, blg.namespace, template, map[string]interface{}{
+		"Post":       postdata,
+		"Comments":   comments,
+		"Groups":     groups,
+		"BlogURL":    "/" + blg.namespace,
+		"Searchable": blg.searchable,
+		"__feeds__":  feedLinks(title, "/"+blg.namespace) + commentFeedLink(post.Title, comments.FeedURL),
+	})
+	if err != nil {
+		blg.render.InternalServerError(w, r, err)
+		return
+	}
+}
+
+// SearchResultData is a search result as seen by the theme templates.
+type SearchResultData struct {
+	PostData
+	TitleHTML template.HTML // the title with the matches in <mark>
+	Snippet   template.HTML // the part of the body around the matches, with the matches in <mark>
+}
+
+// searchDate is the format of the from and to query parameters of the search
+// page, the value of an <input type="date">.
+const searchDate = "2006-01-02"
+
+// SearchGet searches the published posts. The search is in the q query
+// parameter (see ftsQuery), and it can be narrowed down to the posts published
+// from and to a date (both inclusive) with the from and to query parameters.
+// The results are paginated like the post index, the page number is in the
+// page query parameter. If SQLite has no FTS5 (see initSearch), the search
+// template is rendered with a 404 status and .Searchable false, so that it can
+// say so. It renders the search template with:
+//
+//	.Query      string
+//	.From       string
+//	.To         string
+//	.Results    []SearchResultData
+//	.Pagination renderly.Pagination
+//	.SearchURL  string // the URL of the search, without the page
+//	.Error      string // if the search is invalid
+//	.BlogURL    string
+//	.Searchable bool
+func (blg *Blog) SearchGet(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	opts := SearchOptions{Query: strings.TrimSpace(query.Get("q"))}
+	data := map[string]interface{}{
+		"Query":      opts.Query,
+		"From":       query.Get("from"),
+		"To":         query.Get("to"),
+		"SearchURL":  "/" + blg.namespace + "/search?" + url.Values{"q": {opts.Query}, "from": {query.Get("from")}, "to": {query.Get("to")}}.Encode(),
+		"BlogURL":    "/" + blg.namespace,
+		"Searchable": blg.searchable,
+	}
+	status := http.StatusOK
+	var err error
+	if from := query.Get("from"); from != "" {
+		opts.From, err = time.Parse(searchDate, from)
+	}
+	if to := query.Get("to"); to != "" && err == nil {
+		opts.To, err = time.Parse(searchDate, to)
+		opts.To = opts.To.AddDate(0, 0, 1)
+	}
+	if !blg.searchable {
+		status = http.StatusNotFound
+	} else if err != nil {
+		status = http.StatusBadRequest
+		data["Error"] = "dates must look like " + searchDate
+	} else if opts.Query != "" {
+		page, _ := strconv.Atoi(query.Get("page"))
+		err = blg.search(opts, page, data)
+		if errors.Is(err, ErrInvalidQuery) {
+			status = http.StatusBadRequest
+			data["Error"] = "invalid search: " + opts.Query
+		} else if err != nil {
+			blg.render.InternalServerError(w, r, err)
+			return
+		}
+	}
+	template, err := blg.config(configSearch)
+	if err != nil {
+		blg.render.InternalServerError(w, r, err)
+		return
+	}
+	err = blg.RenderTemplate(&statusWriter{ResponseWriter: w, status: status}, r, blg.namespace, template, data)
+	if err != nil {
+		blg.render.InternalServerError(w, r, err)
+		return
+	}
+}
+
+// search fills in the results and pagination of the search page.
+func (blg *Blog) search(opts SearchOptions, page int, data map[string]interface{}) error {
+	perPage, err := blg.postsPerPage()
+	if err != nil {
+		return err
+	}
+	t := now()
+	total, err := blg.CountSearch(t, opts)
+	if err != nil {
+		return err
+	}
+	pagination := renderly.Paginate(total, perPage, page)
+	opts.Limit, opts.Offset = pagination.PerPage, pagination.Offset()
+	results, err := blg.Search(t, opts)
+	if err != nil {
+		return err
+	}
+	format, err := blg.postURLFormat()
+	if err != nil {
+		return err
+	}
+	resultdata := make([]SearchResultData, len(results))
+	for i, result := range results {
+		resultdata[i].PostData, err = blg.postData(format, result.Post)
+		if err != nil {
+			return err
+		}
+		resultdata[i].TitleHTML = result.TitleHTML
+		resultdata[i].Snippet = result.Snippet
+	}
+	data["Results"] = resultdata
+	data["Pagination"] = pagination
+	return nil
+}
@@ -0,0 +1,346 @@
+package blog
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/weblog/pagemanager"
+	"github.com/bokwoon95/weblog/pagemanager/renderly"
+)
+
+// Post is a row in blg_posts. Timestamps are in UTC.
+type Post struct {
+	PostID        int64
+	Slug          string
+	Title         string
+	Summary       string
+	Body          string // markdown
+	PublishedOn   sql.NullTime
+	UnpublishedOn sql.NullTime
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+	Meta          url.Values // see meta.go
+}
+
+// ErrPostNotFound is returned when a post does not exist.
+var ErrPostNotFound = errors.New("post not found")
+
+// PostError is returned when a post fails validation. Field is the name of
+// the offending field in the post editor form.
+type PostError struct {
+	Field string
+	Msg   string
+}
+
+func (e *PostError) Error() string {
+	return e.Field + ": " + e.Msg
+}
+
+// now is the clock used to timestamp posts, it is replaced in tests.
+var now = func() time.Time {
+	return time.Now().UTC().Truncate(time.Second)
+}
+
+const postColumns = "post_id, slug, title, summary, body, published_on, unpublished_on, created_at, updated_at"
+
+func scanPost(row interface{ Scan(...interface{}) error }) (Post, error) {
+	var post Post
+	err := row.Scan(
+		&post.PostID, &post.Slug, &post.Title, &post.Summary, &post.Body,
+		&post.PublishedOn, &post.UnpublishedOn, &post.CreatedAt, &post.UpdatedAt,
+	)
+	return post, err
+}
+
+// queryPosts runs a query that selects postColumns, and loads the metadata of
+// the posts.
+func (blg *Blog) queryPosts(query string, args ...interface{}) ([]Post, error) {
+	rows, err := blg.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var posts []Post
+	for rows.Next() {
+		post, err := scanPost(rows)
+		if err != nil {
+			return nil, err
+		}
+		posts = append(posts, post)
+	}
+	err = rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return posts, blg.loadMeta(posts)
+}
+
+// getPost runs a query that selects postColumns of one post, and loads its
+// metadata.
+func (blg *Blog) getPost(query string, args ...interface{}) (Post, error) {
+	posts, err := blg.queryPosts(query, args...)
+	if err != nil {
+		return Post{}, err
+	}
+	if len(posts) == 0 {
+		return Post{}, ErrPostNotFound
+	}
+	return posts[0], nil
+}
+
+// ListPosts returns every post, drafts included, most recently updated first.
+func (blg *Blog) ListPosts() ([]Post, error) {
+	return blg.queryPosts("SELECT " + postColumns + " FROM blg_posts ORDER BY updated_at DESC, post_id DESC")
+}
+
+// GetPost returns the post with the given id.
+func (blg *Blog) GetPost(postID int64) (Post, error) {
+	return blg.getPost("SELECT "+postColumns+" FROM blg_posts WHERE post_id = ?", postID)
+}
+
+// GetPostBySlug returns the post with the given slug.
+func (blg *Blog) GetPostBySlug(slug string) (Post, error) {
+	return blg.getPost("SELECT "+postColumns+" FROM blg_posts WHERE slug = ?", slug)
+}
+
+// isPublished is the SQL condition for a post being published at the time
+// passed in as both of its parameters.
+const isPublished = "published_on <= ? AND (unpublished_on IS NULL OR unpublished_on > ?)"
+
+// IsPublished reports whether the post is published at t: its publish date
+// has passed and its unpublish date, if any, has not.
+func (post Post) IsPublished(t time.Time) bool {
+	if !post.PublishedOn.Valid || post.PublishedOn.Time.After(t) {
+		return false
+	}
+	return !post.UnpublishedOn.Valid || post.UnpublishedOn.Time.After(t)
+}
+
+// publishedWhere returns the SQL condition for a post being published at t and
+// having every key/value pair in filter, and its arguments.
+func publishedWhere(t time.Time, filter url.Values) (string, []interface{}) {
+	t = t.UTC()
+	where, args := isPublished, []interface{}{t, t}
+	if cond, condArgs := metaFilter(filter); cond != "" {
+		where += " AND " + cond
+		args = append(args, condArgs...)
+	}
+	return where, args
+}
+
+// CountPublishedPosts returns the number of posts published at t that have
+// every key/value pair in filter.
+func (blg *Blog) CountPublishedPosts(t time.Time, filter url.Values) (int, error) {
+	var count int
+	where, args := publishedWhere(t, filter)
+	err := blg.DB.QueryRow("SELECT COUNT(*) FROM blg_posts WHERE "+where, args...).Scan(&count)
+	return count, err
+}
+
+// PublishedPosts returns the posts published at t that have every key/value
+// pair in filter, most recently published first, skipping the first offset
+// posts. If limit is not positive every post is returned.
+func (blg *Blog) PublishedPosts(t time.Time, filter url.Values, limit, offset int) ([]Post, error) {
+	if limit <= 0 {
+		limit = -1 // no limit
+	}
+	where, args := publishedWhere(t, filter)
+	return blg.queryPosts(
+		"SELECT "+postColumns+" FROM blg_posts WHERE "+where+
+			" ORDER BY published_on DESC, post_id DESC LIMIT ? OFFSET ?",
+		append(args, limit, offset)...,
+	)
+}
+
+// CreatePost validates and inserts a new post, returning it as stored. If the
+// post has no slug, one is generated from its title. A redirect left at the
+// post's URL by a post that moved away from it is removed.
+func (blg *Blog) CreatePost(post Post) (Post, error) {
+	format, err := blg.postURLFormat()
+	if err != nil {
+		return post, err
+	}
+	tx, err := blg.DB.Begin()
+	if err != nil {
+		return post, err
+	}
+	defer tx.Rollback()
+	post.PostID = 0
+	post, err = preparePost(tx, post)
+	if err != nil {
+		return post, err
+	}
+	post.CreatedAt = now()
+	post.UpdatedAt = post.CreatedAt
+	result, err := tx.Exec(
+		"INSERT INTO blg_posts (slug, title, summary, body, published_on, unpublished_on, created_at, updated_at)"+
+			" VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		post.Slug, post.Title, post.Summary, post.Body, post.PublishedOn, post.UnpublishedOn, post.CreatedAt, post.UpdatedAt,
+	)
+	if err != nil {
+		return post, err
+	}
+	post.PostID, err = result.LastInsertId()
+	if err != nil {
+		return post, err
+	}
+	err = setPostMeta(tx, post.PostID, post.Meta)
+	if err != nil {
+		return post, err
+	}
+	err = pagemanager.RemoveRedirect(tx, blg.postURL(format, post))
+	if err != nil {
+		return post, err
+	}
+	return post, tx.Commit()
+}
+
+// UpdatePost validates and saves an existing post, returning it as stored. If
+// the post has no slug, one is generated from its title. Its created_at is
+// left untouched. If the post had been published and its URL changed, its old
+// URL is redirected to the new one. A redirect away from its new URL is
+// removed.
+func (blg *Blog) UpdatePost(post Post) (Post, error) {
+	format, err := blg.postURLFormat()
+	if err != nil {
+		return post, err
+	}
+	tx, err := blg.DB.Begin()
+	if err != nil {
+		return post, err
+	}
+	defer tx.Rollback()
+	before, err := scanPost(tx.QueryRow("SELECT "+postColumns+" FROM blg_posts WHERE post_id = ?", post.PostID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return post, ErrPostNotFound
+	}
+	if err != nil {
+		return post, err
+	}
+	post.CreatedAt = before.CreatedAt
+	post, err = preparePost(tx, post)
+	if err != nil {
+		return post, err
+	}
+	post.UpdatedAt = now()
+	_, err = tx.Exec(
+		"UPDATE blg_posts SET slug = ?, title = ?, summary = ?, body = ?, published_on = ?, unpublished_on = ?, updated_at = ?"+
+			" WHERE post_id = ?",
+		post.Slug, post.Title, post.Summary, post.Body, post.PublishedOn, post.UnpublishedOn, post.UpdatedAt, post.PostID,
+	)
+	if err != nil {
+		return post, err
+	}
+	err = setPostMeta(tx, post.PostID, post.Meta)
+	if err != nil {
+		return post, err
+	}
+	// Keep the links to a published post working if its slug or publish
+	// date moved its URL
+	if before.wasPublished(now()) {
+		err = pagemanager.AddRedirect(tx, blg.postURL(format, before), blg.postURL(format, post))
+	} else {
+		err = pagemanager.RemoveRedirect(tx, blg.postURL(format, post))
+	}
+	if err != nil {
+		return post, err
+	}
+	return post, tx.Commit()
+}
+
+// DeletePost deletes the post with the given id, along with its metadata and
+// comments.
+func (blg *Blog) DeletePost(postID int64) error {
+	tx, err := blg.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("DELETE FROM blg_post_meta WHERE post_id = ?", postID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM blg_comments WHERE post_id = ?", postID)
+	if err != nil {
+		return err
+	}
+	result, err := tx.Exec("DELETE FROM blg_posts WHERE post_id = ?", postID)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrPostNotFound
+	}
+	return tx.Commit()
+}
+
+// reservedSlugs are the slugs that would clash with the blog's own pages
+// under the {slug} post URL format.
+var reservedSlugs = map[string]bool{
+	"admin":    true,
+	"comments": true,
+	"edit":     true,
+	"groups":   true,
+	"search":   true,
+}
+
+// preparePost validates the post and normalizes its fields for saving.
+// A slug given by the user must not be taken by another post, while a slug
+// generated from the title is made unique by appending -2, -3 and so on.
+func preparePost(tx *sql.Tx, post Post) (Post, error) {
+	post.Title = strings.TrimSpace(post.Title)
+	if post.Title == "" {
+		return post, &PostError{Field: "title", Msg: "a post needs a title"}
+	}
+	if post.PublishedOn.Valid {
+		post.PublishedOn.Time = post.PublishedOn.Time.UTC()
+	}
+	if post.UnpublishedOn.Valid {
+		post.UnpublishedOn.Time = post.UnpublishedOn.Time.UTC()
+	}
+	if post.PublishedOn.Valid && post.UnpublishedOn.Valid && !post.UnpublishedOn.Time.After(post.PublishedOn.Time) {
+		return post, &PostError{Field: "unpublished_on", Msg: "must be after published_on"}
+	}
+	meta, err := normalizeMeta(post.Meta)
+	if err != nil {
+		return post, err
+	}
+	post.Meta = meta
+	generated := strings.TrimSpace(post.Slug) == ""
+	if generated {
+		post.Slug = renderly.Slugify(post.Title)
+	} else {
+		post.Slug = renderly.Slugify(post.Slug)
+	}
+	if post.Slug == "" {
+		return post, &PostError{Field: "slug", Msg: "needs at least one letter or digit"}
+	}
+	base := post.Slug
+	for i := 2; ; i++ {
+		var taken bool
+		err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM blg_posts WHERE slug = ? AND post_id <> ?)", post.Slug, post.PostID).Scan(&taken)
+		if err != nil {
+			return post, err
+		}
+		if !taken && !reservedSlugs[post.Slug] {
+			return post, nil
+		}
+		if !generated {
+			return post, &PostError{Field: "slug", Msg: fmt.Sprintf("%q is already taken", post.Slug)}
+		}
+		post.Slug = base + "-" + strconv.Itoa(i)
+	}
+}
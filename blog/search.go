@@ -0,0 +1,257 @@
+package blog
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"html"
+	"html/template"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Full-text search needs the FTS5 extension of SQLite, which the sqlite3
+// driver only compiles in with the sqlite_fts5 build tag:
+//
+//	go build -tags sqlite_fts5
+//
+// Without it the blog works as usual, minus the search page.
+
+// ftsSQL creates the full-text search tables and the triggers that keep them
+// up to date.
+//
+//go:embed fts.sql
+var ftsSQL string
+
+// ftsTriggers are the triggers made by ftsSQL.
+var ftsTriggers = []string{"blg_posts_after_insert", "blg_posts_after_delete", "blg_posts_after_update"}
+
+// initSearch finds out whether SQLite has FTS5 and if so, creates the
+// full-text search tables. If not, it drops the triggers that a binary with
+// FTS5 may have left behind, since they would make every change to a post fail
+// with "no such module: fts5".
+func (blg *Blog) initSearch() error {
+	err := blg.DB.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&blg.searchable)
+	if err != nil {
+		return err
+	}
+	if blg.searchable {
+		_, err = blg.DB.Exec(ftsSQL)
+		return err
+	}
+	for _, trigger := range ftsTriggers {
+		_, err = blg.DB.Exec("DROP TRIGGER IF EXISTS " + trigger)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ErrInvalidQuery is returned when SQLite rejects a search query.
+var ErrInvalidQuery = errors.New("invalid search query")
+
+// SearchOptions are the parameters of a search.
+type SearchOptions struct {
+	Query  string    // what was typed into the search box, see ftsQuery
+	From   time.Time // if not zero, only posts published on or after From
+	To     time.Time // if not zero, only posts published before To
+	Limit  int       // if not positive, every result is returned
+	Offset int
+}
+
+// SearchResult is a post that matched a search.
+type SearchResult struct {
+	Post
+	TitleHTML template.HTML // the title with the matches in <mark>
+	Snippet   template.HTML // the part of the body around the matches, with the matches in <mark>
+}
+
+// highlightStart and highlightEnd surround the matches in the highlights and
+// snippets returned by SQLite. They are replaced by <mark> and </mark> after
+// the rest of the text has been HTML escaped.
+const (
+	highlightStart = "\x02"
+	highlightEnd   = "\x03"
+)
+
+func highlightHTML(s string) template.HTML {
+	s = html.EscapeString(s)
+	s = strings.ReplaceAll(s, highlightStart, "<mark>")
+	s = strings.ReplaceAll(s, highlightEnd, "</mark>")
+	return template.HTML(s)
+}
+
+// searchFrom is the FROM clause of the search queries.
+const searchFrom = " FROM blg_posts_fts JOIN blg_posts AS p ON p.post_id = blg_posts_fts.rowid"
+
+// searchWhere returns the WHERE clause of the search queries and its
+// arguments, or an empty query if there is nothing to search for.
+func searchWhere(t time.Time, opts SearchOptions) (query string, args []interface{}) {
+	match := ftsQuery(opts.Query)
+	if match == "" {
+		return "", nil
+	}
+	t = t.UTC()
+	query = " WHERE blg_posts_fts MATCH ? AND " + isPublished
+	args = []interface{}{match, t, t}
+	if !opts.From.IsZero() {
+		query += " AND published_on >= ?"
+		args = append(args, opts.From.UTC())
+	}
+	if !opts.To.IsZero() {
+		query += " AND published_on < ?"
+		args = append(args, opts.To.UTC())
+	}
+	return query, args
+}
+
+// CountSearch returns the number of posts published at t that match
+// opts.Query. opts.Limit and opts.Offset are ignored.
+func (blg *Blog) CountSearch(t time.Time, opts SearchOptions) (int, error) {
+	where, args := searchWhere(t, opts)
+	if where == "" {
+		return 0, nil
+	}
+	var count int
+	err := blg.DB.QueryRow("SELECT COUNT(*)"+searchFrom+where, args...).Scan(&count)
+	if err != nil {
+		return 0, searchError(err)
+	}
+	return count, nil
+}
+
+// Search returns the posts published at t that match opts.Query, best match
+// first as ranked by bm25 (matches in the title weigh the most, then the
+// summary, then the body).
+func (blg *Blog) Search(t time.Time, opts SearchOptions) ([]SearchResult, error) {
+	where, args := searchWhere(t, opts)
+	if where == "" {
+		return nil, nil
+	}
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = -1 // no limit
+	}
+	args = append([]interface{}{highlightStart, highlightEnd, highlightStart, highlightEnd}, args...)
+	rows, err := blg.DB.Query(
+		"SELECT p.post_id, p.slug, p.title, p.summary, p.body, p.published_on, p.unpublished_on, p.created_at, p.updated_at"+
+			", highlight(blg_posts_fts, 0, ?, ?), snippet(blg_posts_fts, 2, ?, ?, '…', 24)"+
+			searchFrom+where+
+			" ORDER BY bm25(blg_posts_fts, 10.0, 5.0, 1.0), p.published_on DESC LIMIT ? OFFSET ?",
+		append(args, limit, opts.Offset)...,
+	)
+	if err != nil {
+		return nil, searchError(err)
+	}
+	defer rows.Close()
+	var results []SearchResult
+	for rows.Next() {
+		var result SearchResult
+		var title, snippet string
+		err = rows.Scan(
+			&result.PostID, &result.Slug, &result.Title, &result.Summary, &result.Body,
+			&result.PublishedOn, &result.UnpublishedOn, &result.CreatedAt, &result.UpdatedAt,
+			&title, &snippet,
+		)
+		if err != nil {
+			return nil, err
+		}
+		result.TitleHTML = highlightHTML(title)
+		result.Snippet = highlightHTML(snippet)
+		results = append(results, result)
+	}
+	err = rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, searchError(err)
+	}
+	posts := make([]Post, len(results))
+	for i := range results {
+		posts[i] = results[i].Post
+	}
+	err = blg.loadMeta(posts)
+	if err != nil {
+		return nil, err
+	}
+	for i := range results {
+		results[i].Post = posts[i]
+	}
+	return results, nil
+}
+
+// searchError wraps the FTS5 errors caused by the query in ErrInvalidQuery.
+func searchError(err error) error {
+	if strings.HasPrefix(err.Error(), "fts5:") || strings.Contains(err.Error(), "malformed MATCH") {
+		return fmt.Errorf("%w: %s", ErrInvalidQuery, err.Error())
+	}
+	return err
+}
+
+// ftsQuery converts what was typed into the search box into an FTS5 query.
+// Every word and "quoted phrase" has to match, unless there is an OR between
+// two of them. A word or phrase that ends with * matches as a prefix. Every
+// word and phrase is quoted in the FTS5 query, so FTS5 operators and special
+// characters in the search box are searched for instead of being interpreted.
+// Words and phrases without any letters or digits are dropped.
+func ftsQuery(q string) string {
+	type term struct {
+		text   string
+		prefix bool
+		or     bool
+	}
+	var terms []term
+	for q = strings.TrimSpace(q); q != ""; q = strings.TrimLeftFunc(q, unicode.IsSpace) {
+		var t term
+		if q[0] == '"' {
+			end := strings.IndexByte(q[1:], '"')
+			if end < 0 {
+				t.text, q = q[1:], ""
+			} else {
+				t.text, q = q[1:end+1], q[end+2:]
+			}
+			if strings.HasPrefix(q, "*") {
+				t.prefix = true
+				q = strings.TrimLeft(q, "*")
+			}
+		} else {
+			end := strings.IndexFunc(q, func(r rune) bool { return unicode.IsSpace(r) || r == '"' })
+			if end < 0 {
+				end = len(q)
+			}
+			t.text, q = q[:end], q[end:]
+			if t.text == "OR" {
+				t.or = true
+			} else if strings.HasSuffix(t.text, "*") {
+				t.prefix = true
+				t.text = strings.TrimRight(t.text, "*")
+			}
+		}
+		if !t.or && strings.IndexFunc(t.text, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }) < 0 {
+			continue
+		}
+		terms = append(terms, t)
+	}
+	var b strings.Builder
+	for i, t := range terms {
+		if t.or {
+			// OR only counts between two terms
+			if i > 0 && i < len(terms)-1 && !terms[i-1].or && !terms[i+1].or {
+				b.WriteString(" OR")
+			}
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString(" ")
+		}
+		b.WriteString(`"` + strings.ReplaceAll(t.text, `"`, `""`) + `"`)
+		if t.prefix {
+			b.WriteString("*")
+		}
+	}
+	return b.String()
+}
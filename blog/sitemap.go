@@ -0,0 +1,72 @@
+package blog
+
+import (
+	"github.com/bokwoon95/weblog/pagemanager"
+)
+
+// SitemapURLs returns the blog's pages for the sitemap: the post index, the
+// published posts and the group pages.
+func (blg *Blog) SitemapURLs() ([]pagemanager.SitemapURL, error) {
+	t := now()
+	posts, err := blg.PublishedPosts(t, nil, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	format, err := blg.postURLFormat()
+	if err != nil {
+		return nil, err
+	}
+	urls := []pagemanager.SitemapURL{{Path: "/" + blg.namespace}} // the index, last modified with its latest post
+	for _, post := range posts {
+		lastmod := post.UpdatedAt
+		if post.PublishedOn.Time.After(lastmod) {
+			lastmod = post.PublishedOn.Time
+		}
+		if lastmod.After(urls[0].LastMod) {
+			urls[0].LastMod = lastmod
+		}
+		urls = append(urls, pagemanager.SitemapURL{Path: blg.postURL(format, post), LastMod: lastmod})
+	}
+	groups, err := blg.Groups(t)
+	if err != nil {
+		return nil, err
+	}
+	for _, keyGroups := range groups {
+		for _, group := range keyGroups {
+			urls = append(urls, pagemanager.SitemapURL{Path: group.URL})
+		}
+	}
+	return urls, nil
+}
+
+// ExportURLs returns the feeds of the blog and of its groups, which a static
+// export of the site needs on top of the sitemap URLs.
+func (blg *Blog) ExportURLs() ([]string, error) {
+	groups, err := blg.Groups(now())
+	if err != nil {
+		return nil, err
+	}
+	paths := []string{"/" + blg.namespace}
+	for _, keyGroups := range groups {
+		for _, group := range keyGroups {
+			paths = append(paths, group.URL)
+		}
+	}
+	var urls []string
+	for _, path := range paths {
+		for _, kind := range []string{feedRSS, feedAtom, feedJSON} {
+			urls = append(urls, path+"/"+kind)
+		}
+	}
+	return urls, nil
+}
+
+// DynamicURLs returns the pages of the blog that need the server: the search
+// page, which searches as you type in a query, and the admin pages.
+func (blg *Blog) DynamicURLs() []string {
+	return []string{
+		"/" + blg.namespace + "/search",
+		"/" + blg.namespace + "/edit",
+		"/" + blg.namespace + "/admin",
+	}
+}
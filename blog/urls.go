@@ -0,0 +1,155 @@
+package blog
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/weblog/pagemanager"
+)
+
+// placeholderRegexp matches the placeholders of a post URL format.
+var placeholderRegexp = regexp.MustCompile(`{[^{}]*}`)
+
+// placeholderPatterns are the regexps that the placeholders of a post URL
+// format match.
+var placeholderPatterns = map[string]string{
+	"{year}":  `\d{4}`,
+	"{month}": `\d{2}`,
+	"{day}":   `\d{2}`,
+	"{slug}":  `(?P<slug>[^/]+)`,
+}
+
+// checkPostURLFormat reports whether format is a valid post URL format. A post
+// URL format is the path of a post relative to the blog, made up of text and
+// the placeholders {year}, {month}, {day} and {slug}. {slug} must appear
+// exactly once. The date placeholders are filled in from the post's publish
+// date (or its creation date, for drafts). Some formats from blog.txt:
+//
+//	{slug}
+//	{year}/{month}/{day}/{slug}
+//	{year}-{month}-{day}/{slug}
+//	{year}/{month}/{slug}
+//	{year}-{month}/{slug}
+func checkPostURLFormat(format string) error {
+	if format == "" || strings.HasPrefix(format, "/") || strings.HasSuffix(format, "/") {
+		return fmt.Errorf("post URL format %q must not be empty or start or end with a /", format)
+	}
+	if strings.ContainsAny(format, "?#") {
+		return fmt.Errorf("post URL format %q must not contain a ? or #", format)
+	}
+	var slugs int
+	for _, placeholder := range placeholderRegexp.FindAllString(format, -1) {
+		if _, ok := placeholderPatterns[placeholder]; !ok {
+			return fmt.Errorf("post URL format %q: unknown placeholder %s", format, placeholder)
+		}
+		if placeholder == "{slug}" {
+			slugs++
+		}
+	}
+	if slugs != 1 {
+		return fmt.Errorf("post URL format %q must contain {slug} exactly once", format)
+	}
+	if strings.ContainsAny(placeholderRegexp.ReplaceAllString(format, ""), "{}") {
+		return fmt.Errorf("post URL format %q has an unclosed placeholder", format)
+	}
+	return nil
+}
+
+// postURLRegexp returns a regexp that matches the paths generated by the post
+// URL format, capturing the slug.
+func postURLRegexp(format string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("^")
+	last := 0
+	for _, loc := range placeholderRegexp.FindAllStringIndex(format, -1) {
+		b.WriteString(regexp.QuoteMeta(format[last:loc[0]]))
+		b.WriteString(placeholderPatterns[format[loc[0]:loc[1]]])
+		last = loc[1]
+	}
+	b.WriteString(regexp.QuoteMeta(format[last:]))
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
+// postDate is the date that fills in the date placeholders of the post's URL.
+func postDate(post Post) time.Time {
+	if post.PublishedOn.Valid {
+		return post.PublishedOn.Time
+	}
+	return post.CreatedAt
+}
+
+// postURL returns the URL of the post under the post URL format.
+func (blg *Blog) postURL(format string, post Post) string {
+	date := postDate(post).UTC()
+	path := strings.NewReplacer(
+		"{year}", date.Format("2006"),
+		"{month}", date.Format("01"),
+		"{day}", date.Format("02"),
+		"{slug}", post.Slug,
+	).Replace(format)
+	return "/" + blg.namespace + "/" + path
+}
+
+// postURLFormat returns the post URL format of the blog.
+func (blg *Blog) postURLFormat() (string, error) {
+	format, err := blg.config(configPostURL)
+	if err != nil {
+		return "", err
+	}
+	if checkPostURLFormat(format) != nil {
+		return defaultConfig[configPostURL], nil
+	}
+	return format, nil
+}
+
+// wasPublished reports whether the post has been published at some point
+// before t, i.e. whether its URL may have been linked to.
+func (post Post) wasPublished(t time.Time) bool {
+	return post.PublishedOn.Valid && !post.PublishedOn.Time.After(t)
+}
+
+// SetPostURLFormat changes the post URL format of the blog. Every post that
+// has been published gets a permanent redirect in pm_routes from its URL
+// under the current format to its URL under the new one, so that existing
+// links keep working.
+func (blg *Blog) SetPostURLFormat(format string) error {
+	err := checkPostURLFormat(format)
+	if err != nil {
+		return err
+	}
+	oldFormat, err := blg.postURLFormat()
+	if err != nil {
+		return err
+	}
+	var posts []Post
+	if format != oldFormat {
+		posts, err = blg.queryPosts("SELECT "+postColumns+" FROM blg_posts WHERE published_on <= ?", now())
+		if err != nil {
+			return err
+		}
+	}
+	tx, err := blg.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, post := range posts {
+		err = pagemanager.AddRedirect(tx, blg.postURL(oldFormat, post), blg.postURL(format, post))
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec("INSERT INTO blg_config (key, value) VALUES (?, ?) ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value", configPostURL, format)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	blg.cache.Del(configPostURL)
+	return nil
+}
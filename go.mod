@@ -3,6 +3,7 @@ module github.com/bokwoon95/weblog
 go 1.16
 
 require (
+	github.com/alecthomas/chroma v0.10.0
 	github.com/bokwoon95/go-structured-query v1.1.1
 	github.com/davecgh/go-spew v1.1.1
 	github.com/dgraph-io/ristretto v0.0.3
@@ -13,5 +14,7 @@ require (
 	github.com/microcosm-cc/bluemonday v1.0.4
 	github.com/oxtoacart/bpool v0.0.0-20190530202638-03653db5a59c
 	github.com/pelletier/go-toml v1.8.1
-	gopkg.in/yaml.v2 v2.4.0 // indirect
+	github.com/yuin/goldmark v1.4.11
+	github.com/yuin/goldmark-highlighting v0.0.0-20220208100518-594be1970594
+	gopkg.in/yaml.v2 v2.4.0
 )
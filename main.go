@@ -2,11 +2,14 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
+	"io/fs"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/bokwoon95/weblog/blog"
 	"github.com/bokwoon95/weblog/pagemanager"
@@ -15,6 +18,18 @@ import (
 const port = ":80"
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "lint":
+			os.Exit(lint(os.Args[2:]))
+		case "theme":
+			os.Exit(theme(os.Args[2:]))
+		case "export":
+			os.Exit(export(os.Args[2:]))
+		case "sync":
+			os.Exit(sync(os.Args[2:]))
+		}
+	}
 	a, err := os.Executable()
 	if err != nil {
 		log.Fatalln(err)
@@ -52,3 +67,190 @@ func main() {
 		}
 	}
 }
+
+// lint lints the named themes (including the embedded default themes), or
+// every theme if no names are given. It returns the exit code of the lint
+// command.
+//
+//	weblog lint [theme...]
+func lint(names []string) int {
+	fsys := pagemanager.ThemesFS("./themes")
+	if len(names) == 0 {
+		entries, err := fs.ReadDir(fsys, ".")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+			if _, err := fs.Stat(fsys, entry.Name()+"/theme.toml"); err == nil {
+				names = append(names, entry.Name())
+			}
+		}
+	}
+	var failed bool
+	for _, name := range names {
+		errs := pagemanager.LintTheme(fsys, name)
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		if len(errs) > 0 {
+			failed = true
+			continue
+		}
+		fmt.Printf("%s: ok\n", name)
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// theme manages the themes in ./themes.
+//
+//	weblog theme list
+//	weblog theme install <archive>
+//	weblog theme use <theme> [scope]
+func theme(args []string) int {
+	usage := "usage: weblog theme list | install <archive> | use <theme> [scope]"
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		themes, err := pagemanager.ListThemes(pagemanager.ThemesFS("./themes"))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		for _, cfg := range themes {
+			fmt.Printf("%s\t%s %s\t%s\n", cfg.Dir(), cfg.Name, cfg.Version, cfg.Author)
+		}
+	case args[0] == "install" && len(args) == 2:
+		cfg, err := pagemanager.InstallTheme("./themes", args[1])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("installed themes/%s\n", cfg.Dir())
+	case args[0] == "use" && (len(args) == 2 || len(args) == 3):
+		pm, err := pagemanager.New("sqlite3", "./database.sqlite3")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer pm.DB.Close()
+		scope := pagemanager.SiteScope
+		if len(args) == 3 {
+			scope = args[2]
+		}
+		err = pm.SetTheme(scope, args[1])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+	return 0
+}
+
+// export writes a static copy of the site into dir (see
+// pagemanager.PageManager.Export) and lists the URLs that could not be
+// exported.
+//
+//	weblog export [-base-url https://example.com] [-redirects-file] <dir>
+func export(args []string) int {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	var opts pagemanager.ExportOptions
+	flags.StringVar(&opts.BaseURL, "base-url", "http://localhost", "the scheme and host the static site is served from")
+	flags.BoolVar(&opts.RedirectsFile, "redirects-file", false, "write redirects into a _redirects file instead of meta refresh pages")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: weblog export [-base-url URL] [-redirects-file] <dir>")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	pm, err := pagemanager.New("sqlite3", "./database.sqlite3")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer pm.DB.Close()
+	err = pm.AddPlugins(blog.New("blog"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	report, err := pm.Export(flags.Arg(0), opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	for _, skipped := range report.Skipped {
+		fmt.Fprintf(os.Stderr, "not exported: %v\n", skipped)
+	}
+	fmt.Printf("exported %d files to %s\n", len(report.Files), flags.Arg(0))
+	return 0
+}
+
+// sync syncs the HTML and markdown files in dir (./pages by default) into
+// pm_routes (see pagemanager.PageManager.SyncPages), printing the changes. With
+// -watch it keeps syncing whenever the files change.
+//
+//	weblog sync [-dry-run] [-watch] [-template plainsimple/page.html] [dir]
+func sync(args []string) int {
+	flags := flag.NewFlagSet("sync", flag.ContinueOnError)
+	var opts pagemanager.SyncOptions
+	flags.BoolVar(&opts.DryRun, "dry-run", false, "print the changes without making them")
+	flags.StringVar(&opts.Template, "template", "plainsimple/page.html", "the template of markdown files that do not set one")
+	watch := flags.Bool("watch", false, "keep syncing the files as they change")
+	interval := flags.Duration("interval", time.Second, "how often -watch checks the files for changes")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: weblog sync [-dry-run] [-watch] [-template TEMPLATE] [dir]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() > 1 || (opts.DryRun && *watch) {
+		flags.Usage()
+		return 2
+	}
+	dir := "./pages"
+	if flags.NArg() == 1 {
+		dir = flags.Arg(0)
+	}
+	pm, err := pagemanager.New("sqlite3", "./database.sqlite3")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer pm.DB.Close()
+	fsys := os.DirFS(dir)
+	for {
+		changes, err := pm.SyncPages(fsys, opts)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			if !*watch {
+				return 1
+			}
+		}
+		for _, change := range changes {
+			fmt.Println(change)
+		}
+		if !*watch {
+			return 0
+		}
+		time.Sleep(*interval)
+	}
+}
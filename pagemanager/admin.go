@@ -0,0 +1,227 @@
+package pagemanager
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// IsAdmin reports whether the request is authenticated as the admin with HTTP
+// basic auth. The admin credentials are read from the PM_ADMIN_USER and
+// PM_ADMIN_PASSWORD environment variables. If PM_ADMIN_PASSWORD is not set,
+// nobody is an admin.
+func (pm *PageManager) IsAdmin(r *http.Request) bool {
+	if pm.adminPassword == "" {
+		return false
+	}
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(pm.adminUser)) == 1
+	passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(pm.adminPassword)) == 1
+	return userOK && passwordOK
+}
+
+// RequireAdmin is a middleware that only lets admins through.
+func (pm *PageManager) RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !pm.IsAdmin(r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="pagemanager", charset="UTF-8"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// SameOrigin is a middleware that rejects cross-site requests that change
+// state, i.e. anything but GET, HEAD and OPTIONS. Browsers send basic auth
+// credentials along with a form that another site posts to this one, so
+// RequireAdmin alone would let that site act as the admin. A request is
+// same-origin if its Sec-Fetch-Site header says so or, in browsers that do
+// not send it, if its Origin (or failing that, Referer) header has the host
+// of the request. Requests with none of those headers do not come from a
+// browser and are let through.
+func SameOrigin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "HEAD", "OPTIONS":
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !isSameOrigin(r) {
+			http.Error(w, "cross-origin request rejected", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func isSameOrigin(r *http.Request) bool {
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" {
+		return site == "same-origin" || site == "none" // "none" is the user typing the URL
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Header.Get("Referer")
+	}
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// localRedirect returns to if it is a path on this site, or fallback if it is
+// not, so that the redirect_to of a form cannot send the admin elsewhere.
+func localRedirect(to, fallback string) string {
+	if !strings.HasPrefix(to, "/") || strings.HasPrefix(to, "//") || strings.HasPrefix(to, "/\\") {
+		return fallback
+	}
+	return to
+}
+
+// ThemeInfo is a theme as listed by the theme admin.
+type ThemeInfo struct {
+	Dir         string   `json:"dir"`
+	Name        string   `json:"name"`
+	Author      string   `json:"author"`
+	Version     string   `json:"version"`
+	Description string   `json:"description"`
+	Screenshot  string   `json:"screenshot,omitempty"` // URL of the screenshot
+	ActiveFor   []string `json:"active_for"`           // scopes the theme is active for
+}
+
+func (pm *PageManager) ThemesGet(w http.ResponseWriter, r *http.Request) {
+	themes, err := ListThemes(pm.Themes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	active := make(map[string][]string)
+	rows, err := pm.DB.Query("SELECT scope, theme FROM pm_themes ORDER BY scope")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var scope, theme string
+		err = rows.Scan(&scope, &theme)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		active[theme] = append(active[theme], scope)
+	}
+	infos := make([]ThemeInfo, len(themes))
+	for i, cfg := range themes {
+		infos[i] = ThemeInfo{
+			Dir:         cfg.Dir(),
+			Name:        cfg.Name,
+			Author:      cfg.Author,
+			Version:     cfg.Version,
+			Description: cfg.Description,
+			ActiveFor:   active[cfg.Dir()],
+		}
+		if cfg.Screenshot != "" {
+			infos[i].Screenshot = "/pm-admin/themes/" + cfg.Dir() + "/screenshot"
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(infos)
+}
+
+func (pm *PageManager) ThemeScreenshotGet(w http.ResponseWriter, r *http.Request) {
+	cfg, err := LoadThemeConfig(pm.Themes, path.Join(chi.URLParam(r, "theme"), themeConfigFilename))
+	if err != nil || cfg.Screenshot == "" {
+		http.NotFound(w, r)
+		return
+	}
+	name := path.Join(cfg.Dir(), path.Clean("/"+cfg.Screenshot))
+	b, err := fs.ReadFile(pm.Themes, name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(b))
+}
+
+// ThemesPost installs the theme archive uploaded in the "theme" field of a
+// multipart form.
+func (pm *PageManager) ThemesPost(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxThemeSize)
+	file, header, err := r.FormFile("theme")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	// Keep the uploaded filename's extension, InstallTheme uses it to
+	// detect the archive format
+	tmpDir, err := os.MkdirTemp("", "pm-theme-")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+	archive := filepath.Join(tmpDir, filepath.Base(filepath.FromSlash(header.Filename)))
+	f, err := os.Create(archive)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = io.Copy(f, file)
+	f.Close()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = InstallTheme(pm.ThemesDirectory, archive)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, "/pm-admin/themes", http.StatusSeeOther)
+}
+
+type ThemeActivatePostData struct {
+	Scope      string `json:"scope"`
+	Theme      string `json:"theme"`
+	RedirectTo string `json:"redirect_to"`
+}
+
+// ThemeActivatePost activates a theme for a scope (see SiteScope).
+func (pm *PageManager) ThemeActivatePost(w http.ResponseWriter, r *http.Request) {
+	data := ThemeActivatePostData{}
+	err := decodeJSONBody(w, r, &data)
+	if err != nil {
+		var mr *malformedRequest
+		switch {
+		case errors.As(err, &mr):
+			http.Error(w, mr.msg, mr.status)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	err = pm.SetTheme(data.Scope, data.Theme)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, localRedirect(data.RedirectTo, "/pm-admin/themes"), http.StatusSeeOther)
+}
@@ -0,0 +1,406 @@
+package pagemanager
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"html"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bokwoon95/weblog/pagemanager/renderly"
+)
+
+// Exporter is implemented by plugins that take part in a static export of the
+// site.
+type Exporter interface {
+	// ExportURLs returns the URLs that belong in the export on top of the
+	// plugin's sitemap URLs (see Sitemapper), such as feeds.
+	ExportURLs() ([]string, error)
+	// DynamicURLs returns the URL prefixes of the pages that only work when
+	// served by the server, such as search pages. A prefix covers its URL
+	// and every URL below it, e.g. "/blog/search" covers
+	// "/blog/search/advanced". Export leaves them out even if the exported
+	// pages link to them, and lists them in the report.
+	DynamicURLs() []string
+}
+
+type exportKey struct{}
+
+// IsExport reports whether the request is Export rendering the site. Themes
+// see it as __export__ (see RenderTemplate), so that they can drop what a
+// static site cannot serve, such as forms.
+func IsExport(r *http.Request) bool {
+	export, _ := r.Context().Value(exportKey{}).(bool)
+	return export
+}
+
+// ExportOptions are the options of Export.
+type ExportOptions struct {
+	// BaseURL is the scheme and host that the exported site will be served
+	// from, e.g. "https://example.com". It defaults to "http://localhost".
+	BaseURL string
+	// RedirectsFile writes the redirects into a _redirects file (as read by
+	// Netlify and Cloudflare Pages) instead of writing a page with a meta
+	// refresh at every redirected URL.
+	RedirectsFile bool
+}
+
+// ExportReport is what Export did.
+type ExportReport struct {
+	Files   []string      // the files written, relative to the export directory
+	Skipped []ExportError // the URLs that could not be exported
+}
+
+// ExportError is a URL that could not be exported.
+type ExportError struct {
+	URL      string
+	Referrer string // the page that linked to URL, if it was found on a page
+	Reason   string
+}
+
+func (e ExportError) Error() string {
+	if e.Referrer != "" {
+		return e.URL + " (linked from " + e.Referrer + "): " + e.Reason
+	}
+	return e.URL + ": " + e.Reason
+}
+
+// exportManifest is the file in the export directory that lists the files of
+// the last export, so that the next export can remove the ones that are gone.
+const exportManifest = ".pm-export"
+
+// exportLink matches the href and src attributes of an HTML page.
+var exportLink = regexp.MustCompile(`(?i)\s(?:href|src)\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+
+// Export writes a static copy of the site into dir. Every pm_routes entry
+// that is not disabled, every URL of the plugins that are Sitemappers or
+// Exporters, /robots.txt and /sitemap.xml are requested through pm.Router,
+// and so is every page or asset of the site that the exported HTML pages link
+// to. A page is written to index.html in the directory of its URL unless its
+// URL ends in a file extension (/blog/rss.xml), and redirects become pages
+// with a meta refresh or lines of a _redirects file (see ExportOptions).
+//
+// URLs that respond with an error, the dynamic URLs of the plugins (see
+// Exporter) and URLs with a query string (which a static site has no way of
+// serving) are left out and listed in the report.
+// The output only depends on the content of the site, so an export kept in
+// git diffs cleanly: the files of the previous export into dir that are no
+// longer part of the site are removed, and pages are rendered without nonces
+// (see renderly.ContextWithoutNonce).
+func (pm *PageManager) Export(dir string, opts ExportOptions) (ExportReport, error) {
+	var report ExportReport
+	if opts.BaseURL == "" {
+		opts.BaseURL = "http://localhost"
+	}
+	base, err := url.Parse(strings.TrimSuffix(opts.BaseURL, "/"))
+	if err != nil {
+		return report, err
+	}
+	if (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" || base.Path != "" {
+		return report, fmt.Errorf("base URL %q is not a scheme and host like https://example.com", opts.BaseURL)
+	}
+	urls, dynamic, err := pm.exportURLs()
+	if err != nil {
+		return report, err
+	}
+	err = removeExport(dir)
+	if err != nil {
+		return report, err
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return report, err
+	}
+	files := make(map[string][]byte)
+	redirects := make(map[string]string)
+	referrers := make(map[string]string) // the page each URL was found on, "" for the URLs of exportURLs
+	for _, u := range urls {
+		referrers[u] = ""
+	}
+	for queue := urls; len(queue) > 0; queue = queue[1:] {
+		u := queue[0]
+		skip := func(reason string) {
+			report.Skipped = append(report.Skipped, ExportError{URL: u, Referrer: referrers[u], Reason: reason})
+		}
+		target, err := url.Parse(u)
+		if err != nil {
+			skip(err.Error())
+			continue
+		}
+		if isDynamicURL(target.Path, dynamic) {
+			skip("a static site cannot serve dynamic pages")
+			continue
+		}
+		if target.RawQuery != "" {
+			skip("a static site cannot serve URLs with a query string")
+			continue
+		}
+		r, err := http.NewRequest("GET", base.String()+u, nil)
+		if err != nil {
+			skip(err.Error())
+			continue
+		}
+		if base.Scheme == "https" {
+			r.TLS = &tls.ConnectionState{} // for BaseURL
+		}
+		r = r.WithContext(context.WithValue(renderly.ContextWithoutNonce(r.Context()), exportKey{}, true))
+		w := httptest.NewRecorder()
+		pm.Router.ServeHTTP(w, r)
+		var links []string
+		switch {
+		case w.Code == http.StatusOK:
+			name := exportFile(r.URL.Path)
+			if _, ok := files[name]; ok {
+				continue // e.g. /blog and /blog/
+			}
+			files[name] = w.Body.Bytes()
+			if strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+				links = exportLinks(base, r.URL, w.Body.String())
+			}
+		case w.Code >= 300 && w.Code < 400 && w.Header().Get("Location") != "":
+			location, err := r.URL.Parse(w.Header().Get("Location"))
+			if err != nil {
+				skip(err.Error())
+				continue
+			}
+			to := location.String()
+			if location.Host == base.Host {
+				to = siteURL(location)
+				links = append(links, to)
+			}
+			redirects[r.URL.EscapedPath()] = to
+		default:
+			skip(strconv.Itoa(w.Code) + " " + http.StatusText(w.Code))
+		}
+		for _, link := range links {
+			if _, ok := referrers[link]; ok {
+				continue
+			}
+			referrers[link] = u
+			queue = append(queue, link)
+		}
+	}
+	if opts.RedirectsFile && len(redirects) > 0 {
+		var b bytes.Buffer
+		for _, from := range sortedKeys(redirects) {
+			b.WriteString(from + " " + redirects[from] + " 301\n")
+		}
+		files["_redirects"] = b.Bytes()
+	} else {
+		for _, from := range sortedKeys(redirects) {
+			p, err := url.PathUnescape(from)
+			if err != nil {
+				return report, err
+			}
+			name := exportFile(p)
+			if _, ok := files[name]; !ok {
+				files[name] = redirectPage(redirects[from])
+			}
+		}
+	}
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		filename := filepath.Join(dir, filepath.FromSlash(name))
+		err = os.MkdirAll(filepath.Dir(filename), 0755)
+		if err != nil {
+			return report, err
+		}
+		err = os.WriteFile(filename, files[name], 0644)
+		if err != nil {
+			return report, err
+		}
+		report.Files = append(report.Files, name)
+	}
+	sort.Slice(report.Skipped, func(i, j int) bool { return report.Skipped[i].URL < report.Skipped[j].URL })
+	manifest := strings.Join(report.Files, "\n")
+	if manifest != "" {
+		manifest += "\n"
+	}
+	err = os.WriteFile(filepath.Join(dir, exportManifest), []byte(manifest), 0644)
+	if err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+// exportURLs returns the URLs that Export starts from, sorted, and the dynamic
+// URL prefixes of the plugins.
+func (pm *PageManager) exportURLs() (urls, dynamic []string, err error) {
+	set := map[string]bool{"/robots.txt": true, "/sitemap.xml": true}
+	rows, err := pm.DB.Query("SELECT url FROM pm_routes WHERE disabled IS NULL OR NOT disabled")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var u string
+		err = rows.Scan(&u)
+		if err != nil {
+			return nil, nil, err
+		}
+		set[u] = true
+	}
+	err = rows.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, plugin := range pm.plugins {
+		if sitemapper, ok := plugin.(Sitemapper); ok {
+			sitemap, err := sitemapper.SitemapURLs()
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, u := range sitemap {
+				set[u.Path] = true
+			}
+		}
+		if exporter, ok := plugin.(Exporter); ok {
+			exportURLs, err := exporter.ExportURLs()
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, u := range exportURLs {
+				set[u] = true
+			}
+			dynamic = append(dynamic, exporter.DynamicURLs()...)
+		}
+	}
+	sitemap, err := pm.SitemapURLs()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(sitemap) > sitemapSize {
+		for n := 1; (n-1)*sitemapSize < len(sitemap); n++ {
+			set["/sitemap-"+strconv.Itoa(n)+".xml"] = true
+		}
+	}
+	urls = make([]string, 0, len(set))
+	for u := range set {
+		urls = append(urls, u)
+	}
+	sort.Strings(urls)
+	return urls, dynamic, nil
+}
+
+// exportFile returns the file, relative to the export directory, that the
+// response for the URL path p is written to.
+func exportFile(p string) string {
+	name := strings.TrimPrefix(path.Clean("/"+p), "/")
+	if path.Ext(name) != "" && !strings.HasSuffix(p, "/") {
+		return name
+	}
+	return path.Join(name, "index.html")
+}
+
+// isDynamicURL reports whether the URL path p is covered by one of the
+// dynamic URL prefixes.
+func isDynamicURL(p string, dynamic []string) bool {
+	for _, prefix := range dynamic {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if p == prefix || strings.HasPrefix(p, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// exportLinks returns the URLs of the site that the HTML page at pageURL
+// links to, without their fragments.
+func exportLinks(base, pageURL *url.URL, page string) []string {
+	var links []string
+	for _, match := range exportLink.FindAllStringSubmatch(page, -1) {
+		href := html.UnescapeString(match[1] + match[2])
+		if href == "" || strings.HasPrefix(href, "#") {
+			continue
+		}
+		link, err := pageURL.Parse(href)
+		if err != nil || (link.Scheme != "http" && link.Scheme != "https") || link.Host != base.Host {
+			continue
+		}
+		links = append(links, siteURL(link))
+	}
+	return links
+}
+
+// siteURL returns the path and query of u.
+func siteURL(u *url.URL) string {
+	s := u.EscapedPath()
+	if s == "" {
+		s = "/"
+	}
+	if u.RawQuery != "" {
+		s += "?" + u.RawQuery
+	}
+	return s
+}
+
+// redirectPage returns the page that redirects a browser to the URL to.
+func redirectPage(to string) []byte {
+	to = html.EscapeString(to)
+	return []byte("<!DOCTYPE html>\n" +
+		"<meta charset=\"utf-8\">\n" +
+		"<title>Redirecting…</title>\n" +
+		"<link rel=\"canonical\" href=\"" + to + "\">\n" +
+		"<meta name=\"robots\" content=\"noindex\">\n" +
+		"<meta http-equiv=\"refresh\" content=\"0; url=" + to + "\">\n" +
+		"<a href=\"" + to + "\">" + to + "</a>\n")
+}
+
+// removeExport removes the files of the previous export into dir, listed in
+// its manifest, along with the directories that they leave empty.
+func removeExport(dir string) error {
+	f, err := os.Open(filepath.Join(dir, exportManifest))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		name := scanner.Text()
+		if !fs.ValidPath(name) || name == "." {
+			continue
+		}
+		err = os.Remove(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for parent := path.Dir(name); parent != "."; parent = path.Dir(parent) {
+			if os.Remove(filepath.Join(dir, filepath.FromSlash(parent))) != nil {
+				break // not empty
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
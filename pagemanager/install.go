@@ -0,0 +1,199 @@
+package pagemanager
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// maxThemeSize is the maximum number of bytes a theme archive may extract to.
+const maxThemeSize = 100 << 20
+
+// InstallTheme installs the theme in the .zip, .tar, .tar.gz or .tgz archive
+// into themesDir. The theme.toml may sit at the root of the archive or inside
+// a single top level directory. The theme is installed under its name in
+// theme.toml, or under the archive's basename if it has no name. The theme is
+// linted before it is installed, and an already installed theme is never
+// overwritten.
+func InstallTheme(themesDir, archive string) (ThemeConfig, error) {
+	var cfg ThemeConfig
+	tmpDir, err := os.MkdirTemp(themesDir, ".install-")
+	if err != nil {
+		return cfg, err
+	}
+	defer os.RemoveAll(tmpDir)
+	base := filepath.Base(archive)
+	switch {
+	case strings.HasSuffix(base, ".zip"):
+		err = extractZip(tmpDir, archive)
+	case strings.HasSuffix(base, ".tar"):
+		err = extractTar(tmpDir, archive, false)
+	case strings.HasSuffix(base, ".tar.gz"), strings.HasSuffix(base, ".tgz"):
+		err = extractTar(tmpDir, archive, true)
+	default:
+		return cfg, fmt.Errorf("%s: unsupported archive format (must be .zip, .tar, .tar.gz or .tgz)", archive)
+	}
+	if err != nil {
+		return cfg, fmt.Errorf("%s: %w", archive, err)
+	}
+	root := tmpDir
+	if _, err := os.Stat(filepath.Join(root, themeConfigFilename)); err != nil {
+		entries, _ := os.ReadDir(root)
+		if len(entries) != 1 || !entries[0].IsDir() {
+			return cfg, fmt.Errorf("%s: no %s found", archive, themeConfigFilename)
+		}
+		root = filepath.Join(root, entries[0].Name())
+	}
+	cfg, err = LoadThemeConfig(os.DirFS(root), themeConfigFilename)
+	if err != nil {
+		return cfg, fmt.Errorf("%s: %w", archive, err)
+	}
+	errs := LintTheme(os.DirFS(root), ".")
+	if len(errs) > 0 {
+		msgs := make([]string, len(errs))
+		for i, err := range errs {
+			msgs[i] = err.Error()
+		}
+		return cfg, fmt.Errorf("%s: theme has errors:\n%s", archive, strings.Join(msgs, "\n"))
+	}
+	name := cfg.Name
+	if name == "" {
+		name = base
+		for _, ext := range []string{".zip", ".tar", ".tar.gz", ".tgz"} {
+			if strings.HasSuffix(base, ext) {
+				name = strings.TrimSuffix(base, ext)
+			}
+		}
+	}
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return cfg, fmt.Errorf("%s: invalid theme name %q", archive, name)
+	}
+	dest := filepath.Join(themesDir, name)
+	if _, err := os.Stat(dest); err == nil {
+		return cfg, fmt.Errorf("theme %s is already installed", name)
+	}
+	err = os.Rename(root, dest)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Filename = path.Join(name, themeConfigFilename)
+	return cfg, nil
+}
+
+// extractPath returns the path inside dir that the archive entry name should
+// be extracted to, rejecting entries that would escape dir.
+func extractPath(dir, name string) (string, error) {
+	name = strings.ReplaceAll(name, `\`, "/")
+	cleaned := path.Clean(name)
+	if path.IsAbs(name) || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("illegal path in archive: %s", name)
+	}
+	return filepath.Join(dir, filepath.FromSlash(cleaned)), nil
+}
+
+// extractFile writes at most *remaining bytes of src to the file dst.
+func extractFile(dst string, src io.Reader, remaining *int64) error {
+	err := os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	n, err := io.Copy(f, io.LimitReader(src, *remaining+1))
+	if err != nil {
+		return err
+	}
+	*remaining -= n
+	if *remaining < 0 {
+		return fmt.Errorf("archive is larger than %d bytes when extracted", maxThemeSize)
+	}
+	return f.Close()
+}
+
+func extractZip(dir, archive string) error {
+	zr, err := zip.OpenReader(archive)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	remaining := int64(maxThemeSize)
+	for _, file := range zr.File {
+		dst, err := extractPath(dir, file.Name)
+		if err != nil {
+			return err
+		}
+		mode := file.Mode()
+		switch {
+		case mode.IsDir():
+			err = os.MkdirAll(dst, 0755)
+		case mode.IsRegular():
+			var rc io.ReadCloser
+			rc, err = file.Open()
+			if err != nil {
+				return err
+			}
+			err = extractFile(dst, rc, &remaining)
+			rc.Close()
+		default:
+			err = fmt.Errorf("%s: only regular files and directories are allowed in a theme", file.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extractTar(dir, archive string, gzipped bool) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if gzipped {
+		gr, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		r = gr
+	}
+	tr := tar.NewReader(r)
+	remaining := int64(maxThemeSize)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		dst, err := extractPath(dir, hdr.Name)
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(dst, 0755)
+		case tar.TypeReg:
+			err = extractFile(dst, tr, &remaining)
+		case tar.TypeXGlobalHeader:
+			continue
+		default:
+			err = fmt.Errorf("%s: only regular files and directories are allowed in a theme", hdr.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package pagemanager
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"strconv"
+)
+
+// migrations are the changes to the pagemanager tables since the original
+// init.sql, one .sql file each.
+//
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// Migrate brings a set of tables up to date by running the migrations in
+// fsys that have not run yet: the .sql files at the root of fsys in the order
+// of their names, of which the first version have already run. Each runs in
+// its own transaction together with setVersion, which records the number of
+// migrations run so far. Migrations are only ever appended, never edited,
+// since databases out there may have had them already.
+func Migrate(db *sql.DB, fsys fs.FS, version int, setVersion func(tx *sql.Tx, version int) error) error {
+	names, err := fs.Glob(fsys, "*.sql")
+	if err != nil {
+		return err
+	}
+	if version > len(names) {
+		return fmt.Errorf("the database has had %d migrations, but only %d are known: is the binary out of date?", version, len(names))
+	}
+	for i := version; i < len(names); i++ {
+		b, err := fs.ReadFile(fsys, names[i])
+		if err != nil {
+			return err
+		}
+		err = migrate(db, string(b), i+1, setVersion)
+		if err != nil {
+			return fmt.Errorf("migration %s: %w", names[i], err)
+		}
+	}
+	return nil
+}
+
+func migrate(db *sql.DB, query string, version int, setVersion func(tx *sql.Tx, version int) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(query)
+	if err != nil {
+		return err
+	}
+	err = setVersion(tx, version)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// migrate brings the pagemanager tables up to date (see Migrate). The
+// database's user_version is the number of migrations that it has had, which
+// is 0 for a new database as well as for a database made from the original
+// init.sql.
+func (pm *PageManager) migrate() error {
+	var version int
+	err := pm.DB.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return err
+	}
+	fsys, err := fs.Sub(migrations, "migrations")
+	if err != nil {
+		return err
+	}
+	return Migrate(pm.DB, fsys, version, func(tx *sql.Tx, version int) error {
+		// PRAGMA statements take no bound parameters
+		_, err := tx.Exec("PRAGMA user_version = " + strconv.Itoa(version))
+		return err
+	})
+}
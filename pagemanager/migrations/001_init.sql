@@ -0,0 +1,18 @@
+-- The tables of the original init.sql, which databases made from it already
+-- have.
+CREATE TABLE IF NOT EXISTS pm_routes (
+    url TEXT NOT NULL PRIMARY KEY
+    ,disabled BOOLEAN
+    ,redirect_url TEXT
+    ,handler_url TEXT
+    ,content TEXT
+    ,template TEXT
+);
+
+CREATE TABLE IF NOT EXISTS pm_templatedata (
+    pageid TEXT NOT NULL
+    ,name TEXT NOT NULL
+    ,value TEXT
+
+    ,UNIQUE(pageid, name)
+);
@@ -0,0 +1,8 @@
+-- TOML, overrides the theme.toml args of the template
+ALTER TABLE pm_routes ADD COLUMN args TEXT;
+
+-- site-wide values of theme.toml args
+CREATE TABLE pm_kv (
+    key TEXT NOT NULL PRIMARY KEY
+    ,value TEXT
+);
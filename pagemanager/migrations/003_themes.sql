@@ -0,0 +1,6 @@
+-- the active theme of every scope: '' for the site's theme, or the namespace
+-- of a plugin
+CREATE TABLE pm_themes (
+    scope TEXT NOT NULL PRIMARY KEY
+    ,theme TEXT NOT NULL
+);
@@ -0,0 +1,2 @@
+-- keeps the URL out of the sitemap and search engines
+ALTER TABLE pm_routes ADD COLUMN noindex BOOLEAN;
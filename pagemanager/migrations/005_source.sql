@@ -0,0 +1,2 @@
+-- the file in the pages directory that the route is synced from
+ALTER TABLE pm_routes ADD COLUMN source TEXT;
@@ -1,19 +1,23 @@
 package pagemanager
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
+	"html/template"
 	"io"
 	"io/fs"
+	"net"
 	"net/http"
 	"os"
-	"path/filepath"
+	"path"
 	"regexp"
 	"strings"
 
 	sq "github.com/bokwoon95/go-structured-query/postgres"
 	"github.com/bokwoon95/weblog/pagemanager/renderly"
+	"github.com/bokwoon95/weblog/themes"
 	"github.com/dgraph-io/ristretto"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
@@ -29,7 +33,16 @@ type PageManager struct {
 	Router        *chi.Mux
 	htmlPolicy    *bluemonday.Policy
 	RootDirectory string
+	// ThemesDirectory is the directory that themes are installed in.
+	ThemesDirectory string
+	// Themes is ThemesDirectory overlaid on top of the embedded default
+	// themes, see ThemesFS.
+	Themes        fs.FS
 	Render        *renderly.Renderly
+	plugins       []Plugin
+	adminUser     string
+	adminPassword string
+	proxyHeader   string // see ClientIP
 }
 
 func New(driverName, dataSourceName string) (*PageManager, error) {
@@ -60,6 +73,10 @@ func New(driverName, dataSourceName string) (*PageManager, error) {
 	if err != nil {
 		return pm, fmt.Errorf("database ping failed: %w", err)
 	}
+	err = pm.migrate()
+	if err != nil {
+		return pm, fmt.Errorf("migrating the pagemanager tables: %w", err)
+	}
 	// Cache
 	pm.cache, err = ristretto.NewCache(&ristretto.Config{
 		NumCounters: 1e7,     // number of keys to track frequency of (10M).
@@ -73,27 +90,47 @@ func New(driverName, dataSourceName string) (*PageManager, error) {
 	// Router
 	pm.Router = chi.NewRouter()
 	pm.Router.Use(middleware.Recoverer)
-	pm.Router.Use(pm.pm_routes)
 	pm.Router.Use(SecurityHeaders)
+	pm.Router.Use(pm.pm_routes)
 	pm.Router.Get("/", func(w http.ResponseWriter, r *http.Request) {
 		chi.Walk(pm.Router, printroutes(w))
 		// io.WriteString(w, docgen.JSONRoutesDoc(pm.Router))
 	})
-	pm.Router.Get("/pm-admin", func(w http.ResponseWriter, r *http.Request) {
-		io.WriteString(w, "Welcome to the pagemanager dashboard")
+	pm.Router.Route("/pm-admin", func(r chi.Router) {
+		r.Use(pm.RequireAdmin, SameOrigin)
+		r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "Welcome to the pagemanager dashboard")
+		})
+		r.Get("/themes", pm.ThemesGet)
+		r.Post("/themes", pm.ThemesPost)
+		r.Post("/themes/activate", pm.ThemeActivatePost)
+		r.Get("/themes/{theme}/screenshot", pm.ThemeScreenshotGet)
+		r.Get("/robots.txt", pm.AdminRobotsGet)
+		r.Post("/robots.txt", pm.AdminRobotsPost)
 	})
-	pm.Router.Post("/pm-kv", pm.KVPost)
+	pm.Router.Get("/sitemap.xml", pm.SitemapGet)
+	pm.Router.Get("/sitemap-{n:[0-9]+}.xml", pm.SitemapPageGet)
+	pm.Router.Get("/robots.txt", pm.RobotsGet)
+	// pm_kv values are rendered into every page (see templateData), so only
+	// admins may write them
+	pm.Router.With(pm.RequireAdmin, SameOrigin).Post("/pm-kv", pm.KVPost)
 	pm.Router.Post("/restart", func(w http.ResponseWriter, r *http.Request) {
 		pm.Restart <- struct{}{}
 		http.Redirect(w, r, "/", http.StatusMovedPermanently)
 	})
 	// HTMLPolicy
-	pm.htmlPolicy = bluemonday.UGCPolicy()
-	pm.htmlPolicy.AllowStyling()
+	pm.htmlPolicy = newHTMLPolicy()
 	// RootDirectory
 	pm.RootDirectory = "." + string(os.PathSeparator) + "pagemanager" + string(os.PathSeparator)
+	// Admin
+	pm.adminUser = os.Getenv("PM_ADMIN_USER")
+	pm.adminPassword = os.Getenv("PM_ADMIN_PASSWORD")
+	// Proxy
+	pm.proxyHeader = os.Getenv("PM_PROXY_HEADER")
 	// renderly
-	pm.Render, err = renderly.New(os.DirFS("./themes"))
+	pm.ThemesDirectory = "./themes"
+	pm.Themes = ThemesFS(pm.ThemesDirectory)
+	pm.Render, err = newRender(pm.Themes, pm.htmlPolicy)
 	// pm.Router.Handle("/static/*", http.StripPrefix("/static/", pm.Render.FileServer()))
 	if err != nil {
 		return pm, err
@@ -101,15 +138,44 @@ func New(driverName, dataSourceName string) (*PageManager, error) {
 	return pm, nil
 }
 
+// ThemesFS returns the themes in dir (the "themes" layer) stacked on top of
+// the default themes embedded in the binary (the "embedded" layer). A file in
+// dir overrides the embedded file of the same name, so a theme can be
+// customized one file at a time.
+func ThemesFS(dir string) *renderly.LayeredFS {
+	return renderly.NewLayeredFS(
+		renderly.Layer{Name: "themes", FS: os.DirFS(dir)},
+		renderly.Layer{Name: "embedded", FS: themes.FS},
+	)
+}
+
+func newHTMLPolicy() *bluemonday.Policy {
+	policy := bluemonday.UGCPolicy()
+	policy.AllowStyling()
+	return policy
+}
+
+// newRender returns the renderly used to render themes. It is shared with
+// LintTheme so that themes are linted the same way they are rendered.
+func newRender(fsys fs.FS, htmlPolicy *bluemonday.Policy) (*renderly.Renderly, error) {
+	return renderly.New(
+		fsys,
+		renderly.TemplateFuncs(renderly.FuncMap()),
+		renderly.MarkdownPolicy(htmlPolicy),
+		renderly.HighlightStyles(),
+		renderly.Nonce(true),
+	)
+}
+
 func (pm *PageManager) pm_routes(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		data, found := pm.cache.Get(r.URL.Path)
 		route, ok := data.(Route)
 		if !found || !ok {
-			query := "SELECT url, disabled, redirect_url, handler_url, content, template FROM pm_routes WHERE url = ?"
+			query := "SELECT url, disabled, redirect_url, handler_url, content, template, args, noindex FROM pm_routes WHERE url = ?"
 			err := pm.DB.
 				QueryRow(query, r.URL.Path).
-				Scan(&route.URL, &route.Disabled, &route.RedirectURL, &route.HandlerURL, &route.Content, &route.Template)
+				Scan(&route.URL, &route.Disabled, &route.RedirectURL, &route.HandlerURL, &route.Content, &route.Template, &route.Args, &route.NoIndex)
 			if err != nil && !errors.Is(err, sql.ErrNoRows) {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
@@ -124,140 +190,212 @@ func (pm *PageManager) pm_routes(next http.Handler) http.Handler {
 			http.Redirect(w, r, route.RedirectURL.String, http.StatusMovedPermanently)
 			return
 		}
+		if route.NoIndex.Valid && route.NoIndex.Bool {
+			w.Header().Set("X-Robots-Tag", "noindex")
+			r = r.WithContext(context.WithValue(r.Context(), noindexKey{}, true))
+		}
 		if route.HandlerURL.Valid {
 			rctx := chi.RouteContext(r.Context())
 			rctx.RoutePath = route.HandlerURL.String
 			next.ServeHTTP(w, r)
 			return
 		}
-		if route.Content.Valid {
-			io.WriteString(w, route.Content.String)
-			return
-		}
 		if route.Template.Valid {
-			fsys, filename := pm.Render.Resolve(route.Template.String)
-			if fsys == nil {
-				http.Error(w, "can't locate fsys of "+route.Template.String, http.StatusInternalServerError)
+			// content is handed to the template as __content__, the same as
+			// the content of a markdown file would be
+			var data map[string]interface{}
+			if route.Content.Valid {
+				data = map[string]interface{}{"__content__": template.HTML(route.Content.String)}
 			}
-			src, err := getPageSource(fsys, filename)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			var files []string
-			if src.MainTemplate != "" {
-				files = append(files, src.MainTemplate)
-			}
-			files = append(files, src.Name)
-			files = append(files, src.Include...)
-			err = pm.Render.Page(w, r, nil, files...)
+			err := pm.renderTemplate(w, r, SiteScope, route.Template.String, route, data)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
 			return
 		}
+		if route.Content.Valid {
+			io.WriteString(w, route.Content.String)
+			return
+		}
 		next.ServeHTTP(w, r)
 	})
 }
 
-type PageSource struct {
-	Name         string
-	MainTemplate string                 `toml:"main_template"`
-	Include      []string               `toml:"include"`
-	Args         map[string]interface{} `toml:"args"`
+// RenderTemplate renders a theme template for a page that belongs to scope
+// (see SiteScope), the same way pm_routes renders its templates: the scope's
+// active theme is used if it has a file of the same name, and data is added on
+// top of the template's args (see templateData). __export__ is true when the
+// page is rendered for a static export of the site (see IsExport). Plugins
+// use it to render their pages with the themes in pm.Themes, e.g.
+//
+//	pm.RenderTemplate(w, r, "blog", "plainsimple/post.html", data)
+func (pm *PageManager) RenderTemplate(w http.ResponseWriter, r *http.Request, scope, template string, data map[string]interface{}) error {
+	return pm.renderTemplate(w, r, scope, template, Route{}, data)
 }
 
-func getPageSource(fsys fs.FS, filename string) (PageSource, error) {
-	const configFilename = "theme.toml"
-	src := PageSource{
-		Name: filename,
+func (pm *PageManager) renderTemplate(w http.ResponseWriter, r *http.Request, scope, template string, route Route, data map[string]interface{}) error {
+	template, err := pm.themedTemplate(r, scope, template)
+	if err != nil {
+		return err
+	}
+	src, err := getPageSource(pm.Render, template)
+	if err != nil {
+		return err
+	}
+	pagedata, err := pm.templateData(src, route)
+	if err != nil {
+		return err
 	}
-	currentPath := filename
-	var parentPath string
-	var configFound bool
-	for {
-		parentPath = filepath.Dir(currentPath)
-		if parentPath == currentPath {
-			break
+	for k, v := range data {
+		pagedata[k] = v
+	}
+	if IsNoIndex(r) {
+		pagedata["__robots__"] = robotsMeta
+	}
+	if IsExport(r) {
+		pagedata["__export__"] = true
+	}
+	return pm.Render.Page(w, r, pagedata, src.Files()...)
+}
+
+// templateData returns the data a page is rendered with. It starts with the
+// page's args from theme.toml. A pm_kv entry whose key matches an arg
+// overrides that arg, converted to the type of the arg (so that a site owner
+// can write "true" to turn on a boolean arg). An entry that does not convert
+// is ignored and the arg keeps its theme.toml default, so that a bad value
+// cannot break every page that uses the arg. The args column of the page's
+// pm_routes entry, if any, is a TOML document whose keys override everything
+// else for that route only.
+func (pm *PageManager) templateData(src PageSource, route Route) (map[string]interface{}, error) {
+	data := make(map[string]interface{})
+	var keys []interface{}
+	for k, v := range src.Args {
+		data[k] = v
+		keys = append(keys, k)
+	}
+	if len(keys) > 0 {
+		query := "SELECT key, value FROM pm_kv WHERE value IS NOT NULL AND key IN (?" + strings.Repeat(", ?", len(keys)-1) + ")"
+		rows, err := pm.DB.Query(query, keys...)
+		if err != nil {
+			return nil, err
 		}
-		currentPath = parentPath
-		err := func() error {
-			f, err := fsys.Open(currentPath)
+		defer rows.Close()
+		for rows.Next() {
+			var key, value string
+			err = rows.Scan(&key, &value)
 			if err != nil {
-				return err
-			}
-			defer f.Close()
-			dir, ok := f.(interface {
-				Readdirnames(n int) (names []string, err error)
-			})
-			if !ok {
-				return fmt.Errorf("%s is not a directory", currentPath)
+				return nil, err
 			}
-			var names []string
-			for {
-				names, err = dir.Readdirnames(1)
-				if err != nil {
-					if errors.Is(err, io.EOF) {
-						return nil // no more files in current directory
-					}
-					return err
-				}
-				if names[0] == configFilename {
-					configFound = true
-					return nil
-				}
+			arg, err := convertArg(data[key], value)
+			if err != nil {
+				continue // keep the theme.toml default
 			}
-		}()
-		if err != nil {
-			return src, err
+			data[key] = arg
 		}
-		if configFound {
-			break
+		err = rows.Err()
+		if err != nil {
+			return nil, err
 		}
 	}
-	if configFound {
-		var configDir string
-		if currentPath != "." {
-			configDir = currentPath + string(os.PathSeparator)
-		}
-		var mainTree *toml.Tree
-		b, err := fs.ReadFile(fsys, configDir+configFilename)
+	if route.Args.Valid {
+		tree, err := toml.Load(route.Args.String)
 		if err != nil {
-			return src, err
+			return nil, fmt.Errorf("pm_routes args of %s: %w", route.URL.String, err)
 		}
-		mainTree, err = toml.LoadBytes(b)
+		for k, v := range tree.ToMap() {
+			data[k] = v
+		}
+	}
+	return data, nil
+}
+
+// convertArg converts value to the TOML type of arg. Values for non-string
+// args are parsed as TOML, e.g. "true", "3", "1979-05-27" or "[1, 2]".
+func convertArg(arg interface{}, value string) (interface{}, error) {
+	if _, ok := arg.(string); ok {
+		return value, nil
+	}
+	tree, err := toml.Load("v = " + value)
+	if err != nil {
+		return nil, fmt.Errorf("%q is not %s", value, tomlType(arg))
+	}
+	v := tree.Get("v")
+	if tomlType(v) != tomlType(arg) {
+		return nil, fmt.Errorf("%q is %s, not %s", value, tomlType(v), tomlType(arg))
+	}
+	return v, nil
+}
+
+// PageSource is a page and the files it is made up of, as described by its
+// entry in a theme.toml (see ThemeSchema).
+type PageSource struct {
+	Name         string
+	MainTemplate string
+	Include      []string
+	Args         map[string]interface{}
+	Sample       map[string]interface{}
+}
+
+// Files returns the files to be passed to renderly for the page.
+func (src PageSource) Files() []string {
+	var files []string
+	if src.MainTemplate != "" {
+		files = append(files, src.MainTemplate)
+	}
+	files = append(files, src.Name)
+	files = append(files, src.Include...)
+	return files
+}
+
+// resolve returns src with its paths made relative to the root of the theme's
+// fs.FS instead of the theme.toml.
+func (cfg ThemeConfig) resolve(src PageSource) PageSource {
+	dir := cfg.Dir()
+	src.Name = path.Join(dir, src.Name)
+	if src.MainTemplate != "" {
+		src.MainTemplate = path.Join(dir, src.MainTemplate)
+	}
+	include := make([]string, len(src.Include))
+	for i := range src.Include {
+		include[i] = path.Join(dir, src.Include[i])
+	}
+	src.Include = include
+	return src
+}
+
+func getPageSource(fsys fs.FS, filename string) (PageSource, error) {
+	src := PageSource{
+		Name: filename,
+	}
+	configFilename, err := findThemeConfig(fsys, filename)
+	if err != nil {
+		return src, err
+	}
+	if configFilename != "" {
+		cfg, err := LoadThemeConfig(fsys, configFilename)
 		if err != nil {
 			return src, err
 		}
-		key := strings.TrimPrefix(filename, configDir)
-		subTree, _ := mainTree.GetPath([]string{key}).(*toml.Tree)
-		if subTree != nil {
-			err = subTree.Unmarshal(&src)
-			if err != nil {
-				return src, err
-			}
-			if src.MainTemplate != "" {
-				src.MainTemplate = configDir + src.MainTemplate
-			}
-			for i := range src.Include {
-				src.Include[i] = configDir + src.Include[i]
-			}
-			return src, nil
+		key := filename
+		if dir := cfg.Dir(); dir != "." {
+			key = strings.TrimPrefix(filename, dir+"/")
+		}
+		if entry, ok := cfg.Pages[key]; ok {
+			return cfg.resolve(entry), nil
 		}
 	}
-	ext := filepath.Ext(filename)
+	ext := path.Ext(filename)
 	if ext == filename {
 		ext = ""
 	}
 	basename := strings.TrimSuffix(filename, ext)
 	for _, name := range []string{basename + ".css", basename + ".js", basename + ".md"} {
-		f, err := fsys.Open(name)
+		_, err := fs.Stat(fsys, name)
 		if err == nil {
-			f.Close()
 			src.Include = append(src.Include, name)
 		}
-		if err != nil && !errors.Is(err, os.ErrNotExist) {
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
 			return src, err
 		}
 	}
@@ -282,6 +420,7 @@ func (pm *PageManager) AddPlugins(constructors ...PluginConstructor) error {
 		if err != nil {
 			return err
 		}
+		pm.plugins = append(pm.plugins, plugin)
 	}
 	return nil
 }
@@ -330,44 +469,49 @@ func (pm *PageManager) KVPost(w http.ResponseWriter, r *http.Request) {
 	for _, keyValuePair := range kvdata.KeyValuePairs {
 		pm.cache.Set(keyValuePair.Key, keyValuePair.Value, 0)
 	}
-	http.Redirect(w, r, kvdata.RedirectTo, http.StatusMovedPermanently)
+	http.Redirect(w, r, localRedirect(kvdata.RedirectTo, "/pm-admin"), http.StatusMovedPermanently)
 }
 
+// contentSecurityPolicy is the site-wide Content-Security-Policy. Every
+// request gets its own copy of it on its context (see SecurityHeaders), which
+// renderly adds the hashes or nonces of inline assets to.
+var contentSecurityPolicy = renderly.ParseCSP(strings.Join([]string{
+	`script-src-elem
+		'self'
+		cdn.jsdelivr.net
+		stackpath.bootstrapcdn.com
+		cdn.datatables.net
+		unpkg.com
+		code.jquery.com
+	`,
+	`style-src-elem
+		'self'
+		cdn.jsdelivr.net
+		stackpath.bootstrapcdn.com
+		cdn.datatables.net
+		unpkg.com
+		fonts.googleapis.com
+	`,
+	`img-src
+		'self'
+		cdn.datatables.net
+		data:
+		source.unsplash.com
+		images.unsplash.com
+	`,
+	`font-src fonts.gstatic.com`,
+	"default-src 'self'",
+	"object-src 'self'",
+	"media-src 'self'",
+	"frame-ancestors 'self'",
+	"connect-src 'self'",
+}, ";"))
+
 func SecurityHeaders(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		securityPolicies := []string{
-			`script-src-elem
-				'self'
-				cdn.jsdelivr.net
-				stackpath.bootstrapcdn.com
-				cdn.datatables.net
-				unpkg.com
-				code.jquery.com
-			`,
-			`style-src-elem
-				'self'
-				cdn.jsdelivr.net
-				stackpath.bootstrapcdn.com
-				cdn.datatables.net
-				unpkg.com
-				fonts.googleapis.com
-			`,
-			`img-src
-				'self'
-				cdn.datatables.net
-				data:
-				source.unsplash.com
-				images.unsplash.com
-			`,
-			`font-src fonts.gstatic.com`,
-			"default-src 'self'",
-			"object-src 'self'",
-			"media-src 'self'",
-			"frame-ancestors 'self'",
-			"connect-src 'self'",
-		}
-		ContentSecurityPolicy := regexp.MustCompile(`\s+`).ReplaceAllString(strings.Join(securityPolicies, "; "), " ")
-		w.Header().Set("Content-Security-Policy", ContentSecurityPolicy)
+		csp := contentSecurityPolicy.Clone()
+		w.Header().Set("Content-Security-Policy", csp.String())
+		r = r.WithContext(renderly.ContextWithCSP(r.Context(), csp))
 		features := []string{
 			`microphone 'none'`,
 			`camera 'none'`,
@@ -384,3 +528,29 @@ func SecurityHeaders(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// ClientIP returns the IP address of the client that made the request. By
+// default it is the address of the connection, so behind a reverse proxy
+// every request comes from the proxy's address. If the PM_PROXY_HEADER
+// environment variable names a header that the proxy sets to the address of
+// the client, such as X-Real-IP or X-Forwarded-For, the address is taken from
+// that header instead: for X-Forwarded-For, which clients can send too, the
+// last address is the one the proxy added. Only set PM_PROXY_HEADER when the
+// site cannot be reached without going through the proxy, otherwise clients
+// can make up their address.
+func (pm *PageManager) ClientIP(r *http.Request) string {
+	if pm.proxyHeader != "" {
+		values := r.Header.Values(pm.proxyHeader)
+		if len(values) > 0 {
+			addrs := strings.Split(values[len(values)-1], ",")
+			if ip := net.ParseIP(strings.TrimSpace(addrs[len(addrs)-1])); ip != nil {
+				return ip.String()
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
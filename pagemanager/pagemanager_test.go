@@ -1,8 +1,19 @@
 package pagemanager
 
 import (
+	"archive/zip"
+	"database/sql"
+	"encoding/xml"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
 
 	"github.com/bokwoon95/weblog/pagemanager/renderly"
 	"github.com/davecgh/go-spew/spew"
@@ -16,3 +27,588 @@ func Test_Uh(t *testing.T) {
 	is.NoErr(err)
 	spew.Dump(src)
 }
+
+func Test_parseThemeConfig(t *testing.T) {
+	is := is.New(t)
+	cfg, err := LoadThemeConfig(os.DirFS(renderly.AbsDir("../themes")), "plainsimple/theme.toml")
+	is.NoErr(err)
+	is.Equal(cfg.Name, "plainsimple")
+	is.Equal(cfg.Pages["post.html"].Include, []string{"header.html", "tags.html", "comments.html", "style.css", "post.js"})
+	is.Equal(cfg.Pages["post.html"].Args, map[string]interface{}{"date_format": "Monday, January 2, 2006"})
+
+	for _, tt := range []struct {
+		config string
+		errmsg string
+	}{
+		{"name = \"x\"", `theme.toml: missing required key schema`},
+		{"schema = 2", `theme.toml:1:1: schema: unsupported schema version 2`},
+		{"schema = 1\nauthr = \"x\"", `theme.toml:2:1: authr: unknown key`},
+		{"schema = 1\n[\"post.html\"]\nhtml = \"post.html\"", `theme.toml:3:1: "post.html".html: unknown key`},
+		{"schema = 1\n[\"post.html\"]\ninclude = \"style.css\"", `"post.html".include: must be an array of strings, got a string`},
+		{"schema = 1\n[\"post.html\"]\ninclude = [1]", `"post.html".include: item 0 must be a string`},
+		{"schema = 1\n[[pages]]\nhtml = \"post.html\"", `pages: unknown key`},
+	} {
+		_, err := parseThemeConfig("theme.toml", []byte(tt.config))
+		is.True(err != nil)
+		is.True(strings.Contains(err.Error(), tt.errmsg)) // error cites the file and key
+	}
+}
+
+func Test_getPageSource(t *testing.T) {
+	is := is.New(t)
+	fsys := fstest.MapFS{
+		"mytheme/theme.toml":      {Data: []byte("schema = 1\n[\"blog/post.html\"]\nmain_template = \"base.html\"\ninclude = [\"style.css\"]\n")},
+		"mytheme/blog/about.html": {Data: []byte("")},
+		"mytheme/blog/about.css":  {Data: []byte("")},
+	}
+	src, err := getPageSource(fsys, "mytheme/blog/post.html")
+	is.NoErr(err)
+	is.Equal(src.Files(), []string{"mytheme/base.html", "mytheme/blog/post.html", "mytheme/style.css"})
+	src, err = getPageSource(fsys, "mytheme/blog/about.html")
+	is.NoErr(err)
+	is.Equal(src.Files(), []string{"mytheme/blog/about.html", "mytheme/blog/about.css"})
+}
+
+func Test_LintTheme(t *testing.T) {
+	is := is.New(t)
+	is.Equal(LintTheme(os.DirFS(renderly.AbsDir("../themes")), "plainsimple"), nil)
+	fsys := fstest.MapFS{
+		"bad/theme.toml": {Data: []byte(`schema = 1
+["missing.html"]
+include = ["nope.css"]
+["broken.html"]
+["render.html"]
+["render.html".sample]
+items = 1
+`)},
+		"bad/broken.html": {Data: []byte(`{{ template "nowhere" }}`)},
+		"bad/render.html": {Data: []byte(`{{ .items.name }}`)},
+	}
+	errs := LintTheme(fsys, "bad")
+	is.Equal(len(errs), 4)
+	is.True(strings.Contains(errs[0].Error(), `"nowhere"`))
+	is.True(strings.Contains(errs[1].Error(), "bad/missing.html"))
+	is.True(strings.Contains(errs[2].Error(), "bad/nope.css"))
+	is.True(strings.Contains(errs[3].Error(), "can't evaluate field name"))
+}
+
+func Test_templateData(t *testing.T) {
+	is := is.New(t)
+	pm, err := New("sqlite3", ":memory:")
+	is.NoErr(err)
+	defer pm.DB.Close()
+	pm.DB.SetMaxOpenConns(1) // every connection to :memory: is a new database
+	_, err = pm.DB.Exec("INSERT INTO pm_kv (key, value) VALUES ('summary', 'false'), ('limit', '20'), ('unrelated', 'x')")
+	is.NoErr(err)
+	cfg, err := parseThemeConfig("theme.toml", []byte(`schema = 1
+["post.html".args]
+summary = true
+limit = 10
+title = "Posts"
+since = 2020-01-02T00:00:00Z
+tags = ["go", "sql"]
+`))
+	is.NoErr(err)
+	src := cfg.Pages["post.html"]
+
+	data, err := pm.templateData(src, Route{})
+	is.NoErr(err)
+	is.Equal(data["summary"], false)   // pm_kv overrides theme args
+	is.Equal(data["limit"], int64(20)) // converted to the type of the arg
+	is.Equal(data["title"], "Posts")   // types from TOML are preserved
+	is.Equal(data["tags"], []interface{}{"go", "sql"})
+	is.Equal(data["since"], time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC))
+	is.Equal(data["unrelated"], nil) // only keys declared as args are read from pm_kv
+
+	route := Route{URL: sql.NullString{String: "/posts", Valid: true}, Args: sql.NullString{String: "summary = true\nextra = 1", Valid: true}}
+	data, err = pm.templateData(src, route)
+	is.NoErr(err)
+	is.Equal(data["summary"], true) // route args override pm_kv
+	is.Equal(data["extra"], int64(1))
+
+	_, err = pm.DB.Exec("UPDATE pm_kv SET value = 'lots' WHERE key = 'limit'")
+	is.NoErr(err)
+	data, err = pm.templateData(src, Route{})
+	is.NoErr(err)
+	is.Equal(data["limit"], int64(10)) // "lots" is not an integer, the theme.toml default is kept
+
+	// only admins may write pm_kv
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/pm-kv", strings.NewReader(`{"key_value_pairs": [{"key": "summary", "value": "true"}], "redirect_to": "/"}`))
+	r.Header.Set("Content-Type", "application/json")
+	pm.Router.ServeHTTP(w, r)
+	is.Equal(w.Code, http.StatusUnauthorized)
+	data, err = pm.templateData(src, Route{})
+	is.NoErr(err)
+	is.Equal(data["summary"], false)
+}
+
+// baselineSchema is the pagemanager part of the original init.sql.
+const baselineSchema = `
+CREATE TABLE pm_routes (
+    url TEXT NOT NULL PRIMARY KEY
+    ,disabled BOOLEAN
+    ,redirect_url TEXT
+    ,handler_url TEXT
+    ,content TEXT
+    ,template TEXT
+);
+CREATE TABLE pm_templatedata (
+    pageid TEXT NOT NULL
+    ,name TEXT NOT NULL
+    ,value TEXT
+    ,UNIQUE(pageid, name)
+);
+INSERT INTO pm_routes (url, content) VALUES ('/about', 'about');
+`
+
+func Test_migrate(t *testing.T) {
+	is := is.New(t)
+	dataSourceName := filepath.Join(t.TempDir(), "database.sqlite3")
+	db, err := sql.Open("sqlite3", dataSourceName)
+	is.NoErr(err)
+	_, err = db.Exec(baselineSchema)
+	is.NoErr(err)
+	is.NoErr(db.Close())
+
+	pm, err := New("sqlite3", dataSourceName)
+	is.NoErr(err)
+	var version int
+	is.NoErr(pm.DB.QueryRow("PRAGMA user_version").Scan(&version))
+	names, err := fs.Glob(migrations, "migrations/*.sql")
+	is.NoErr(err)
+	is.Equal(version, len(names))
+	var content string
+	var args sql.NullString
+	is.NoErr(pm.DB.QueryRow("SELECT content, args FROM pm_routes WHERE url = '/about'").Scan(&content, &args))
+	is.Equal(content, "about") // the rows are kept
+	w := httptest.NewRecorder()
+	pm.Router.ServeHTTP(w, httptest.NewRequest("GET", "/sitemap.xml", nil))
+	is.Equal(w.Code, http.StatusOK) // pm_routes has every column
+	is.True(strings.Contains(w.Body.String(), "<loc>http://example.com/about</loc>"))
+	_, err = pm.DB.Exec("INSERT INTO pm_kv (key, value) VALUES ('title', 'Hello')")
+	is.NoErr(err)
+	is.NoErr(pm.DB.Close())
+
+	pm, err = New("sqlite3", dataSourceName) // migrations only run once
+	is.NoErr(err)
+	defer pm.DB.Close()
+	var count int
+	is.NoErr(pm.DB.QueryRow("SELECT COUNT(*) FROM pm_kv").Scan(&count))
+	is.Equal(count, 1)
+}
+
+func writeZip(t *testing.T, filename string, files map[string]string) {
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, content)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_InstallTheme(t *testing.T) {
+	is := is.New(t)
+	dir := t.TempDir()
+	themesDir := filepath.Join(dir, "themes")
+	is.NoErr(os.Mkdir(themesDir, 0755))
+
+	archive := filepath.Join(dir, "fancy-1.0.zip")
+	writeZip(t, archive, map[string]string{
+		"fancy/theme.toml": "schema = 1\nname = \"fancy\"\nscreenshot = \"shot.png\"\n[\"index.html\"]\ninclude = [\"style.css\"]\n",
+		"fancy/index.html": "<p>{{ .__css__ }}</p>",
+		"fancy/style.css":  "p { color: red; }",
+	})
+	cfg, err := InstallTheme(themesDir, archive)
+	is.NoErr(err)
+	is.Equal(cfg.Dir(), "fancy")
+	themes, err := ListThemes(os.DirFS(themesDir))
+	is.NoErr(err)
+	is.Equal(len(themes), 1)
+	is.Equal(themes[0].Screenshot, "shot.png")
+	_, err = InstallTheme(themesDir, archive)
+	is.True(err != nil) // already installed
+
+	evil := filepath.Join(dir, "evil.zip")
+	writeZip(t, evil, map[string]string{
+		"theme.toml":     "schema = 1\n",
+		"../escaped.txt": "gotcha",
+	})
+	_, err = InstallTheme(themesDir, evil)
+	is.True(err != nil)
+	_, err = os.Stat(filepath.Join(dir, "escaped.txt"))
+	is.True(os.IsNotExist(err)) // nothing was written outside the themes directory
+
+	broken := filepath.Join(dir, "broken.zip")
+	writeZip(t, broken, map[string]string{
+		"theme.toml": "schema = 1\n[\"index.html\"]\n",
+		"index.html": `{{ template "nowhere" }}`,
+	})
+	_, err = InstallTheme(themesDir, broken)
+	is.True(err != nil) // themes are linted before they are installed
+	entries, err := os.ReadDir(themesDir)
+	is.NoErr(err)
+	is.Equal(len(entries), 1) // no leftovers
+}
+
+func Test_Theme(t *testing.T) {
+	is := is.New(t)
+	db, err := sql.Open("sqlite3", ":memory:")
+	is.NoErr(err)
+	defer db.Close()
+	db.SetMaxOpenConns(1) // every connection to :memory: is a new database
+	pm := &PageManager{
+		DB:            db,
+		Themes:        os.DirFS(renderly.AbsDir("../themes")),
+		adminUser:     "admin",
+		adminPassword: "hunter2",
+	}
+	is.NoErr(pm.migrate())
+	r := httptest.NewRequest("GET", "/", nil)
+	theme, err := pm.Theme(r, "blog")
+	is.NoErr(err)
+	is.Equal(theme, "") // no theme activated
+
+	is.NoErr(pm.SetTheme(SiteScope, "plainsimple"))
+	is.True(pm.SetTheme("blog", "nonexistent") != nil)
+	theme, err = pm.Theme(r, "blog")
+	is.NoErr(err)
+	is.Equal(theme, "plainsimple") // falls back to the site's theme
+
+	_, err = db.Exec("INSERT INTO pm_themes (scope, theme) VALUES ('blog', 'other')")
+	is.NoErr(err)
+	theme, err = pm.Theme(r, "blog")
+	is.NoErr(err)
+	is.Equal(theme, "other")
+
+	r = httptest.NewRequest("GET", "/?theme=preview", nil)
+	theme, err = pm.Theme(r, "blog")
+	is.NoErr(err)
+	is.Equal(theme, "other") // only admins may preview
+	r.SetBasicAuth("admin", "hunter2")
+	theme, err = pm.Theme(r, "blog")
+	is.NoErr(err)
+	is.Equal(theme, "preview")
+
+	activate := func(body string, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/pm-admin/themes/activate", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		for k := range header {
+			r.Header.Set(k, header.Get(k))
+		}
+		r.SetBasicAuth("admin", "hunter2")
+		w := httptest.NewRecorder()
+		pm.RequireAdmin(SameOrigin(http.HandlerFunc(pm.ThemeActivatePost))).ServeHTTP(w, r)
+		return w
+	}
+	body := `{"scope": "blog", "theme": "plainsimple", "redirect_to": "//evil.example.com"}`
+	is.Equal(activate(body, http.Header{"Origin": {"https://evil.example.com"}}).Code, http.StatusForbidden)
+	is.Equal(activate(body, http.Header{"Sec-Fetch-Site": {"cross-site"}}).Code, http.StatusForbidden)
+	is.Equal(activate(body, http.Header{"Referer": {"https://evil.example.com/page"}}).Code, http.StatusForbidden)
+	theme, err = pm.Theme(httptest.NewRequest("GET", "/", nil), "blog")
+	is.NoErr(err)
+	is.Equal(theme, "other") // not activated
+	w := activate(body, http.Header{"Origin": {"http://example.com"}})
+	is.Equal(w.Code, http.StatusSeeOther)
+	is.Equal(w.Header().Get("Location"), "/pm-admin/themes") // not an open redirect
+	w = activate(`{"scope": "blog", "theme": "plainsimple", "redirect_to": "/blog"}`, http.Header{"Sec-Fetch-Site": {"same-origin"}})
+	is.Equal(w.Code, http.StatusSeeOther)
+	is.Equal(w.Header().Get("Location"), "/blog")
+	theme, err = pm.Theme(httptest.NewRequest("GET", "/", nil), "blog")
+	is.NoErr(err)
+	is.Equal(theme, "plainsimple")
+}
+
+type sitemapPlugin []SitemapURL
+
+func (p sitemapPlugin) AddRoutes() error { return nil }
+
+func (p sitemapPlugin) SitemapURLs() ([]SitemapURL, error) { return p, nil }
+
+func Test_ClientIP(t *testing.T) {
+	is := is.New(t)
+	pm, err := New("sqlite3", ":memory:")
+	is.NoErr(err)
+	defer pm.DB.Close()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	is.Equal(pm.ClientIP(r), "192.0.2.1") // the header is not trusted by default
+
+	os.Setenv("PM_PROXY_HEADER", "X-Forwarded-For")
+	pm, err = New("sqlite3", ":memory:")
+	os.Unsetenv("PM_PROXY_HEADER")
+	is.NoErr(err)
+	defer pm.DB.Close()
+	is.Equal(pm.ClientIP(r), "198.51.100.1")
+	r.Header.Set("X-Forwarded-For", "203.0.113.9, 198.51.100.1")
+	is.Equal(pm.ClientIP(r), "198.51.100.1") // the address added by the proxy
+	r.Header.Set("X-Forwarded-For", "nonsense")
+	is.Equal(pm.ClientIP(r), "192.0.2.1")
+	r.Header.Del("X-Forwarded-For")
+	is.Equal(pm.ClientIP(r), "192.0.2.1")
+}
+
+func Test_Sitemap(t *testing.T) {
+	is := is.New(t)
+	os.Setenv("PM_ADMIN_USER", "admin")
+	os.Setenv("PM_ADMIN_PASSWORD", "hunter2")
+	pm, err := New("sqlite3", ":memory:")
+	os.Unsetenv("PM_ADMIN_USER")
+	os.Unsetenv("PM_ADMIN_PASSWORD")
+	is.NoErr(err)
+	defer pm.DB.Close()
+	pm.DB.SetMaxOpenConns(1) // every connection to :memory: is a new database
+	_, err = pm.DB.Exec(`
+INSERT INTO pm_routes (url, content) VALUES ('/about', 'about');
+INSERT INTO pm_routes (url, content, disabled) VALUES ('/disabled', 'disabled', TRUE);
+INSERT INTO pm_routes (url, redirect_url) VALUES ('/moved', '/about');
+INSERT INTO pm_routes (url, content, noindex) VALUES ('/private', 'private', TRUE);
+INSERT INTO pm_routes (url, noindex) VALUES ('/plugin/hidden', TRUE);
+`)
+	is.NoErr(err)
+	lastmod := time.Date(2020, 6, 18, 0, 0, 0, 0, time.UTC)
+	is.NoErr(pm.AddPlugins(func(*PageManager) (Plugin, error) {
+		return sitemapPlugin{{Path: "/plugin", LastMod: lastmod}, {Path: "/plugin/hidden"}, {Path: "/moved"}}, nil
+	}))
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		pm.Router.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		return w
+	}
+
+	urls, err := pm.SitemapURLs()
+	is.NoErr(err)
+	is.Equal(urls, []SitemapURL{{Path: "/about"}, {Path: "/plugin", LastMod: lastmod}})
+	w := get("/sitemap.xml")
+	is.Equal(w.Header().Get("Content-Type"), "application/xml; charset=utf-8")
+	var urlset sitemapURLSet
+	is.NoErr(xml.Unmarshal(w.Body.Bytes(), &urlset))
+	is.Equal(urlset.URLs, []sitemapElement{
+		{Loc: "http://example.com/about"},
+		{Loc: "http://example.com/plugin", LastMod: "2020-06-18T00:00:00Z"},
+	})
+
+	sitemapSize = 1
+	defer func() { sitemapSize = 50000 }()
+	var index sitemapIndex
+	is.NoErr(xml.Unmarshal(get("/sitemap.xml").Body.Bytes(), &index))
+	is.Equal(index.Sitemaps, []sitemapElement{
+		{Loc: "http://example.com/sitemap-1.xml"},
+		{Loc: "http://example.com/sitemap-2.xml", LastMod: "2020-06-18T00:00:00Z"},
+	})
+	urlset = sitemapURLSet{}
+	is.NoErr(xml.Unmarshal(get("/sitemap-2.xml").Body.Bytes(), &urlset))
+	is.Equal(urlset.URLs, []sitemapElement{{Loc: "http://example.com/plugin", LastMod: "2020-06-18T00:00:00Z"}})
+	is.Equal(get("/sitemap-3.xml").Code, http.StatusNotFound)
+
+	w = get("/private")
+	is.Equal(w.Body.String(), "private")
+	is.Equal(w.Header().Get("X-Robots-Tag"), "noindex")
+	is.Equal(get("/about").Header().Get("X-Robots-Tag"), "")
+
+	is.Equal(get("/robots.txt").Body.String(), defaultRobots+"\nSitemap: http://example.com/sitemap.xml\n")
+	r := httptest.NewRequest("POST", "/pm-admin/robots.txt", strings.NewReader(`{"robots_txt": "User-agent: *\r\nDisallow: /"}`))
+	r.Header.Set("Content-Type", "application/json")
+	r.SetBasicAuth("admin", "hunter2")
+	w = httptest.NewRecorder()
+	pm.Router.ServeHTTP(w, r)
+	is.Equal(w.Code, http.StatusSeeOther)
+	is.Equal(w.Header().Get("Location"), "/pm-admin/robots.txt")
+	is.Equal(get("/robots.txt").Body.String(), "User-agent: *\nDisallow: /\n\nSitemap: http://example.com/sitemap.xml\n")
+	r = httptest.NewRequest("POST", "/pm-admin/robots.txt", strings.NewReader(`{"robots_txt": "", "redirect_to": "https://evil.example.com"}`))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Sec-Fetch-Site", "cross-site")
+	r.SetBasicAuth("admin", "hunter2")
+	w = httptest.NewRecorder()
+	pm.Router.ServeHTTP(w, r)
+	is.Equal(w.Code, http.StatusForbidden) // other sites cannot post it
+	r = httptest.NewRequest("POST", "/pm-admin/robots.txt", strings.NewReader(`{"robots_txt": "User-agent: *\r\nDisallow: /", "redirect_to": "//evil.example.com"}`))
+	r.Header.Set("Content-Type", "application/json")
+	r.SetBasicAuth("admin", "hunter2")
+	w = httptest.NewRecorder()
+	pm.Router.ServeHTTP(w, r)
+	is.Equal(w.Header().Get("Location"), "/pm-admin/robots.txt") // redirects stay on this site
+	r = httptest.NewRequest("POST", "/pm-kv", strings.NewReader(`{"key_value_pairs": [{"key": "robots.txt", "value": "User-agent: *\nAllow: /"}]}`))
+	r.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	pm.Router.ServeHTTP(w, r)
+	is.Equal(w.Code, http.StatusUnauthorized) // only the admin can change the robots.txt
+	is.Equal(get("/robots.txt").Body.String(), "User-agent: *\nDisallow: /\n\nSitemap: http://example.com/sitemap.xml\n")
+	_, err = pm.DB.Exec("UPDATE pm_kv SET value = 'Sitemap: https://cdn.example.com/sitemap.xml' WHERE key = 'robots.txt'")
+	is.NoErr(err)
+	is.Equal(get("/robots.txt").Body.String(), "Sitemap: https://cdn.example.com/sitemap.xml") // already has one
+}
+
+type exportPlugin struct{ pm *PageManager }
+
+func (p exportPlugin) AddRoutes() error {
+	p.pm.Router.Get("/plugin", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, `<img src="plugin/logo.png"><a href="#top">top</a><a href='/plugin?page=2'>next</a>`+
+			`<a href="https://other.example.com/">elsewhere</a><a href="http://example.com/missing">missing</a>`+
+			`<a href="/plugin/search/advanced">search</a>`)
+		if !IsExport(r) {
+			io.WriteString(w, `<form method="post"></form>`)
+		}
+	})
+	p.pm.Router.Get("/plugin/search/*", func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "results") })
+	p.pm.Router.Get("/plugin/logo.png", func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "\x89PNG") })
+	p.pm.Router.Get("/plugin/feed.xml", func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, BaseURL(r)) })
+	return nil
+}
+
+func (p exportPlugin) SitemapURLs() ([]SitemapURL, error) {
+	return []SitemapURL{{Path: "/plugin"}}, nil
+}
+
+func (p exportPlugin) ExportURLs() ([]string, error) { return []string{"/plugin/feed.xml"}, nil }
+
+func (p exportPlugin) DynamicURLs() []string { return []string{"/plugin/search/"} }
+
+func Test_Export(t *testing.T) {
+	is := is.New(t)
+	pm, err := New("sqlite3", ":memory:")
+	is.NoErr(err)
+	defer pm.DB.Close()
+	pm.DB.SetMaxOpenConns(1) // every connection to :memory: is a new database
+	_, err = pm.DB.Exec(`
+INSERT INTO pm_routes (url, content) VALUES ('/about/me', '<p>about</p>');
+INSERT INTO pm_routes (url, content, disabled) VALUES ('/disabled', 'disabled', TRUE);
+INSERT INTO pm_routes (url, redirect_url) VALUES ('/moved', '/about/me');
+`)
+	is.NoErr(err)
+	is.NoErr(pm.AddPlugins(func(pm *PageManager) (Plugin, error) { return exportPlugin{pm: pm}, nil }))
+	dir := t.TempDir()
+	read := func(name string) string {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		is.NoErr(err)
+		return string(b)
+	}
+
+	report, err := pm.Export(dir, ExportOptions{BaseURL: "https://example.com/"})
+	is.NoErr(err)
+	is.Equal(report.Files, []string{
+		"about/me/index.html",
+		"moved/index.html",
+		"plugin/feed.xml",
+		"plugin/index.html",
+		"plugin/logo.png",
+		"robots.txt",
+		"sitemap.xml",
+	})
+	is.Equal(report.Skipped, []ExportError{
+		{URL: "/missing", Referrer: "/plugin", Reason: "404 Not Found"},
+		{URL: "/plugin/search/advanced", Referrer: "/plugin", Reason: "a static site cannot serve dynamic pages"},
+		{URL: "/plugin?page=2", Referrer: "/plugin", Reason: "a static site cannot serve URLs with a query string"},
+	})
+	is.Equal(read("about/me/index.html"), "<p>about</p>")
+	is.True(!strings.Contains(read("plugin/index.html"), "<form")) // rendered for a static site
+	is.True(strings.Contains(read("moved/index.html"), `<meta http-equiv="refresh" content="0; url=/about/me">`))
+	is.Equal(read("plugin/feed.xml"), "https://example.com") // rendered for the base URL
+	is.True(strings.Contains(read("robots.txt"), "Sitemap: https://example.com/sitemap.xml"))
+	sitemap := read("sitemap.xml")
+	again, err := pm.Export(dir, ExportOptions{BaseURL: "https://example.com"})
+	is.NoErr(err)
+	is.Equal(again, report)
+	is.Equal(read("sitemap.xml"), sitemap) // the same every time
+
+	_, err = pm.DB.Exec("DELETE FROM pm_routes WHERE url = '/about/me'")
+	is.NoErr(err)
+	report, err = pm.Export(dir, ExportOptions{BaseURL: "https://example.com", RedirectsFile: true})
+	is.NoErr(err)
+	is.Equal(report.Files, []string{"_redirects", "plugin/feed.xml", "plugin/index.html", "plugin/logo.png", "robots.txt", "sitemap.xml"})
+	is.Equal(read("_redirects"), "/moved /about/me 301\n")
+	_, err = os.Stat(filepath.Join(dir, "about"))
+	is.True(os.IsNotExist(err)) // files of the previous export are removed
+	is.Equal(read(exportManifest), strings.Join(report.Files, "\n")+"\n")
+
+	_, err = pm.Export(dir, ExportOptions{BaseURL: "example.com"})
+	is.True(err != nil) // no scheme
+}
+
+func Test_SyncPages(t *testing.T) {
+	is := is.New(t)
+	pm, err := New("sqlite3", ":memory:")
+	is.NoErr(err)
+	defer pm.DB.Close()
+	pm.DB.SetMaxOpenConns(1) // every connection to :memory: is a new database
+	_, err = pm.DB.Exec(`
+INSERT INTO pm_routes (url, content) VALUES ('/contact', 'contact');
+`)
+	is.NoErr(err)
+	fsys := fstest.MapFS{
+		"index.html":       {Data: []byte("<p>home</p>")},
+		"about.md":         {Data: []byte("+++\ntitle = \"About me\"\nnoindex = true\n+++\n# Hi\n")},
+		"docs/index.md":    {Data: []byte("---\nurl: /documentation\ntemplate: \"\"\n---\nDocs <script>alert(1)</script>\n")},
+		"docs/notes.txt":   {Data: []byte("not a page")},
+		".git/config.html": {Data: []byte("hidden")},
+	}
+	opts := SyncOptions{Template: "plainsimple/page.html", DryRun: true}
+	changes, err := pm.SyncPages(fsys, opts)
+	is.NoErr(err)
+	is.Equal(changes, []SyncChange{
+		{Action: "create", URL: "/", Source: "index.html"},
+		{Action: "create", URL: "/about", Source: "about.md"},
+		{Action: "create", URL: "/documentation", Source: "docs/index.md"},
+	})
+	var count int
+	is.NoErr(pm.DB.QueryRow("SELECT COUNT(*) FROM pm_routes").Scan(&count))
+	is.Equal(count, 1) // nothing synced in a dry run
+
+	opts.DryRun = false
+	_, err = pm.SyncPages(fsys, opts)
+	is.NoErr(err)
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		pm.Router.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		return w
+	}
+	is.Equal(get("/").Body.String(), "<p>home</p>")
+	body := get("/about").Body.String()
+	is.True(strings.Contains(body, "<title>About me</title>")) // rendered with the template and front matter
+	is.True(strings.Contains(body, "<h1>Hi</h1>"))             // the markdown as __content__
+	is.True(strings.Contains(body, `<meta name="robots" content="noindex">`))
+	is.Equal(get("/documentation").Body.String(), "<p>Docs alert(1)</p>\n") // sanitized, without a template
+	changes, err = pm.SyncPages(fsys, opts)
+	is.NoErr(err)
+	is.Equal(len(changes), 0) // already in sync
+
+	fsys["about.md"] = &fstest.MapFile{Data: []byte("+++\ntitle = \"About us\"\nnoindex = true\n+++\n# Hi\n")}
+	delete(fsys, "index.html")
+	changes, err = pm.SyncPages(fsys, opts)
+	is.NoErr(err)
+	is.Equal(changes, []SyncChange{
+		{Action: "disable", URL: "/", Source: "index.html"},
+		{Action: "update", URL: "/about", Source: "about.md", Fields: []string{"args"}},
+	})
+	is.Equal(get("/").Code, http.StatusNotFound)
+	is.True(strings.Contains(get("/about").Body.String(), "<title>About us</title>"))
+	fsys["index.md"] = &fstest.MapFile{Data: []byte("home")}
+	changes, err = pm.SyncPages(fsys, opts)
+	is.NoErr(err)
+	is.Equal(changes, []SyncChange{{Action: "update", URL: "/", Source: "index.md", Fields: []string{"disabled", "content", "template", "source"}}})
+
+	for _, tt := range []struct {
+		name, data, errmsg string
+	}{
+		{"contact.html", "", "contact.html: /contact is already in pm_routes and was not synced from a file"},
+		{"home.md", "+++\nurl = \"/\"\n+++\n", "index.md: / is also the URL of home.md"},
+		{"bad.md", "+++\nurl = \"bad\"\n+++\n", "bad.md: url: must be a string starting with /, got bad"},
+	} {
+		fsys := fstest.MapFS{"index.md": {Data: []byte("home")}, tt.name: {Data: []byte(tt.data)}}
+		_, err = pm.SyncPages(fsys, opts)
+		is.True(err != nil)
+		is.Equal(err.Error(), tt.errmsg)
+	}
+}
@@ -0,0 +1,346 @@
+package renderly
+
+import (
+	"fmt"
+	"html/template"
+	"strconv"
+	"strings"
+	"text/template/parse"
+
+	"github.com/oxtoacart/bpool"
+)
+
+// A component is any template that is invoked with the component function
+// instead of a {{ template }} action:
+//
+//	{{ component "card.html" "title" .Title "author.name" .Author.Name }}
+//
+// Arguments are passed in as name/value pairs. Names may be dotted, in which
+// case the value is nested inside maps (the card template above would access
+// the author's name with {{ .author.name }}). The component is executed with
+// only its arguments as data, and its output is inserted into the caller.
+//
+// A component may declare the parameters it accepts with params, which must
+// appear at the top level of the component template:
+//
+//	{{ params "title!" "subtitle" "size=medium" "count:int=3" "author.name:string!" }}
+//
+// Each parameter has the form name[:type][!][=default]. A trailing ! marks a
+// parameter as required. The type is one of string, int, float, bool, html or
+// any (the default). If a component declares its parameters, Lookup fails if
+// any call to it with constant arguments is missing a required parameter,
+// passes an unknown parameter or passes a constant of the wrong type.
+// Parameters that cannot be checked at Lookup time are checked at render time.
+
+// fnParams is a no-op at render time. Parameter declarations are read from the
+// template's parse tree by Lookup.
+func fnParams(params ...string) string {
+	return ""
+}
+
+// fnComponent is a placeholder that is replaced with a working implementation
+// for every page returned by Lookup.
+func fnComponent(name string, args ...interface{}) (template.HTML, error) {
+	return "", fmt.Errorf(`component "%s" was called outside of a renderly page`, name)
+}
+
+type param struct {
+	name     string
+	typ      string
+	required bool
+	def      interface{}
+	hasdef   bool
+}
+
+type componentSpec struct {
+	template string
+	params   []param
+}
+
+func parseParam(s string) (param, error) {
+	var p param
+	if i := strings.IndexByte(s, '='); i >= 0 {
+		s, p.def, p.hasdef = s[:i], s[i+1:], true
+	}
+	if strings.HasSuffix(s, "!") {
+		s, p.required = s[:len(s)-1], true
+	}
+	p.typ = "any"
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		s, p.typ = s[:i], s[i+1:]
+	}
+	p.name = s
+	if p.name == "" {
+		return p, fmt.Errorf("parameter has no name")
+	}
+	switch p.typ {
+	case "any", "string", "int", "float", "bool", "html":
+	default:
+		return p, fmt.Errorf(`parameter "%s" has an unknown type "%s"`, p.name, p.typ)
+	}
+	if p.hasdef {
+		def, err := convertParam(p, p.def.(string), true)
+		if err != nil {
+			return p, err
+		}
+		p.def = def
+	}
+	return p, nil
+}
+
+// convertParam checks that value is of the type declared by p, converting
+// default values (which are always strings) to the declared type.
+func convertParam(p param, value interface{}, isDefault bool) (interface{}, error) {
+	str, isString := value.(string)
+	switch p.typ {
+	case "string":
+		if !isString {
+			return nil, fmt.Errorf(`parameter "%s" must be a string, got %T`, p.name, value)
+		}
+	case "int":
+		switch v := value.(type) {
+		case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+			return v, nil
+		}
+		if isDefault && isString {
+			return strconv.Atoi(str)
+		}
+		return nil, fmt.Errorf(`parameter "%s" must be an int, got %T`, p.name, value)
+	case "float":
+		switch v := value.(type) {
+		case float32, float64, int, int64:
+			return v, nil
+		}
+		if isDefault && isString {
+			return strconv.ParseFloat(str, 64)
+		}
+		return nil, fmt.Errorf(`parameter "%s" must be a float, got %T`, p.name, value)
+	case "bool":
+		if v, ok := value.(bool); ok {
+			return v, nil
+		}
+		if isDefault && isString {
+			return strconv.ParseBool(str)
+		}
+		return nil, fmt.Errorf(`parameter "%s" must be a bool, got %T`, p.name, value)
+	case "html":
+		if v, ok := value.(template.HTML); ok {
+			return v, nil
+		}
+		if isString {
+			// Defaults are written by the template author and can be
+			// trusted, anything else must be escaped
+			if isDefault {
+				return template.HTML(str), nil
+			}
+			return template.HTML(template.HTMLEscapeString(str)), nil
+		}
+		return nil, fmt.Errorf(`parameter "%s" must be html, got %T`, p.name, value)
+	}
+	return value, nil
+}
+
+// paramsOf returns the parameters declared by the template t, or nil if t does
+// not declare any.
+func paramsOf(t *template.Template) ([]param, error) {
+	if t.Tree == nil || t.Tree.Root == nil {
+		return nil, nil
+	}
+	var params []param
+	for _, node := range t.Tree.Root.Nodes {
+		action, ok := node.(*parse.ActionNode)
+		if !ok || action.Pipe == nil || len(action.Pipe.Cmds) != 1 {
+			continue
+		}
+		args := action.Pipe.Cmds[0].Args
+		if ident, ok := args[0].(*parse.IdentifierNode); !ok || ident.Ident != "params" {
+			continue
+		}
+		for _, arg := range args[1:] {
+			str, ok := arg.(*parse.StringNode)
+			if !ok {
+				return nil, fmt.Errorf("%s: params only accepts string constants", t.Name())
+			}
+			p, err := parseParam(str.Text)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", t.Name(), err)
+			}
+			params = append(params, p)
+		}
+	}
+	return params, nil
+}
+
+// bind turns the name/value pairs passed to a component into the component's
+// data, applying defaults and checking parameters if the component declares
+// any.
+func (spec *componentSpec) bind(args []interface{}) (map[string]interface{}, error) {
+	if len(args)%2 != 0 {
+		return nil, fmt.Errorf(`component "%s": arguments must be name/value pairs`, spec.template)
+	}
+	data := make(map[string]interface{})
+	passed := make(map[string]interface{})
+	for i := 0; i < len(args); i += 2 {
+		name, ok := args[i].(string)
+		if !ok {
+			return nil, fmt.Errorf(`component "%s": argument name must be a string, got %T`, spec.template, args[i])
+		}
+		passed[name] = args[i+1]
+	}
+	if spec.params == nil {
+		for name, value := range passed {
+			setPath(data, strings.Split(name, "."), value)
+		}
+		return data, nil
+	}
+	declared := make(map[string]struct{})
+	for _, p := range spec.params {
+		declared[p.name] = struct{}{}
+		value, ok := passed[p.name]
+		if !ok {
+			if p.required {
+				return nil, fmt.Errorf(`component "%s": missing required parameter "%s"`, spec.template, p.name)
+			}
+			if p.hasdef {
+				setPath(data, strings.Split(p.name, "."), p.def)
+			}
+			continue
+		}
+		value, err := convertParam(p, value, false)
+		if err != nil {
+			return nil, fmt.Errorf(`component "%s": %w`, spec.template, err)
+		}
+		setPath(data, strings.Split(p.name, "."), value)
+	}
+	for name := range passed {
+		if _, ok := declared[name]; !ok {
+			return nil, fmt.Errorf(`component "%s": unknown parameter "%s"`, spec.template, name)
+		}
+	}
+	return data, nil
+}
+
+// setPath sets the value at the path inside m, creating intermediate maps as
+// necessary.
+func setPath(m map[string]interface{}, path []string, value interface{}) {
+	for _, key := range path[:len(path)-1] {
+		next, ok := m[key].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			m[key] = next
+		}
+		m = next
+	}
+	m[path[len(path)-1]] = value
+}
+
+// checkCall checks a call to a component at Lookup time, as far as possible
+// with the constant arguments of the call.
+func (spec *componentSpec) checkCall(cmd *parse.CommandNode) error {
+	if spec.params == nil {
+		return nil
+	}
+	args := cmd.Args[2:]
+	if len(args)%2 != 0 {
+		return fmt.Errorf(`component "%s": arguments must be name/value pairs`, spec.template)
+	}
+	passed := make(map[string]parse.Node)
+	for i := 0; i < len(args); i += 2 {
+		name, ok := args[i].(*parse.StringNode)
+		if !ok {
+			return nil // dynamic parameter names can only be checked at render time
+		}
+		passed[name.Text] = args[i+1]
+	}
+	declared := make(map[string]struct{})
+	for _, p := range spec.params {
+		declared[p.name] = struct{}{}
+		node, ok := passed[p.name]
+		if !ok {
+			if p.required {
+				return fmt.Errorf(`component "%s": missing required parameter "%s"`, spec.template, p.name)
+			}
+			continue
+		}
+		var value interface{}
+		switch node := node.(type) {
+		case *parse.StringNode:
+			value = node.Text
+		case *parse.BoolNode:
+			value = node.True
+		case *parse.NumberNode:
+			if node.IsInt {
+				value = int(node.Int64)
+			} else if node.IsFloat {
+				value = node.Float64
+			}
+		}
+		if value == nil {
+			continue // not a constant
+		}
+		_, err := convertParam(p, value, false)
+		if err != nil {
+			return fmt.Errorf(`component "%s": %w`, spec.template, err)
+		}
+	}
+	for name := range passed {
+		if _, ok := declared[name]; !ok {
+			return fmt.Errorf(`component "%s": unknown parameter "%s"`, spec.template, name)
+		}
+	}
+	return nil
+}
+
+// bindComponents replaces the placeholder component function of the page
+// template t with one that executes components within t, and checks every
+// component call made by the templates in deps.
+func bindComponents(t *template.Template, bufpool *bpool.BufferPool, deps DependencyGraph) error {
+	specs := make(map[string]*componentSpec)
+	for _, tmpl := range t.Templates() {
+		params, err := paramsOf(tmpl)
+		if err != nil {
+			return err
+		}
+		specs[tmpl.Name()] = &componentSpec{template: tmpl.Name(), params: params}
+	}
+	for _, dep := range deps.Dependencies {
+		tmpl := t.Lookup(dep.Name)
+		if tmpl == nil || tmpl.Tree == nil {
+			continue
+		}
+		for _, ref := range listRefs(tmpl.Tree.Root, map[string]struct{}{"component": {}}) {
+			if ref.name == "" || ref.via != "component" {
+				continue
+			}
+			spec := specs[ref.name]
+			if spec == nil {
+				continue // missing templates are already reported by buildGraph
+			}
+			err := spec.checkCall(ref.node.(*parse.CommandNode))
+			if err != nil {
+				location, _ := tmpl.Tree.ErrorContext(ref.node)
+				return fmt.Errorf("%s: %w", location, err)
+			}
+		}
+	}
+	t.Funcs(template.FuncMap{
+		"component": func(name string, args ...interface{}) (template.HTML, error) {
+			spec := specs[name]
+			if spec == nil {
+				return "", fmt.Errorf(`no such component "%s"`, name)
+			}
+			data, err := spec.bind(args)
+			if err != nil {
+				return "", err
+			}
+			buf := bufpool.Get()
+			defer bufpool.Put(buf)
+			err = t.ExecuteTemplate(buf, name, data)
+			if err != nil {
+				return "", err
+			}
+			return template.HTML(buf.String()), nil
+		},
+	})
+	return nil
+}
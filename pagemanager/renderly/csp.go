@@ -0,0 +1,207 @@
+package renderly
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// CSP is a parsed Content-Security-Policy: an ordered list of directives, each
+// with a list of unique sources. Directive names are case-insensitive and are
+// stored in lowercase. A CSP is meant to be built up over the course of a
+// request by middlewares and renderly (see ContextWithCSP), and serialized
+// into the Content-Security-Policy header once.
+type CSP struct {
+	directives []string
+	sources    map[string][]string
+}
+
+// ParseCSP parses a Content-Security-Policy header value. Directives are
+// separated by semicolons and sources by any whitespace, including newlines.
+// As per the CSP spec, a repeated directive is ignored.
+func ParseCSP(policy string) *CSP {
+	csp := &CSP{sources: make(map[string][]string)}
+	for _, directive := range strings.Split(policy, ";") {
+		fields := strings.Fields(directive)
+		if len(fields) == 0 {
+			continue
+		}
+		name := strings.ToLower(fields[0])
+		if csp.Has(name) {
+			continue
+		}
+		csp.Set(name, fields[1:]...)
+	}
+	return csp
+}
+
+// Has reports whether the policy contains the directive.
+func (csp *CSP) Has(directive string) bool {
+	_, ok := csp.sources[strings.ToLower(directive)]
+	return ok
+}
+
+// Get returns the sources of the directive.
+func (csp *CSP) Get(directive string) []string {
+	return append([]string(nil), csp.sources[strings.ToLower(directive)]...)
+}
+
+// Directives returns the names of the directives in the policy, in order.
+func (csp *CSP) Directives() []string {
+	return append([]string(nil), csp.directives...)
+}
+
+// Set replaces the sources of the directive, adding the directive to the end
+// of the policy if it does not exist.
+func (csp *CSP) Set(directive string, sources ...string) {
+	directive = strings.ToLower(directive)
+	if !csp.Has(directive) {
+		csp.directives = append(csp.directives, directive)
+	}
+	csp.sources[directive] = nil
+	csp.add(directive, sources)
+}
+
+// Add adds the sources that the directive does not already have. If the
+// directive does not exist, it is created with the sources of the directive
+// it falls back to (e.g. script-src-elem falls back to script-src, which falls
+// back to default-src), so that adding a source never blocks anything that was
+// previously allowed.
+func (csp *CSP) Add(directive string, sources ...string) {
+	directive = strings.ToLower(directive)
+	if !csp.Has(directive) {
+		var inherited []string
+		for fallback := fallbackOf(directive); fallback != ""; fallback = fallbackOf(fallback) {
+			if csp.Has(fallback) {
+				inherited = csp.Get(fallback)
+				break
+			}
+		}
+		csp.Set(directive, inherited...)
+	}
+	csp.add(directive, sources)
+}
+
+func (csp *CSP) add(directive string, sources []string) {
+	existing := csp.sources[directive]
+	for _, source := range sources {
+		if source == "" || strings.ContainsAny(source, "; \t\r\n") {
+			continue
+		}
+		var found bool
+		for _, s := range existing {
+			if s == source {
+				found = true
+				break
+			}
+		}
+		if !found {
+			existing = append(existing, source)
+		}
+	}
+	csp.sources[directive] = existing
+}
+
+// Delete removes the directive from the policy.
+func (csp *CSP) Delete(directive string) {
+	directive = strings.ToLower(directive)
+	if !csp.Has(directive) {
+		return
+	}
+	delete(csp.sources, directive)
+	for i, name := range csp.directives {
+		if name == directive {
+			csp.directives = append(csp.directives[:i:i], csp.directives[i+1:]...)
+			break
+		}
+	}
+}
+
+// Clone returns a copy of the policy.
+func (csp *CSP) Clone() *CSP {
+	clone := &CSP{sources: make(map[string][]string)}
+	for _, directive := range csp.directives {
+		clone.Set(directive, csp.sources[directive]...)
+	}
+	return clone
+}
+
+// String serializes the policy into a Content-Security-Policy header value.
+func (csp *CSP) String() string {
+	buf := &strings.Builder{}
+	for i, directive := range csp.directives {
+		if i > 0 {
+			buf.WriteString("; ")
+		}
+		buf.WriteString(directive)
+		for _, source := range csp.sources[directive] {
+			buf.WriteString(" ")
+			buf.WriteString(source)
+		}
+	}
+	return buf.String()
+}
+
+// fallbackOf returns the directive that the directive falls back to if it is
+// absent from a policy, or an empty string if there is none.
+func fallbackOf(directive string) string {
+	switch directive {
+	case "script-src-elem", "script-src-attr":
+		return "script-src"
+	case "style-src-elem", "style-src-attr":
+		return "style-src"
+	case "frame-src", "worker-src":
+		return "child-src"
+	case "script-src", "style-src", "img-src", "font-src", "connect-src",
+		"media-src", "object-src", "manifest-src", "prefetch-src", "child-src":
+		return "default-src"
+	}
+	return ""
+}
+
+// allowInline allows inline <script> or <style> elements (kind is "script" or
+// "style") carrying the sources, which are nonces or hashes. The sources are
+// added to script-src/style-src, and to script-src-elem/style-src-elem if
+// present, since those take precedence for elements.
+func allowInline(csp *CSP, kind string, sources ...string) {
+	csp.Add(kind+"-src", sources...)
+	if csp.Has(kind + "-src-elem") {
+		csp.Add(kind+"-src-elem", sources...)
+	}
+}
+
+type cspKey struct{}
+
+// ContextWithCSP returns a copy of ctx carrying the policy. Middlewares put the
+// policy of a request on its context, and Render adds to it and writes it to
+// the Content-Security-Policy header.
+func ContextWithCSP(ctx context.Context, csp *CSP) context.Context {
+	return context.WithValue(ctx, cspKey{}, csp)
+}
+
+// CSPFromContext returns the policy carried by ctx, if any.
+func CSPFromContext(ctx context.Context) (*CSP, bool) {
+	csp, ok := ctx.Value(cspKey{}).(*CSP)
+	return csp, ok
+}
+
+type noNonceKey struct{}
+
+// ContextWithoutNonce returns a copy of ctx that turns off nonce mode (see
+// Nonce) for the pages rendered with it, so that their assets are allowed by
+// hash instead. Pages that are rendered once and then served as files, such as
+// a static export of the site, must not carry a nonce: it would be the same on
+// every visit, and different every time the page is rendered.
+func ContextWithoutNonce(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noNonceKey{}, true)
+}
+
+// requestCSP returns the policy of the request. If no middleware put a
+// policy on the request context, the policy is parsed from the
+// Content-Security-Policy header already set on w (if any).
+func requestCSP(w http.ResponseWriter, r *http.Request) *CSP {
+	if csp, ok := CSPFromContext(r.Context()); ok {
+		return csp
+	}
+	return ParseCSP(w.Header().Get("Content-Security-Policy"))
+}
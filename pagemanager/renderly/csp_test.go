@@ -0,0 +1,122 @@
+package renderly
+
+import (
+	"math/rand"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"testing/quick"
+
+	"github.com/matryer/is"
+)
+
+// cspDirectives is deliberately full of directives that are prefixes of one
+// another.
+var cspDirectives = []string{
+	"default-src", "script-src", "script-src-elem", "script-src-attr",
+	"style-src", "style-src-elem", "style-src-attr", "img-src", "frame-ancestors",
+}
+
+var cspSources = []string{
+	"'self'", "'none'", "'unsafe-inline'", "data:", "cdn.jsdelivr.net",
+	"'sha256-abc='", "'nonce-xyz'", "https://style-src-elem.example.com",
+}
+
+// randomCSP is a CSP that testing/quick knows how to generate.
+type randomCSP struct{ *CSP }
+
+func (randomCSP) Generate(rand *rand.Rand, size int) reflect.Value {
+	csp := ParseCSP("")
+	for _, i := range rand.Perm(len(cspDirectives))[:rand.Intn(len(cspDirectives))] {
+		var sources []string
+		for j := rand.Intn(4); j > 0; j-- {
+			sources = append(sources, cspSources[rand.Intn(len(cspSources))])
+		}
+		csp.Set(cspDirectives[i], sources...)
+	}
+	return reflect.ValueOf(randomCSP{csp})
+}
+
+func Test_CSP(t *testing.T) {
+	is := is.New(t)
+	csp := ParseCSP("default-src 'self';\n  style-src-elem 'self'\n\tfonts.googleapis.com ; STYLE-SRC 'unsafe-inline'; style-src data:;;")
+	is.Equal(csp.Directives(), []string{"default-src", "style-src-elem", "style-src"})
+	is.Equal(csp.Get("style-src"), []string{"'unsafe-inline'"}) // repeated directives are ignored
+	csp.Add("style-src", "'sha256-abc='", "'unsafe-inline'")
+	is.Equal(csp.Get("style-src"), []string{"'unsafe-inline'", "'sha256-abc='"})
+	is.Equal(csp.Get("style-src-elem"), []string{"'self'", "fonts.googleapis.com"}) // untouched by style-src
+	csp.Add("script-src-elem", "'nonce-xyz'")
+	is.Equal(csp.Get("script-src-elem"), []string{"'self'", "'nonce-xyz'"}) // inherited from default-src
+	is.Equal(csp.String(), "default-src 'self'; style-src-elem 'self' fonts.googleapis.com; style-src 'unsafe-inline' 'sha256-abc='; script-src-elem 'self' 'nonce-xyz'")
+
+	allowInline(csp, "style", "'nonce-1'")
+	is.Equal(csp.Get("style-src"), []string{"'unsafe-inline'", "'sha256-abc='", "'nonce-1'"})
+	is.Equal(csp.Get("style-src-elem"), []string{"'self'", "fonts.googleapis.com", "'nonce-1'"})
+
+	// Render adds to the CSP on the request context and writes it to the header
+	ry, err := New(fstest.MapFS{
+		"page.html": {Data: []byte(`{{ .__Content_Security_Policy__ }}{{ .__css__ }}`)},
+		"page.css":  {Data: []byte(`p { color: red; }`)},
+	})
+	is.NoErr(err)
+	csp = ParseCSP("style-src-elem 'self'; frame-ancestors 'self'")
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r = r.WithContext(ContextWithCSP(r.Context(), csp))
+	err = ry.Page(rec, r, nil, "page.html", "page.css")
+	is.NoErr(err)
+	is.Equal(len(csp.Get("style-src-elem")), 2)
+	is.True(strings.HasPrefix(csp.Get("style-src-elem")[1], "'sha256-"))
+	is.Equal(rec.Header().Get("Content-Security-Policy"), csp.String())
+	is.True(!strings.Contains(rec.Body.String(), "frame-ancestors")) // not allowed in <meta>
+}
+
+func Test_CSP_properties(t *testing.T) {
+	config := &quick.Config{MaxCount: 500}
+	// Serializing and parsing a policy gives back the same policy
+	roundTrip := func(c randomCSP) bool {
+		parsed := ParseCSP(c.String())
+		return reflect.DeepEqual(parsed.Directives(), c.Directives()) && parsed.String() == c.String()
+	}
+	// Adding a source to a directive never changes any other directive that
+	// already exists, in particular the directives it is a prefix of
+	isolated := func(c randomCSP, d, s uint8) bool {
+		directive := cspDirectives[int(d)%len(cspDirectives)]
+		source := cspSources[int(s)%len(cspSources)]
+		before := c.Clone()
+		c.Add(directive, source)
+		for _, name := range before.Directives() {
+			if name != directive && !reflect.DeepEqual(before.Get(name), c.Get(name)) {
+				return false
+			}
+		}
+		return true
+	}
+	// Adding the same source twice is the same as adding it once, and an added
+	// source is always present exactly once
+	idempotent := func(c randomCSP, d, s uint8) bool {
+		directive := cspDirectives[int(d)%len(cspDirectives)]
+		source := cspSources[int(s)%len(cspSources)]
+		c.Add(directive, source)
+		once := c.String()
+		c.Add(directive, source)
+		var count int
+		for _, src := range c.Get(directive) {
+			if src == source {
+				count++
+			}
+		}
+		return c.String() == once && count == 1
+	}
+	for name, property := range map[string]interface{}{
+		"roundTrip":  roundTrip,
+		"isolated":   isolated,
+		"idempotent": idempotent,
+	} {
+		if err := quick.Check(property, config); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package renderly
+
+import (
+	"fmt"
+	"html/template"
+	"text/template/parse"
+)
+
+// Dependency describes something that was pulled into a page, and why.
+type Dependency struct {
+	// Name is the name of the template (or CSS/JS file).
+	Name string
+	// Parent is the template that referenced Name. It is empty for the entry
+	// template and for files that were passed directly to Lookup.
+	Parent string
+	// Via describes how Name was pulled in: "entry" for the entry template,
+	// "file" for files passed directly to Lookup, "extends" for templates in
+	// the layout chain, "template" for {{ template }} and {{ block }} actions,
+	// or the name of the template-calling function (see TemplateCallers).
+	Via string
+	// Location is the "file:line:col" where the reference occurred, if any.
+	Location string
+	// CSS, JS, Prehooks and Posthooks are the assets and hooks that were
+	// associated with Name. Assets already included by an earlier dependency
+	// are not repeated.
+	CSS       []*Asset
+	JS        []*Asset
+	Prehooks  int
+	Posthooks int
+}
+
+// DynamicReference is a call to a template-calling function whose template
+// name is not a string constant. The name can only be known at render time,
+// which means the CSS/JS/Prehooks/Posthooks of the invoked template will not be
+// included in the page.
+type DynamicReference struct {
+	Parent   string
+	Via      string
+	Location string
+}
+
+// DependencyGraph is the complete set of templates and files that make up a
+// page, in the order they were discovered.
+type DependencyGraph struct {
+	Entry        string
+	Dependencies []Dependency
+	Dynamic      []DynamicReference
+}
+
+// Dependencies returns the dependency graph of the page made up of the
+// filenames. It is meant as a diagnostic tool for theme authors to find out
+// which templates were pulled into a page and why.
+func (ry *Renderly) Dependencies(filenames ...string) (DependencyGraph, error) {
+	page, err := ry.Lookup(filenames...)
+	if err != nil {
+		return DependencyGraph{}, err
+	}
+	return page.deps, nil
+}
+
+// Dependencies returns the dependency graph of the page.
+func (page Page) Dependencies() DependencyGraph {
+	return page.deps
+}
+
+type templateRef struct {
+	name string // empty if the template name is dynamic
+	via  string
+	node parse.Node
+}
+
+// buildGraph walks the parse tree of the template `name` and every template
+// it references (transitively), returning the resulting dependency graph.
+// callers is the set of function names that take a template name as their
+// first argument.
+func buildGraph(t *template.Template, name string, callers map[string]struct{}) (DependencyGraph, error) {
+	t = t.Lookup(name) // set the main template to `name`
+	if t == nil {
+		return DependencyGraph{}, fmt.Errorf(`no such template "%s"`, name)
+	}
+	graph := DependencyGraph{
+		Entry:        name,
+		Dependencies: []Dependency{{Name: name, Via: "entry"}},
+	}
+	var set = map[string]struct{}{name: {}}
+	var current = t
+	var queue []*template.Template
+	for {
+		for _, ref := range listRefs(current.Tree.Root, callers) {
+			location, _ := current.Tree.ErrorContext(ref.node)
+			if ref.name == "" {
+				graph.Dynamic = append(graph.Dynamic, DynamicReference{
+					Parent:   current.Name(),
+					Via:      ref.via,
+					Location: location,
+				})
+				continue
+			}
+			if _, ok := set[ref.name]; ok {
+				continue
+			}
+			set[ref.name] = struct{}{}
+			graph.Dependencies = append(graph.Dependencies, Dependency{
+				Name:     ref.name,
+				Parent:   current.Name(),
+				Via:      ref.via,
+				Location: location,
+			})
+			dep := t.Lookup(ref.name)
+			if dep == nil || dep.Tree == nil {
+				return graph, fmt.Errorf(`%s: {{ template "%s" }} was referenced in "%s", but was not found`, location, ref.name, current.Name())
+			}
+			queue = append(queue, dep)
+		}
+		if len(queue) == 0 {
+			break
+		}
+		current, queue = queue[0], queue[1:]
+	}
+	return graph, nil
+}
+
+// listDeps returns the names of the templates directly invoked by node with
+// {{ template }} or {{ block }}.
+func listDeps(node parse.Node) []string {
+	var names []string
+	for _, ref := range listRefs(node, nil) {
+		names = append(names, ref.name)
+	}
+	return names
+}
+
+// listRefs returns every template referenced by node, descending into every
+// control structure (including else branches) and pipeline.
+func listRefs(node parse.Node, callers map[string]struct{}) []templateRef {
+	var refs []templateRef
+	switch node := node.(type) {
+	case *parse.ListNode:
+		if node == nil {
+			return nil
+		}
+		for _, n := range node.Nodes {
+			refs = append(refs, listRefs(n, callers)...)
+		}
+	case *parse.TemplateNode:
+		refs = append(refs, templateRef{name: node.Name, via: "template", node: node})
+		refs = append(refs, listRefs(node.Pipe, callers)...)
+	case *parse.ActionNode:
+		refs = append(refs, listRefs(node.Pipe, callers)...)
+	case *parse.IfNode:
+		refs = append(refs, listBranchRefs(&node.BranchNode, callers)...)
+	case *parse.RangeNode:
+		refs = append(refs, listBranchRefs(&node.BranchNode, callers)...)
+	case *parse.WithNode:
+		refs = append(refs, listBranchRefs(&node.BranchNode, callers)...)
+	case *parse.PipeNode:
+		if node == nil {
+			return nil
+		}
+		for _, cmd := range node.Cmds {
+			refs = append(refs, listRefs(cmd, callers)...)
+		}
+	case *parse.ChainNode:
+		refs = append(refs, listRefs(node.Node, callers)...)
+	case *parse.CommandNode:
+		if len(node.Args) == 0 {
+			return nil
+		}
+		if ident, ok := node.Args[0].(*parse.IdentifierNode); ok {
+			if _, ok := callers[ident.Ident]; ok {
+				ref := templateRef{via: ident.Ident, node: node}
+				if len(node.Args) > 1 {
+					if str, ok := node.Args[1].(*parse.StringNode); ok {
+						ref.name = str.Text
+					}
+				}
+				refs = append(refs, ref)
+			}
+		}
+		for _, arg := range node.Args {
+			refs = append(refs, listRefs(arg, callers)...)
+		}
+	}
+	return refs
+}
+
+func listBranchRefs(node *parse.BranchNode, callers map[string]struct{}) []templateRef {
+	var refs []templateRef
+	refs = append(refs, listRefs(node.Pipe, callers)...)
+	refs = append(refs, listRefs(node.List, callers)...)
+	refs = append(refs, listRefs(node.ElseList, callers)...)
+	return refs
+}
@@ -1,13 +1,80 @@
 package renderly
 
-import "fmt"
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
 
+// funcGroups lets FuncMap select a whole group of functions by name.
+var funcGroups = map[string][]string{
+	"maps":       {"map", "mapsplode", "slice", "dict", "merge", "default", "coalesce"},
+	"dates":      {"now", "date", "tz", "timeago"},
+	"strings":    {"truncate", "slugify", "title", "lower", "upper", "trim", "replace", "contains", "hasPrefix", "hasSuffix", "split", "join"},
+	"math":       {"add", "sub", "mul", "div", "mod", "max", "min"},
+	"safe":       {"safeHTML", "safeHTMLAttr", "safeURL", "safeCSS", "safeJS"},
+	"encoding":   {"json", "markdown"},
+	"pagination": {"paginate"},
+}
+
+// FuncMap returns renderly's built-in template functions. If names are
+// provided, only the functions (or groups of functions, see funcGroups) with
+// those names are returned.
 func FuncMap(names ...string) map[string]interface{} {
 	funcMap := map[string]interface{}{
 		"map":       fnMap,
 		"mapsplode": fnMapsplode,
 		"slice":     fnSlice,
 		"errorf":    fnErrorf,
+		// maps
+		"dict":     fnDict,
+		"merge":    fnMerge,
+		"default":  fnDefault,
+		"coalesce": fnCoalesce,
+		// dates
+		"now":     fnNow,
+		"date":    fnDate,
+		"tz":      fnTz,
+		"timeago": fnTimeago,
+		// strings
+		"truncate":  fnTruncate,
+		"slugify":   Slugify,
+		"title":     fnTitle,
+		"lower":     strings.ToLower,
+		"upper":     strings.ToUpper,
+		"trim":      strings.TrimSpace,
+		"replace":   fnReplace,
+		"contains":  fnContains,
+		"hasPrefix": fnHasPrefix,
+		"hasSuffix": fnHasSuffix,
+		"split":     fnSplit,
+		"join":      fnJoin,
+		// math
+		"add": fnAdd,
+		"sub": fnSub,
+		"mul": fnMul,
+		"div": fnDiv,
+		"mod": fnMod,
+		"max": fnMax,
+		"min": fnMin,
+		// safe
+		"safeHTML":     fnSafeHTML,
+		"safeHTMLAttr": fnSafeHTMLAttr,
+		"safeURL":      fnSafeURL,
+		"safeCSS":      fnSafeCSS,
+		"safeJS":       fnSafeJS,
+		// encoding
+		"json":     fnJSON,
+		"markdown": fnMarkdown,
+		// pagination
+		"paginate": Paginate,
 	}
 	if len(names) == 0 {
 		return funcMap
@@ -16,6 +83,10 @@ func FuncMap(names ...string) map[string]interface{} {
 	for _, name := range names {
 		if fn, ok := funcMap[name]; ok {
 			customMap[name] = fn
+			continue
+		}
+		for _, name := range funcGroups[name] {
+			customMap[name] = funcMap[name]
 		}
 	}
 	return customMap
@@ -24,7 +95,7 @@ func FuncMap(names ...string) map[string]interface{} {
 func fnMap(keyvalues ...interface{}) map[string]interface{} {
 	result := make(map[string]interface{})
 	isKey := true
-	var key string
+	var path []string
 	for i, arg := range keyvalues {
 		switch arg := arg.(type) {
 		case mapsploded:
@@ -32,19 +103,24 @@ func fnMap(keyvalues ...interface{}) map[string]interface{} {
 				result[k] = v
 			}
 			continue
-		case []interface{}:
-			if isKey {
-				// TODO: handle nested keys
-			}
 		}
 		if isKey && i+1 == len(keyvalues) {
 			// drop arg if it is a key and there are no more values
 			break
 		}
 		if isKey {
-			key = fmt.Sprint(arg)
+			// A key passed in as a slice (e.g. `slice "user" "name"`) is
+			// treated as a path of nested keys
+			if keys, ok := arg.([]interface{}); ok && len(keys) > 0 {
+				path = make([]string, len(keys))
+				for j, k := range keys {
+					path[j] = fmt.Sprint(k)
+				}
+			} else {
+				path = []string{fmt.Sprint(arg)}
+			}
 		} else {
-			result[key] = arg
+			setPath(result, path, arg)
 		}
 		isKey = !isKey
 	}
@@ -78,3 +154,461 @@ func fnSlice(a ...interface{}) []interface{} {
 func fnErrorf(format string, a ...interface{}) (string, error) {
 	return "", fmt.Errorf(format, a...)
 }
+
+/* maps */
+
+// fnDict is a stricter version of fnMap: keys must be strings and every key
+// must have a value.
+func fnDict(keyvalues ...interface{}) (map[string]interface{}, error) {
+	if len(keyvalues)%2 != 0 {
+		return nil, fmt.Errorf("dict: odd number of arguments")
+	}
+	result := make(map[string]interface{})
+	for i := 0; i < len(keyvalues); i += 2 {
+		key, ok := keyvalues[i].(string)
+		if !ok {
+			return nil, fmt.Errorf("dict: key %v is a %T, not a string", keyvalues[i], keyvalues[i])
+		}
+		result[key] = keyvalues[i+1]
+	}
+	return result, nil
+}
+
+// fnMerge returns a new map containing the keys of every map, with later maps
+// taking precedence.
+func fnMerge(maps ...map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{})
+	for _, m := range maps {
+		for k, v := range m {
+			result[k] = v
+		}
+	}
+	return result
+}
+
+func isTrue(value interface{}) bool {
+	truth, _ := template.IsTrue(value)
+	return truth
+}
+
+// fnDefault returns value if it is non-empty, otherwise it returns def. It is
+// meant to be used in a pipeline: {{ .title | default "Untitled" }}.
+func fnDefault(def, value interface{}) interface{} {
+	if isTrue(value) {
+		return value
+	}
+	return def
+}
+
+// fnCoalesce returns the first non-empty value.
+func fnCoalesce(values ...interface{}) interface{} {
+	for _, value := range values {
+		if isTrue(value) {
+			return value
+		}
+	}
+	return nil
+}
+
+/* dates */
+
+// timeNow is overridden in tests.
+var timeNow = time.Now
+
+func fnNow() time.Time {
+	return timeNow()
+}
+
+func toTime(value interface{}) (time.Time, error) {
+	switch value := value.(type) {
+	case time.Time:
+		return value, nil
+	case *time.Time:
+		if value == nil {
+			return time.Time{}, nil
+		}
+		return *value, nil
+	default:
+		return time.Time{}, fmt.Errorf("%v is a %T, not a time.Time", value, value)
+	}
+}
+
+// fnDate formats t with the layout. The zero time is formatted as an empty
+// string.
+func fnDate(layout string, t interface{}) (string, error) {
+	tm, err := toTime(t)
+	if err != nil {
+		return "", err
+	}
+	if tm.IsZero() {
+		return "", nil
+	}
+	return tm.Format(layout), nil
+}
+
+// fnTz converts t to the IANA timezone, e.g. {{ .Date | tz "Asia/Singapore" |
+// date "2006 January 02" }}.
+func fnTz(name string, t interface{}) (time.Time, error) {
+	tm, err := toTime(t)
+	if err != nil {
+		return tm, err
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return tm, err
+	}
+	return tm.In(loc), nil
+}
+
+// fnTimeago describes t relative to the current time, e.g. "3 days ago" or
+// "in 2 hours".
+func fnTimeago(t interface{}) (string, error) {
+	tm, err := toTime(t)
+	if err != nil {
+		return "", err
+	}
+	d := timeNow().Sub(tm)
+	future := d < 0
+	if future {
+		d = -d
+	}
+	var n int
+	var unit string
+	switch {
+	case d < time.Minute:
+		return "just now", nil
+	case d < time.Hour:
+		n, unit = int(d/time.Minute), "minute"
+	case d < 24*time.Hour:
+		n, unit = int(d/time.Hour), "hour"
+	case d < 30*24*time.Hour:
+		n, unit = int(d/(24*time.Hour)), "day"
+	case d < 365*24*time.Hour:
+		n, unit = int(d/(30*24*time.Hour)), "month"
+	default:
+		n, unit = int(d/(365*24*time.Hour)), "year"
+	}
+	if n != 1 {
+		unit += "s"
+	}
+	if future {
+		return fmt.Sprintf("in %d %s", n, unit), nil
+	}
+	return fmt.Sprintf("%d %s ago", n, unit), nil
+}
+
+/* strings */
+
+// fnTruncate shortens s to at most n characters (not bytes), replacing the
+// last character with an ellipsis if s had to be shortened.
+func fnTruncate(n int, s string) string {
+	if n <= 0 {
+		return ""
+	}
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	runes := []rune(s)
+	return strings.TrimRightFunc(string(runes[:n-1]), unicode.IsSpace) + "…"
+}
+
+// Slugify lowercases s and replaces every run of characters that are not
+// letters or digits with a single hyphen. It is the "slugify" template
+// function.
+func Slugify(s string) string {
+	b := &strings.Builder{}
+	hyphen := false
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if hyphen && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			hyphen = false
+			continue
+		}
+		hyphen = true
+	}
+	return b.String()
+}
+
+// fnTitle uppercases the first letter of every word in s.
+func fnTitle(s string) string {
+	b := &strings.Builder{}
+	start := true
+	for _, r := range s {
+		if start {
+			b.WriteRune(unicode.ToTitle(r))
+		} else {
+			b.WriteRune(r)
+		}
+		start = unicode.IsSpace(r) || r == '-'
+	}
+	return b.String()
+}
+
+func fnReplace(old, new, s string) string {
+	return strings.ReplaceAll(s, old, new)
+}
+
+func fnContains(substr, s string) bool {
+	return strings.Contains(s, substr)
+}
+
+func fnHasPrefix(prefix, s string) bool {
+	return strings.HasPrefix(s, prefix)
+}
+
+func fnHasSuffix(suffix, s string) bool {
+	return strings.HasSuffix(s, suffix)
+}
+
+func fnSplit(sep, s string) []string {
+	return strings.Split(s, sep)
+}
+
+func fnJoin(sep string, elems interface{}) (string, error) {
+	switch elems := elems.(type) {
+	case []string:
+		return strings.Join(elems, sep), nil
+	case []interface{}:
+		strs := make([]string, len(elems))
+		for i, elem := range elems {
+			strs[i] = fmt.Sprint(elem)
+		}
+		return strings.Join(strs, sep), nil
+	default:
+		return "", fmt.Errorf("join: %T is not a slice", elems)
+	}
+}
+
+/* math */
+
+// toNumber converts value to an int64 if it is an integer, or a float64 if it
+// is a floating point number.
+func toNumber(value interface{}) (i int64, f float64, isFloat bool, err error) {
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), 0, false, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(v.Uint()), 0, false, nil
+	case reflect.Float32, reflect.Float64:
+		return 0, v.Float(), true, nil
+	default:
+		return 0, 0, false, fmt.Errorf("%v is a %T, not a number", value, value)
+	}
+}
+
+// arithmetic applies intOp if both a and b are integers, otherwise it converts
+// them to float64 and applies floatOp.
+func arithmetic(a, b interface{}, intOp func(int64, int64) (int64, error), floatOp func(float64, float64) float64) (interface{}, error) {
+	ai, af, aIsFloat, err := toNumber(a)
+	if err != nil {
+		return nil, err
+	}
+	bi, bf, bIsFloat, err := toNumber(b)
+	if err != nil {
+		return nil, err
+	}
+	if !aIsFloat && !bIsFloat {
+		n, err := intOp(ai, bi)
+		if err != nil {
+			return nil, err
+		}
+		return int(n), nil
+	}
+	if !aIsFloat {
+		af = float64(ai)
+	}
+	if !bIsFloat {
+		bf = float64(bi)
+	}
+	return floatOp(af, bf), nil
+}
+
+func fnAdd(a, b interface{}) (interface{}, error) {
+	return arithmetic(a, b,
+		func(a, b int64) (int64, error) { return a + b, nil },
+		func(a, b float64) float64 { return a + b },
+	)
+}
+
+func fnSub(a, b interface{}) (interface{}, error) {
+	return arithmetic(a, b,
+		func(a, b int64) (int64, error) { return a - b, nil },
+		func(a, b float64) float64 { return a - b },
+	)
+}
+
+func fnMul(a, b interface{}) (interface{}, error) {
+	return arithmetic(a, b,
+		func(a, b int64) (int64, error) { return a * b, nil },
+		func(a, b float64) float64 { return a * b },
+	)
+}
+
+func fnDiv(a, b interface{}) (interface{}, error) {
+	return arithmetic(a, b,
+		func(a, b int64) (int64, error) {
+			if b == 0 {
+				return 0, fmt.Errorf("div: division by zero")
+			}
+			return a / b, nil
+		},
+		func(a, b float64) float64 { return a / b },
+	)
+}
+
+func fnMod(a, b interface{}) (interface{}, error) {
+	return arithmetic(a, b,
+		func(a, b int64) (int64, error) {
+			if b == 0 {
+				return 0, fmt.Errorf("mod: division by zero")
+			}
+			return a % b, nil
+		},
+		math.Mod,
+	)
+}
+
+func fnMax(a, b interface{}) (interface{}, error) {
+	return arithmetic(a, b,
+		func(a, b int64) (int64, error) {
+			if a > b {
+				return a, nil
+			}
+			return b, nil
+		},
+		math.Max,
+	)
+}
+
+func fnMin(a, b interface{}) (interface{}, error) {
+	return arithmetic(a, b,
+		func(a, b int64) (int64, error) {
+			if a < b {
+				return a, nil
+			}
+			return b, nil
+		},
+		math.Min,
+	)
+}
+
+/* safe */
+
+// The safe* functions mark a string as trusted so that html/template does not
+// escape it. They must never be used on user input.
+
+func fnSafeHTML(s string) template.HTML {
+	return template.HTML(s)
+}
+
+func fnSafeHTMLAttr(s string) template.HTMLAttr {
+	return template.HTMLAttr(s)
+}
+
+func fnSafeURL(s string) template.URL {
+	return template.URL(s)
+}
+
+func fnSafeCSS(s string) template.CSS {
+	return template.CSS(s)
+}
+
+func fnSafeJS(s string) template.JS {
+	return template.JS(s)
+}
+
+/* encoding */
+
+func fnJSON(value interface{}) (string, error) {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// fnMarkdown converts markdown to HTML. Raw HTML and dangerous links inside the
+// markdown are omitted.
+func fnMarkdown(s string) (template.HTML, error) {
+	buf := &bytes.Buffer{}
+	err := markdown.Convert([]byte(s), buf)
+	if err != nil {
+		return "", err
+	}
+	return template.HTML(buf.String()), nil
+}
+
+/* pagination */
+
+// Pagination describes the current page of a paginated list of items.
+type Pagination struct {
+	Current    int // the current page number, starting from 1
+	PerPage    int
+	TotalItems int
+	TotalPages int
+}
+
+// Paginate returns the Pagination for the page number current, clamping
+// current to the range of valid page numbers. It is the "paginate" template
+// function.
+func Paginate(totalItems, perPage, current int) Pagination {
+	p := Pagination{PerPage: perPage, TotalItems: totalItems}
+	if perPage <= 0 {
+		p.PerPage = totalItems
+	}
+	p.TotalPages = 1
+	if p.PerPage > 0 && totalItems > 0 {
+		p.TotalPages = (totalItems + p.PerPage - 1) / p.PerPage
+	}
+	p.Current = current
+	if p.Current < 1 {
+		p.Current = 1
+	}
+	if p.Current > p.TotalPages {
+		p.Current = p.TotalPages
+	}
+	return p
+}
+
+// Offset is the number of items that come before the current page.
+func (p Pagination) Offset() int { return (p.Current - 1) * p.PerPage }
+
+func (p Pagination) HasPrev() bool { return p.Current > 1 }
+
+func (p Pagination) HasNext() bool { return p.Current < p.TotalPages }
+
+func (p Pagination) Prev() int { return p.Current - 1 }
+
+func (p Pagination) Next() int { return p.Current + 1 }
+
+// Pages returns every page number.
+func (p Pagination) Pages() []int {
+	pages := make([]int, p.TotalPages)
+	for i := range pages {
+		pages[i] = i + 1
+	}
+	return pages
+}
+
+// Window returns the first page, the last page and the n pages on either side
+// of the current page. Gaps between the page numbers are represented by a 0,
+// for example Window(1) on page 5 of 9 returns [1 0 4 5 6 0 9].
+func (p Pagination) Window(n int) []int {
+	var pages []int
+	last := 0
+	for page := 1; page <= p.TotalPages; page++ {
+		if page != 1 && page != p.TotalPages && (page < p.Current-n || page > p.Current+n) {
+			continue
+		}
+		if page > last+1 {
+			pages = append(pages, 0)
+		}
+		pages = append(pages, page)
+		last = page
+	}
+	return pages
+}
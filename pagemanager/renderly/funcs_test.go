@@ -0,0 +1,173 @@
+package renderly
+
+import (
+	"html/template"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func Test_FuncMap(t *testing.T) {
+	is := is.New(t)
+	is.Equal(len(FuncMap("slugify", "nonexistent")), 1)
+	math := FuncMap("math")
+	is.Equal(len(math), len(funcGroups["math"]))
+	for name := range FuncMap() {
+		if name == "errorf" {
+			continue
+		}
+		found := false
+		for _, names := range funcGroups {
+			for _, n := range names {
+				found = found || n == name
+			}
+		}
+		is.True(found) // every function belongs to a group
+	}
+}
+
+func Test_maps(t *testing.T) {
+	is := is.New(t)
+	m, err := fnDict("a", 1, "b", "two")
+	is.NoErr(err)
+	is.Equal(m, map[string]interface{}{"a": 1, "b": "two"})
+	_, err = fnDict("a")
+	is.True(err != nil)
+	_, err = fnDict(1, 2)
+	is.True(err != nil)
+	is.Equal(fnMerge(map[string]interface{}{"a": 1, "b": 1}, map[string]interface{}{"b": 2}), map[string]interface{}{"a": 1, "b": 2})
+	is.Equal(fnDefault("x", ""), "x")
+	is.Equal(fnDefault("x", "y"), "y")
+	is.Equal(fnDefault(10, 0), 10)
+	is.Equal(fnCoalesce(nil, "", 0, "z", "w"), "z")
+	is.Equal(fnCoalesce(nil, ""), nil)
+}
+
+func Test_dates(t *testing.T) {
+	is := is.New(t)
+	now := time.Date(2020, 6, 18, 12, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	s, err := fnDate("2006 January 02", now)
+	is.NoErr(err)
+	is.Equal(s, "2020 June 18")
+	s, err = fnDate("2006", time.Time{})
+	is.NoErr(err)
+	is.Equal(s, "")
+	_, err = fnDate("2006", "not a time")
+	is.True(err != nil)
+
+	sg, err := fnTz("Asia/Singapore", now)
+	is.NoErr(err)
+	is.Equal(sg.Hour(), 20)
+	_, err = fnTz("Nowhere/Nothing", now)
+	is.True(err != nil)
+
+	for _, tt := range []struct {
+		t    time.Time
+		want string
+	}{
+		{now.Add(-10 * time.Second), "just now"},
+		{now.Add(-1 * time.Minute), "1 minute ago"},
+		{now.Add(-5 * time.Hour), "5 hours ago"},
+		{now.Add(-3 * 24 * time.Hour), "3 days ago"},
+		{now.Add(-65 * 24 * time.Hour), "2 months ago"},
+		{now.Add(-800 * 24 * time.Hour), "2 years ago"},
+		{now.Add(2 * time.Hour), "in 2 hours"},
+	} {
+		got, err := fnTimeago(tt.t)
+		is.NoErr(err)
+		is.Equal(got, tt.want)
+	}
+}
+
+func Test_strings(t *testing.T) {
+	is := is.New(t)
+	is.Equal(fnTruncate(5, "hello"), "hello")
+	is.Equal(fnTruncate(6, "hello world"), "hello…")
+	is.Equal(fnTruncate(3, "héllo"), "hé…")
+	is.Equal(fnTruncate(0, "hello"), "")
+	is.Equal(Slugify("  Hello, World! It's 2020 "), "hello-world-it-s-2020")
+	is.Equal(Slugify("Café au lait"), "café-au-lait")
+	is.Equal(fnTitle("the quick brown-fox"), "The Quick Brown-Fox")
+	is.Equal(fnReplace("a", "b", "banana"), "bbnbnb")
+	is.True(fnContains("nan", "banana"))
+	is.True(fnHasPrefix("ba", "banana"))
+	is.True(fnHasSuffix("na", "banana"))
+	is.Equal(fnSplit(",", "a,b"), []string{"a", "b"})
+	s, err := fnJoin(", ", []interface{}{"a", 1})
+	is.NoErr(err)
+	is.Equal(s, "a, 1")
+	_, err = fnJoin(", ", 1)
+	is.True(err != nil)
+}
+
+func Test_math(t *testing.T) {
+	is := is.New(t)
+	for _, tt := range []struct {
+		fn   func(a, b interface{}) (interface{}, error)
+		a, b interface{}
+		want interface{}
+	}{
+		{fnAdd, 1, 2, 3},
+		{fnAdd, 1, 0.5, 1.5},
+		{fnSub, int64(5), uint8(2), 3},
+		{fnMul, 3, 4, 12},
+		{fnDiv, 7, 2, 3},
+		{fnDiv, 7.0, 2, 3.5},
+		{fnMod, 7, 3, 1},
+		{fnMax, 3, 9, 9},
+		{fnMin, 3, 9, 3},
+		{fnMin, 3.5, 9, 3.5},
+	} {
+		got, err := tt.fn(tt.a, tt.b)
+		is.NoErr(err)
+		is.Equal(got, tt.want)
+	}
+	_, err := fnDiv(1, 0)
+	is.True(err != nil)
+	_, err = fnAdd("1", 2)
+	is.True(err != nil)
+}
+
+func Test_safe(t *testing.T) {
+	is := is.New(t)
+	tmpl := template.Must(template.New("").Funcs(FuncMap("safe")).Parse(
+		`{{ .s }}|{{ safeHTML .s }}|<a href="{{ safeURL .u }}">|<p style="{{ safeCSS .c }}">`,
+	))
+	buf := &strings.Builder{}
+	err := tmpl.Execute(buf, map[string]string{"s": "<b>", "u": "javascript:go", "c": "color: red"})
+	is.NoErr(err)
+	is.Equal(buf.String(), `&lt;b&gt;|<b>|<a href="javascript:go">|<p style="color: red">`)
+}
+
+func Test_encoding(t *testing.T) {
+	is := is.New(t)
+	s, err := fnJSON(map[string]interface{}{"a": []int{1, 2}})
+	is.NoErr(err)
+	is.Equal(s, `{"a":[1,2]}`)
+	html, err := fnMarkdown("# Title\n\n| a | b |\n|---|---|\n| 1 | 2 |\n\n<script>alert(1)</script>\n")
+	is.NoErr(err)
+	is.True(strings.Contains(string(html), "<h1>Title</h1>"))
+	is.True(strings.Contains(string(html), "<td>1</td>"))
+	is.True(!strings.Contains(string(html), "<script>"))
+}
+
+func Test_paginate(t *testing.T) {
+	is := is.New(t)
+	p := Paginate(45, 10, 3)
+	is.Equal(p.TotalPages, 5)
+	is.Equal(p.Offset(), 20)
+	is.True(p.HasPrev() && p.HasNext())
+	is.Equal(p.Pages(), []int{1, 2, 3, 4, 5})
+	is.Equal(Paginate(90, 10, 5).Window(1), []int{1, 0, 4, 5, 6, 0, 9})
+	is.Equal(Paginate(90, 10, 1).Window(1), []int{1, 2, 0, 9})
+	is.Equal(Paginate(90, 10, 99).Current, 9)
+	p = Paginate(0, 10, 1)
+	is.Equal(p.TotalPages, 1)
+	is.True(!p.HasPrev() && !p.HasNext())
+	is.Equal(Paginate(30, 0, 1).TotalPages, 1) // all in one page
+}
@@ -0,0 +1,190 @@
+package renderly
+
+import (
+	"context"
+	"io"
+	"net/http"
+)
+
+// Prehook runs before a page is rendered. It receives the data that the page
+// is about to be rendered with and returns the data to render the page with
+// instead. The page and the template that the hook was registered for can be
+// retrieved from the request context with HookInfoFrom.
+type Prehook func(w io.Writer, r *http.Request, input interface{}) (output interface{}, err error)
+
+// Posthook is a middleware that runs after a page has been rendered. The
+// posthooks of a page are chained together in the order that they were
+// registered and end in a handler that does nothing, so any existing
+// middleware can be used as a posthook. The page and the template that the
+// hook was registered for can be retrieved from the request context with
+// HookInfoFrom.
+type Posthook func(next http.Handler) http.Handler
+
+// HookInfo is what a hook knows about the page being rendered.
+type HookInfo struct {
+	// Page is the page being rendered.
+	Page Page
+	// Template is the name of the template the hook was registered for, or
+	// empty if the hook was registered for every page.
+	Template string
+}
+
+type hookInfoKey struct{}
+
+// HookInfoFrom returns the HookInfo stored in the context of a request passed
+// to a hook.
+func HookInfoFrom(ctx context.Context) (HookInfo, bool) {
+	info, ok := ctx.Value(hookInfoKey{}).(HookInfo)
+	return info, ok
+}
+
+type prehook struct {
+	id       string
+	template string
+	fn       Prehook
+}
+
+type posthook struct {
+	id       string
+	template string
+	fn       Posthook
+}
+
+// AddPrehook registers a prehook for the template (or for every page, if
+// template is empty). Every page that depends on the template runs the hook.
+// Adding a hook with the same id as an existing hook of the template replaces
+// it. Hooks added with an empty id cannot be removed.
+func (ry *Renderly) AddPrehook(template, id string, fn Prehook) {
+	ry.mu.Lock()
+	defer ry.mu.Unlock()
+	hooks := ry.prehooks[template]
+	for i, hook := range hooks {
+		if id != "" && hook.id == id {
+			hooks[i].fn = fn
+			ry.invalidatePages(template)
+			return
+		}
+	}
+	ry.prehooks[template] = append(hooks, prehook{id: id, template: template, fn: fn})
+	ry.invalidatePages(template)
+}
+
+// RemovePrehook removes the prehook of the template with the given id,
+// reporting whether it existed.
+func (ry *Renderly) RemovePrehook(template, id string) bool {
+	ry.mu.Lock()
+	defer ry.mu.Unlock()
+	hooks := ry.prehooks[template]
+	for i, hook := range hooks {
+		if id != "" && hook.id == id {
+			ry.prehooks[template] = append(hooks[:i:i], hooks[i+1:]...)
+			ry.invalidatePages(template)
+			return true
+		}
+	}
+	return false
+}
+
+// AddPosthook registers a posthook for the template (or for every page, if
+// template is empty). Every page that depends on the template runs the hook.
+// Adding a hook with the same id as an existing hook of the template replaces
+// it. Hooks added with an empty id cannot be removed.
+func (ry *Renderly) AddPosthook(template, id string, fn Posthook) {
+	ry.mu.Lock()
+	defer ry.mu.Unlock()
+	hooks := ry.posthooks[template]
+	for i, hook := range hooks {
+		if id != "" && hook.id == id {
+			hooks[i].fn = fn
+			ry.invalidatePages(template)
+			return
+		}
+	}
+	ry.posthooks[template] = append(hooks, posthook{id: id, template: template, fn: fn})
+	ry.invalidatePages(template)
+}
+
+// RemovePosthook removes the posthook of the template with the given id,
+// reporting whether it existed.
+func (ry *Renderly) RemovePosthook(template, id string) bool {
+	ry.mu.Lock()
+	defer ry.mu.Unlock()
+	hooks := ry.posthooks[template]
+	for i, hook := range hooks {
+		if id != "" && hook.id == id {
+			ry.posthooks[template] = append(hooks[:i:i], hooks[i+1:]...)
+			ry.invalidatePages(template)
+			return true
+		}
+	}
+	return false
+}
+
+// invalidatePages evicts every cached page that depends on the template (or
+// every cached page, if template is empty) so that the next Lookup picks up
+// the current set of hooks. It also bumps the hook generation, so that pages
+// that were being looked up while the hooks changed are not cached. ry.mu must
+// be held for writing.
+func (ry *Renderly) invalidatePages(template string) {
+	ry.hookgen++
+	for fullname, page := range ry.cachepage {
+		if template == "" || page.dependsOn(template) {
+			delete(ry.cachepage, fullname)
+		}
+	}
+}
+
+// dependsOn reports whether the page depends on the template.
+func (page Page) dependsOn(template string) bool {
+	for _, dep := range page.deps.Dependencies {
+		if dep.Name == template {
+			return true
+		}
+	}
+	return false
+}
+
+// runPrehooks runs the page's prehooks on data.
+func (page Page) runPrehooks(w io.Writer, r *http.Request, data interface{}) (interface{}, error) {
+	var err error
+	for _, hook := range page.prehooks {
+		ctx := context.WithValue(r.Context(), hookInfoKey{}, HookInfo{Page: page, Template: hook.template})
+		data, err = hook.fn(w, r.WithContext(ctx), data)
+		if err != nil {
+			return data, err
+		}
+	}
+	return data, nil
+}
+
+// runPosthooks chains the page's posthooks together and runs them. If w is
+// not a http.ResponseWriter, headers set by the posthooks are discarded.
+func (page Page) runPosthooks(w io.Writer, r *http.Request) {
+	if len(page.posthooks) == 0 {
+		return
+	}
+	var handler http.Handler = http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+	for i := len(page.posthooks) - 1; i >= 0; i-- {
+		hook := page.posthooks[i]
+		next := hook.fn(handler)
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), hookInfoKey{}, HookInfo{Page: page, Template: hook.template})
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+	rw, ok := w.(http.ResponseWriter)
+	if !ok {
+		rw = &responseWriter{Writer: w, header: make(http.Header)}
+	}
+	handler.ServeHTTP(rw, r)
+}
+
+// responseWriter adapts an io.Writer into a http.ResponseWriter.
+type responseWriter struct {
+	io.Writer
+	header http.Header
+}
+
+func (rw *responseWriter) Header() http.Header { return rw.header }
+
+func (rw *responseWriter) WriteHeader(statusCode int) {}
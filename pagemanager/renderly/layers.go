@@ -0,0 +1,148 @@
+package renderly
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"sort"
+)
+
+// Layer is a named filesystem in a LayeredFS.
+type Layer struct {
+	Name string
+	FS   fs.FS
+}
+
+// LayeredFS is a union of filesystems stacked on top of each other. Every file
+// is resolved from the highest layer that has it, so upper layers override
+// lower layers one file at a time. Directory listings are the union of every
+// layer's listing. A typical stack for a theme is, from highest to lowest:
+//
+//	renderly.NewLayeredFS(
+//		renderly.Layer{Name: "overrides", FS: os.DirFS("./themes/mytheme")},
+//		renderly.Layer{Name: "theme", FS: activeTheme},
+//		renderly.Layer{Name: "plugin", FS: pluginEmbedFS},
+//		renderly.Layer{Name: "base", FS: baseTheme},
+//	)
+type LayeredFS struct {
+	layers []Layer
+}
+
+// NewLayeredFS returns a LayeredFS of the layers, ordered from highest to
+// lowest. Layers that are themselves LayeredFS are flattened.
+func NewLayeredFS(layers ...Layer) *LayeredFS {
+	lfs := &LayeredFS{}
+	for _, layer := range layers {
+		if sub, ok := layer.FS.(*LayeredFS); ok {
+			lfs.layers = append(lfs.layers, sub.layers...)
+			continue
+		}
+		lfs.layers = append(lfs.layers, layer)
+	}
+	return lfs
+}
+
+// Layers returns the layers of lfs, from highest to lowest.
+func (lfs *LayeredFS) Layers() []Layer {
+	return append([]Layer(nil), lfs.layers...)
+}
+
+// Which returns the name of the layer that serves the file identified by name.
+func (lfs *LayeredFS) Which(name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: "which", Path: name, Err: fs.ErrInvalid}
+	}
+	for _, layer := range lfs.layers {
+		_, err := fs.Stat(layer.FS, name)
+		if err == nil {
+			return layer.Name, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+	}
+	return "", &fs.PathError{Op: "which", Path: name, Err: fs.ErrNotExist}
+}
+
+// Open implements fs.FS.
+func (lfs *LayeredFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	for _, layer := range lfs.layers {
+		f, err := layer.FS.Open(name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		info, err := f.Stat()
+		if err != nil || !info.IsDir() {
+			return f, err
+		}
+		entries, err := lfs.ReadDir(name)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &layeredDir{File: f, entries: entries}, nil
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+// layeredDir is a directory whose entries are the union of the entries of
+// every layer.
+type layeredDir struct {
+	fs.File
+	entries []fs.DirEntry
+	offset  int
+}
+
+// ReadDir implements fs.ReadDirFile.
+func (d *layeredDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	entries := d.entries[d.offset:]
+	if n > 0 {
+		if len(entries) == 0 {
+			return nil, io.EOF
+		}
+		if n < len(entries) {
+			entries = entries[:n]
+		}
+	}
+	d.offset += len(entries)
+	return entries, nil
+}
+
+// ReadDir implements fs.ReadDirFS. Entries from upper layers shadow entries of
+// the same name from lower layers.
+func (lfs *LayeredFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	var found bool
+	seen := make(map[string]struct{})
+	var entries []fs.DirEntry
+	for _, layer := range lfs.layers {
+		list, err := fs.ReadDir(layer.FS, name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		found = true
+		for _, entry := range list {
+			if _, ok := seen[entry.Name()]; ok {
+				continue
+			}
+			seen[entry.Name()] = struct{}{}
+			entries = append(entries, entry)
+		}
+	}
+	if !found {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
@@ -0,0 +1,171 @@
+package renderly
+
+import (
+	"fmt"
+	"html/template"
+	"path"
+	"strings"
+	"text/template/parse"
+)
+
+// fnExtends is a no-op at render time. Its only purpose is to let a template
+// declare its parent layout, which is picked up by Lookup when it inspects the
+// template's parse tree:
+//
+//	{{ extends "layouts/base.html" }}
+//	{{ define "content" }}...{{ end }}
+//
+// The parent's filename is relative to the directory of the child template.
+// The parent layout declares overridable blocks with {{ block "name" . }},
+// which the child overrides with {{ define "name" }}. Layouts may themselves
+// extend other layouts, forming a chain (e.g. base → section → page).
+func fnExtends(name string) string {
+	return ""
+}
+
+// parseFile parses the template file identified by filename, using the
+// template cache if it is enabled.
+func (ry *Renderly) parseFile(filename string) (*template.Template, error) {
+	var t *template.Template
+	// If the template is already cached for the given filename, use that template
+	if ry.cacheenabled {
+		ry.mu.RLock()
+		t = ry.cachehtml[filename]
+		ry.mu.RUnlock()
+		if t != nil {
+			return t, nil
+		}
+	}
+	// Else construct the template from scratch
+	b, err := ry.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	t, err = template.New(filename).Funcs(ry.funcs).Option(ry.opts...).Parse(string(b))
+	if err != nil {
+		return nil, err
+	}
+	// Cache the template if the user enabled it
+	if ry.cacheenabled {
+		ry.mu.Lock()
+		ry.cachehtml[filename] = t
+		ry.mu.Unlock()
+	}
+	return t, nil
+}
+
+// layoutChain returns the chain of layouts extended by the template t, nearest
+// parent first. It returns an empty chain if t does not extend any layout.
+func (ry *Renderly) layoutChain(t *template.Template) ([]*template.Template, error) {
+	var chain []*template.Template
+	visited := map[string]struct{}{t.Name(): {}}
+	for {
+		parent, err := extendsOf(t)
+		if err != nil {
+			return chain, err
+		}
+		if parent == "" {
+			return chain, nil
+		}
+		if _, ok := visited[parent]; ok {
+			return chain, fmt.Errorf(`%s: {{ extends "%s" }} creates a cycle in the layout chain`, t.Name(), parent)
+		}
+		visited[parent] = struct{}{}
+		p, err := ry.parseFile(parent)
+		if err != nil {
+			return chain, fmt.Errorf(`%s: {{ extends "%s" }}: %w`, t.Name(), parent, err)
+		}
+		chain = append(chain, p)
+		t = p
+	}
+}
+
+// extendsOf returns the (resolved) filename of the layout declared by an {{
+// extends }} action at the top level of t, or an empty string if there is
+// none.
+func extendsOf(t *template.Template) (string, error) {
+	if t.Tree == nil || t.Tree.Root == nil {
+		return "", nil
+	}
+	var parent string
+	for _, node := range t.Tree.Root.Nodes {
+		action, ok := node.(*parse.ActionNode)
+		if !ok || action.Pipe == nil || len(action.Pipe.Cmds) != 1 {
+			continue
+		}
+		args := action.Pipe.Cmds[0].Args
+		if ident, ok := args[0].(*parse.IdentifierNode); !ok || ident.Ident != "extends" {
+			continue
+		}
+		if parent != "" {
+			return "", fmt.Errorf("%s: a template can only extend one layout", t.Name())
+		}
+		if len(args) != 2 {
+			return "", fmt.Errorf("%s: extends takes exactly one layout name", t.Name())
+		}
+		str, ok := args[1].(*parse.StringNode)
+		if !ok {
+			return "", fmt.Errorf("%s: the layout name passed to extends must be a string constant", t.Name())
+		}
+		parent = path.Join(path.Dir(t.Name()), str.Text)
+	}
+	return parent, nil
+}
+
+// definedNames returns the names of the templates defined with {{ define }}
+// or {{ block }} inside t, excluding t itself.
+func definedNames(t *template.Template) []string {
+	var names []string
+	for _, tmpl := range t.Templates() {
+		if tmpl.Name() == t.Name() || tmpl.Tree == nil {
+			continue
+		}
+		names = append(names, tmpl.Name())
+	}
+	return names
+}
+
+// checkBlocks makes sure that no block declared in the layout chain is
+// overridden by more than one of the page's own templates, since the winner
+// would otherwise depend on the order the files were passed in.
+func checkBlocks(chain []*template.Template, templates []*template.Template) error {
+	// A block is any template that is either defined or invoked by a layout
+	blocks := make(map[string]string)
+	for _, layout := range chain {
+		for _, name := range definedNames(layout) {
+			blocks[name] = layout.Name()
+		}
+		for _, tmpl := range layout.Templates() {
+			if tmpl.Tree == nil {
+				continue
+			}
+			for _, name := range listDeps(tmpl.Tree.Root) {
+				if _, ok := blocks[name]; !ok {
+					blocks[name] = layout.Name()
+				}
+			}
+		}
+	}
+	overriddenBy := make(map[string]string)
+	for _, t := range templates {
+		for _, name := range definedNames(t) {
+			layout, ok := blocks[name]
+			if !ok {
+				continue
+			}
+			if other, ok := overriddenBy[name]; ok {
+				return fmt.Errorf(`block "%s" (declared in %s) is overridden by both %s and %s`, name, layout, other, t.Name())
+			}
+			overriddenBy[name] = t.Name()
+		}
+	}
+	return nil
+}
+
+func layoutNames(chain []*template.Template) string {
+	names := make([]string, len(chain))
+	for i, t := range chain {
+		names[len(chain)-1-i] = t.Name()
+	}
+	return strings.Join(names, " → ")
+}
@@ -0,0 +1,266 @@
+package renderly
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"regexp"
+
+	chromahtml "github.com/alecthomas/chroma/formatters/html"
+	"github.com/alecthomas/chroma/styles"
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/pelletier/go-toml"
+	"github.com/yuin/goldmark"
+	highlighting "github.com/yuin/goldmark-highlighting"
+	"github.com/yuin/goldmark/extension"
+	"gopkg.in/yaml.v2"
+)
+
+// markdown is the CommonMark converter used by renderly, extended with GitHub
+// flavored tables, strikethrough, footnotes and syntax highlighting of fenced
+// code blocks. Code is highlighted with CSS classes instead of inline styles,
+// so that it works under the hash-based Content-Security-Policy generated by
+// renderly. The colors come from the CSS of a chroma style, see
+// HighlightStyles. Line numbers and highlighted lines are enabled with fence
+// attributes:
+//
+//	```go {linenos=table,hl_lines=[2,"4-5"],linenostart=10}
+var markdown = goldmark.New(
+	goldmark.WithExtensions(
+		extension.Table,
+		extension.Strikethrough,
+		extension.Footnote,
+		highlighting.NewHighlighting(
+			highlighting.WithFormatOptions(chromahtml.WithClasses(true)),
+		),
+	),
+)
+
+// markdownPolicy is the default policy for sanitizing markdown. On top of the
+// UGC policy it allows the class attributes generated by syntax highlighting.
+func markdownPolicy() *bluemonday.Policy {
+	policy := bluemonday.UGCPolicy()
+	policy.AllowAttrs("class").
+		Matching(regexp.MustCompile(`^[a-zA-Z0-9\s\-_]+$`)).
+		OnElements("pre", "code", "span", "div", "table", "tr", "td")
+	return policy
+}
+
+// HighlightStyles makes the color schemes of the named chroma styles (or every
+// chroma style, if no names are given) available to themes. For each style it
+// registers an empty template named "highlight/<style>" that carries the
+// style's CSS, so a theme picks its color scheme by invoking the template
+// anywhere in its pages:
+//
+//	{{ template "highlight/monokai" }}
+//
+// See https://xyproto.github.io/splash/docs/ for the list of styles.
+func HighlightStyles(names ...string) Option {
+	return func(ry *Renderly) error {
+		if len(names) == 0 {
+			names = styles.Names()
+		}
+		formatter := chromahtml.New(chromahtml.WithClasses(true))
+		var plugins []Plugin
+		for _, name := range names {
+			style, ok := styles.Registry[name]
+			if !ok {
+				return fmt.Errorf("no such chroma style %q", name)
+			}
+			buf := &bytes.Buffer{}
+			err := formatter.WriteCSS(buf, style)
+			if err != nil {
+				return err
+			}
+			t, err := template.New("highlight/" + name).Parse("")
+			if err != nil {
+				return err
+			}
+			plugins = append(plugins, Plugin{
+				HTML: t,
+				CSS:  []*Asset{{Data: buf.String()}},
+			})
+		}
+		return Plugins(plugins...)(ry)
+	}
+}
+
+// Markdown is a markdown file that has been converted to HTML.
+type Markdown struct {
+	Name        string
+	HTML        template.HTML
+	FrontMatter map[string]interface{}
+}
+
+// MarkdownPolicy sets the bluemonday policy used to sanitize the HTML
+// generated from markdown files. The default is bluemonday.UGCPolicy(), plus
+// the class attributes needed for syntax highlighting.
+func MarkdownPolicy(policy *bluemonday.Policy) Option {
+	return func(ry *Renderly) error {
+		ry.mdpolicy = policy
+		return nil
+	}
+}
+
+// parseMarkdownFile reads the markdown file identified by filename and
+// converts it to HTML, using the markdown cache if it is enabled.
+func (ry *Renderly) parseMarkdownFile(filename string) (*Markdown, error) {
+	var md *Markdown
+	// If the markdown is already cached for the given filename, use that markdown
+	if ry.cacheenabled {
+		ry.mu.RLock()
+		md = ry.cachemd[filename]
+		ry.mu.RUnlock()
+		if md != nil {
+			return md, nil
+		}
+	}
+	// Else convert the markdown from scratch
+	b, err := ry.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	md, err = parseMarkdown(b, ry.mdpolicy)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	md.Name = filename
+	// Cache the markdown if the user enabled it
+	if ry.cacheenabled {
+		ry.mu.Lock()
+		ry.cachemd[filename] = md
+		ry.mu.Unlock()
+	}
+	return md, nil
+}
+
+// parseMarkdown converts markdown to sanitized HTML. The markdown may start
+// with front matter (see ParseFrontMatter).
+func parseMarkdown(b []byte, policy *bluemonday.Policy) (*Markdown, error) {
+	md := &Markdown{}
+	frontMatter, body, err := ParseFrontMatter(b)
+	md.FrontMatter = frontMatter
+	if err != nil {
+		return md, err
+	}
+	md.HTML, err = convertMarkdown(body, policy)
+	return md, err
+}
+
+// ParseFrontMatter splits b into its front matter and body. The front matter
+// is either TOML delimited by +++ lines or YAML delimited by --- lines. The
+// front matter is empty (but not nil) if b has none.
+func ParseFrontMatter(b []byte) (frontMatter map[string]interface{}, body []byte, err error) {
+	frontMatter = make(map[string]interface{})
+	format, data, body := splitFrontMatter(b)
+	switch format {
+	case "toml":
+		tree, err := toml.LoadBytes(data)
+		if err != nil {
+			return frontMatter, body, fmt.Errorf("invalid TOML front matter: %w", err)
+		}
+		frontMatter = tree.ToMap()
+	case "yaml":
+		var m map[string]interface{}
+		err := yaml.Unmarshal(data, &m)
+		if err != nil {
+			return frontMatter, body, fmt.Errorf("invalid YAML front matter: %w", err)
+		}
+		for k, v := range m {
+			frontMatter[k] = normalizeYAML(v)
+		}
+	}
+	return frontMatter, body, nil
+}
+
+// MarkdownHTML converts markdown to HTML sanitized with the renderly's
+// markdown policy (see MarkdownPolicy). Unlike markdown files, b is not
+// checked for front matter.
+func (ry *Renderly) MarkdownHTML(b []byte) (template.HTML, error) {
+	return convertMarkdown(b, ry.mdpolicy)
+}
+
+// convertMarkdown converts markdown to HTML, sanitizing it with policy if
+// policy is not nil.
+func convertMarkdown(b []byte, policy *bluemonday.Policy) (template.HTML, error) {
+	buf := &bytes.Buffer{}
+	err := markdown.Convert(b, buf)
+	if err != nil {
+		return "", err
+	}
+	if policy != nil {
+		return template.HTML(policy.SanitizeBytes(buf.Bytes())), nil
+	}
+	return template.HTML(buf.String()), nil
+}
+
+// splitFrontMatter splits b into its front matter and body. format is "toml",
+// "yaml" or empty if there is no front matter.
+func splitFrontMatter(b []byte) (format string, frontMatter, body []byte) {
+	b = bytes.TrimPrefix(b, []byte("\xef\xbb\xbf"))
+	for _, delim := range []struct {
+		format string
+		line   string
+	}{
+		{"toml", "+++"},
+		{"yaml", "---"},
+	} {
+		rest, ok := trimLine(b, delim.line)
+		if !ok {
+			continue
+		}
+		for i := 0; i < len(rest); {
+			end := bytes.IndexByte(rest[i:], '\n')
+			if end < 0 {
+				end = len(rest) - i
+			}
+			line := bytes.TrimRight(rest[i:i+end], "\r")
+			if string(line) == delim.line {
+				next := i + end + 1
+				if next > len(rest) {
+					next = len(rest)
+				}
+				return delim.format, rest[:i], rest[next:]
+			}
+			i += end + 1
+		}
+	}
+	return "", nil, b
+}
+
+// trimLine trims the line from the start of b, reporting whether b started
+// with that line.
+func trimLine(b []byte, line string) ([]byte, bool) {
+	if !bytes.HasPrefix(b, []byte(line)) {
+		return b, false
+	}
+	rest := b[len(line):]
+	switch {
+	case bytes.HasPrefix(rest, []byte("\r\n")):
+		return rest[2:], true
+	case bytes.HasPrefix(rest, []byte("\n")):
+		return rest[1:], true
+	}
+	return b, false
+}
+
+// normalizeYAML converts the map[interface{}]interface{} values produced by
+// yaml.v2 into map[string]interface{}, so that they behave the same as TOML
+// front matter inside templates.
+func normalizeYAML(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{})
+		for k, v := range value {
+			m[fmt.Sprint(k)] = normalizeYAML(v)
+		}
+		return m
+	case []interface{}:
+		for i, v := range value {
+			value[i] = normalizeYAML(v)
+		}
+		return value
+	default:
+		return value
+	}
+}
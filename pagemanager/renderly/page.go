@@ -1,6 +1,7 @@
 package renderly
 
 import (
+	"bytes"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
@@ -9,10 +10,9 @@ import (
 	"io"
 	"io/fs"
 	"net/http"
+	"path"
 	"path/filepath"
-	"regexp"
 	"strings"
-	"text/template/parse"
 
 	"github.com/bokwoon95/weblog/pagemanager/erro"
 	"github.com/oxtoacart/bpool"
@@ -23,9 +23,13 @@ type Page struct {
 	html      *template.Template
 	css       []*Asset
 	js        []*Asset
-	prehooks  []Prehook
-	posthooks []Posthook
+	prehooks  []prehook
+	posthooks []posthook
 	config    map[string]string
+	markdown  []*Markdown
+	stream    bool
+	nonce     bool
+	deps      DependencyGraph
 }
 
 func (ry *Renderly) Lookup(filenames ...string) (Page, error) {
@@ -44,61 +48,98 @@ func (ry *Renderly) Lookup(filenames ...string) (Page, error) {
 	}
 	var err error
 	// Else construct the page from scratch
+	ry.mu.RLock()
+	hookgen := ry.hookgen
 	page := Page{
 		bufpool:   ry.bufpool,
-		css:       ry.css[""],       // global css assets
-		js:        ry.js[""],        // global js assets
-		prehooks:  ry.prehooks[""],  // global prehooks
-		posthooks: ry.posthooks[""], // global posthooks
-	}
+		css:       ry.css[""],                                   // global css assets
+		js:        ry.js[""],                                    // global js assets
+		prehooks:  append([]prehook(nil), ry.prehooks[""]...),   // global prehooks
+		posthooks: append([]posthook(nil), ry.posthooks[""]...), // global posthooks
+		stream:    ry.stream,
+		nonce:     ry.nonce,
+	}
+	ry.mu.RUnlock()
 	// Clone the page template from the base template
 	page.html, err = ry.html.Clone()
 	if err != nil {
 		return page, err
 	}
-	page.html = page.html.Option(ry.opts...)
-	HTML, CSS, JS := categorize(filenames)
+	page.html = page.html.Option(ry.opts...).Funcs(ry.funcs)
+	HTML, CSS, JS, MD := categorize(filenames)
 	if len(HTML) == 0 {
 		return Page{}, fmt.Errorf("no html files were passed in")
 	}
-	// Add user-specified HTML templates to the page template
-	for _, filename := range HTML {
-		var t *template.Template
-		// If the template is already cached for the given filename, use that template
-		if ry.cacheenabled {
-			ry.mu.RLock()
-			t = ry.cachehtml[filename]
-			ry.mu.RUnlock()
+	// Parse the user-specified HTML templates
+	templates := make([]*template.Template, len(HTML))
+	for i, filename := range HTML {
+		templates[i], err = ry.parseFile(filename)
+		if err != nil {
+			return page, err
 		}
-		// Else construct the template from scratch
-		if t == nil {
-			b, err := ry.ReadFile(filename)
-			if err != nil {
-				return page, err
-			}
-			t, err = template.New(filename).Funcs(ry.funcs).Option(ry.opts...).Parse(string(b))
-			if err != nil {
-				return page, err
-			}
-			// Cache the template if the user enabled it
-			if ry.cacheenabled {
-				ry.mu.Lock()
-				ry.cachehtml[filename] = t
-				ry.mu.Unlock()
-			}
+	}
+	// Resolve the chain of layouts extended by the main HTML template (if any)
+	chain, err := ry.layoutChain(templates[0])
+	if err != nil {
+		return page, err
+	}
+	err = checkBlocks(chain, templates)
+	if err != nil {
+		return page, err
+	}
+	// Add the layouts to the page template starting from the root layout,
+	// followed by the user-specified HTML templates. Templates added later
+	// replace templates of the same name, which is how blocks are overridden.
+	for i := len(chain) - 1; i >= 0; i-- {
+		err = addParseTree(page.html, chain[i], chain[i].Name())
+		if err != nil {
+			return page, err
 		}
-		// Add to page template
-		err := addParseTree(page.html, t, t.Name())
+	}
+	for _, t := range templates {
+		err = addParseTree(page.html, t, t.Name())
 		if err != nil {
 			return page, err
 		}
 	}
-	page.html = page.html.Lookup(HTML[0])
+	// If the main HTML template extends a layout, the root layout becomes the
+	// entry point of the page
+	entry := HTML[0]
+	if len(chain) > 0 {
+		entry = chain[len(chain)-1].Name()
+	}
+	page.html = page.html.Lookup(entry)
 	if page.html == nil {
-		return page, erro.Wrap(fmt.Errorf(`no template found for name "%s"`, HTML[0]))
+		return page, erro.Wrap(fmt.Errorf(`no template found for name "%s"`, entry))
 	}
 	// Find the list of dependency templates invoked by the main HTML template
-	depedencies, err := listAllDeps(page.html, HTML[0])
+	page.deps, err = buildGraph(page.html, entry, ry.callers)
+	if err != nil {
+		if len(chain) > 0 {
+			return page, fmt.Errorf("layout %s: %w", layoutNames(append([]*template.Template{templates[0]}, chain...)), err)
+		}
+		return page, err
+	}
+	// The templates in the layout chain below the root layout are never
+	// invoked by name, so they have to be added to the dependencies explicitly
+	// in order for their CSS/JS/Prehooks/Posthooks to be included
+	for i := len(chain) - 2; i >= 0; i-- {
+		page.deps.Dependencies = append(page.deps.Dependencies, Dependency{
+			Name:   chain[i].Name(),
+			Parent: chain[i+1].Name(),
+			Via:    "extends",
+		})
+	}
+	if len(chain) > 0 {
+		page.deps.Dependencies = append(page.deps.Dependencies, Dependency{
+			Name:   HTML[0],
+			Parent: chain[0].Name(),
+			Via:    "extends",
+		})
+	}
+	// Check every component call made by the page (including the layouts it
+	// extends) and bind the component function to the page template
+	err = bindComponents(page.html, page.bufpool, page.deps)
 	if err != nil {
 		return page, err
 	}
@@ -108,28 +149,35 @@ func (ry *Renderly) Lookup(filenames ...string) (Page, error) {
 	// we do not include the same asset twice.
 	cssset := make(map[[32]byte]struct{})
 	jsset := make(map[[32]byte]struct{})
-	for _, templateName := range depedencies {
+	ry.mu.RLock()
+	for i := range page.deps.Dependencies {
+		dep := &page.deps.Dependencies[i]
 		// css
-		for _, asset := range ry.css[templateName] {
+		for _, asset := range ry.css[dep.Name] {
 			if _, ok := cssset[asset.Hash]; ok {
 				continue
 			}
 			cssset[asset.Hash] = struct{}{}
 			page.css = append(page.css, asset)
+			dep.CSS = append(dep.CSS, asset)
 		}
 		// js
-		for _, asset := range ry.js[templateName] {
+		for _, asset := range ry.js[dep.Name] {
 			if _, ok := jsset[asset.Hash]; ok {
 				continue
 			}
 			jsset[asset.Hash] = struct{}{}
 			page.js = append(page.js, asset)
+			dep.JS = append(dep.JS, asset)
 		}
 		// prehooks
-		page.prehooks = append(page.prehooks, ry.prehooks[templateName]...)
+		page.prehooks = append(page.prehooks, ry.prehooks[dep.Name]...)
+		dep.Prehooks = len(ry.prehooks[dep.Name])
 		// posthooks
-		page.posthooks = append(page.posthooks, ry.posthooks[templateName]...)
+		page.posthooks = append(page.posthooks, ry.posthooks[dep.Name]...)
+		dep.Posthooks = len(ry.posthooks[dep.Name])
 	}
+	ry.mu.RUnlock()
 	// Add the user-specified CSS files to the page
 	for _, filename := range CSS {
 		var asset *Asset
@@ -157,10 +205,13 @@ func (ry *Renderly) Lookup(filenames ...string) (Page, error) {
 			}
 		}
 		// Add CSS asset to page if it hasn't already been added
+		dep := Dependency{Name: filename, Via: "file"}
 		if _, ok := cssset[asset.Hash]; !ok {
 			cssset[asset.Hash] = struct{}{}
 			page.css = append(page.css, asset)
+			dep.CSS = append(dep.CSS, asset)
 		}
+		page.deps.Dependencies = append(page.deps.Dependencies, dep)
 	}
 	// Add the user-specified JS files to the page
 	for _, filename := range JS {
@@ -189,209 +240,285 @@ func (ry *Renderly) Lookup(filenames ...string) (Page, error) {
 			}
 		}
 		// Add JS asset to page if it hasn't already been added
+		dep := Dependency{Name: filename, Via: "file"}
 		if _, ok := jsset[asset.Hash]; !ok {
 			jsset[asset.Hash] = struct{}{}
 			page.js = append(page.js, asset)
+			dep.JS = append(dep.JS, asset)
+		}
+		page.deps.Dependencies = append(page.deps.Dependencies, dep)
+	}
+	// Add the user-specified markdown files to the page
+	for _, filename := range MD {
+		md, err := ry.parseMarkdownFile(filename)
+		if err != nil {
+			return page, err
 		}
+		page.markdown = append(page.markdown, md)
+		page.deps.Dependencies = append(page.deps.Dependencies, Dependency{Name: filename, Via: "file"})
 	}
-	// Cache the page if the user enabled it
+	// Cache the page if the user enabled it, unless the hooks changed while
+	// the page was being constructed
 	if ry.cacheenabled {
 		ry.mu.Lock()
-		ry.cachepage[fullname] = page
+		if ry.hookgen == hookgen {
+			ry.cachepage[fullname] = page
+		}
 		ry.mu.Unlock()
 	}
 	return page, nil
 }
 
-var r1 = regexp.MustCompile(`(?:;|^)\s*(?:frame-ancestors|report-uri|sandbox)[^;]*\s*`)
-
 func (page Page) Render(w io.Writer, r *http.Request, data interface{}) error {
 	if page.bufpool == nil || page.html == nil {
 		return fmt.Errorf("tried to render an empty page")
 	}
 	var err error
-	for _, fn := range page.prehooks {
-		data, err = fn(w, r, data)
+	if r == nil {
+		// Hooks always get a request to read the HookInfo from
+		r, err = http.NewRequest("GET", "/", nil)
 		if err != nil {
 			return err
 		}
 	}
+	data, err = page.runPrehooks(w, r, data)
+	if err != nil {
+		return err
+	}
 	if data == nil {
 		data = make(map[string]interface{})
 	}
 	if mapdata, ok := data.(map[string]interface{}); ok {
+		// The CSP of the request is only written to the header if w is a
+		// http.ResponseWriter
+		csp := ParseCSP("")
+		rw, isResponseWriter := w.(http.ResponseWriter)
+		if isResponseWriter {
+			csp = requestCSP(rw, r)
+		}
+		var nonce string
+		if noNonce, _ := r.Context().Value(noNonceKey{}).(bool); page.nonce && !noNonce {
+			nonce, err = newNonce()
+			if err != nil {
+				return err
+			}
+			allowInline(csp, "script", "'nonce-"+nonce+"'")
+			allowInline(csp, "style", "'nonce-"+nonce+"'")
+			mapdata["__nonce__"] = nonce
+		}
 		if len(page.css) > 0 {
-			mapdata["__css__"] = page.CSS(w)
+			mapdata["__css__"] = inlineAssets(csp, "style", page.css, nonce)
 		}
 		if len(page.js) > 0 {
-			mapdata["__js__"] = page.JS(w)
+			mapdata["__js__"] = inlineAssets(csp, "script", page.js, nonce)
 		}
-		if w, ok := w.(http.ResponseWriter); ok {
+		// The first markdown file is the page's content, the rest are
+		// snippets that are referenced by their filename
+		for i, md := range page.markdown {
+			if i > 0 {
+				mapdata[path.Base(md.Name)] = md.HTML
+				continue
+			}
+			mapdata["__content__"] = md.HTML
+			for k, v := range md.FrontMatter {
+				if _, ok := mapdata[k]; !ok {
+					mapdata[k] = v
+				}
+			}
+		}
+		if isResponseWriter {
 			// this must be computed -AFTER- making the necessary changes to the
-			// CSP header! So that it will reflect the latest version of CSP.
-			if CSP := w.Header().Get("Content-Security-Policy"); CSP != "" {
-				CSP = r1.ReplaceAllString(CSP, "") // not sure if this is worth doing but ok
-				mapdata["__Content_Security_Policy__"] = template.HTML(fmt.Sprintf(`<meta http-equiv="Content-Security-Policy" content="%s">`, CSP))
+			// CSP! So that it will reflect the latest version of CSP.
+			if policy := csp.String(); policy != "" {
+				rw.Header().Set("Content-Security-Policy", policy)
+				// These directives are not supported in a <meta> element
+				meta := csp.Clone()
+				for _, directive := range []string{"frame-ancestors", "report-uri", "sandbox"} {
+					meta.Delete(directive)
+				}
+				mapdata["__Content_Security_Policy__"] = template.HTML(fmt.Sprintf(`<meta http-equiv="Content-Security-Policy" content="%s">`, template.HTMLEscapeString(meta.String())))
 			}
 		} else {
 			mapdata["__Content_Security_Policy__"] = template.HTML(`<meta http-equiv="Content-Security-Policy" content="">`)
 		}
 		data = mapdata
 	}
-	err = executeTemplate(page.html, page.bufpool, w, page.html.Name(), data)
+	if page.stream {
+		err = streamTemplate(page.html, page.bufpool, w, page.html.Name(), data)
+	} else {
+		err = executeTemplate(page.html, page.bufpool, w, page.html.Name(), data)
+	}
 	if err != nil {
 		return err
 	}
-	for _, fn := range page.posthooks {
-		err = fn(w, r)
-		if err != nil {
-			return err
-		}
-	}
+	page.runPosthooks(w, r)
 	return nil
 }
 
-func (page Page) Nonce(w http.ResponseWriter) (template.HTMLAttr, error) {
-	arr := make([]byte, 32)
-	_, err := rand.Read(arr)
-	if err != nil {
-		return "", err
+// Name returns the name of the page's entry template.
+func (page Page) Name() string {
+	if page.html == nil {
+		return ""
 	}
-	nonce := base64.StdEncoding.EncodeToString(arr)
-	_ = appendCSP(w, "style-src-elem", `'nonce-`+nonce+`'`)
-	_ = appendCSP(w, "script-src-elem", `'nonce-`+nonce+`'`)
-	return template.HTMLAttr(`nonce="` + nonce + `"`), nil
+	return page.html.Name()
+}
+
+// CSS returns the page's CSS assets as inline <style> tags, and allows their
+// hashes in the style-src of csp (if csp is not nil).
+func (page Page) CSS(csp *CSP) template.HTML {
+	return inlineAssets(csp, "style", page.css, "")
 }
 
-func (page Page) CSS(w io.Writer) template.HTML {
-	// Generate Content-Security-Policy script-src
-	styles := &strings.Builder{}
-	styleHashes := &strings.Builder{}
-	for i, asset := range page.css {
+// JS returns the page's JS assets as inline <script> tags, and allows their
+// hashes in the script-src of csp (if csp is not nil).
+func (page Page) JS(csp *CSP) template.HTML {
+	return inlineAssets(csp, "script", page.js, "")
+}
+
+// inlineAssets wraps each asset in a tag (either "style" or "script"). If
+// nonce is empty, the hash of every asset is allowed in csp. Otherwise the
+// tags carry the nonce, which is expected to be allowed in csp already.
+func inlineAssets(csp *CSP, tag string, assets []*Asset, nonce string) template.HTML {
+	tags := &strings.Builder{}
+	var hashes []string
+	for i, asset := range assets {
 		if i > 0 {
-			styles.WriteString("\n")
-			styleHashes.WriteString(" ")
+			tags.WriteString("\n")
 		}
-		styles.WriteString("<style>")
-		styles.WriteString(asset.Data)
-		styles.WriteString("</style>")
-		styleHashes.WriteString("'sha256-")
-		styleHashes.WriteString(base64.StdEncoding.EncodeToString(asset.Hash[0:]))
-		styleHashes.WriteString("'")
-	}
-	if styleHashes.Len() > 0 {
-		if w, ok := w.(http.ResponseWriter); ok {
-			_ = appendCSP(w, "style-src", styleHashes.String())
+		tags.WriteString("<" + tag)
+		if nonce != "" {
+			tags.WriteString(` nonce="` + nonce + `"`)
 		}
+		tags.WriteString(">")
+		tags.WriteString(asset.Data)
+		tags.WriteString("</" + tag + ">")
+		hashes = append(hashes, "'sha256-"+base64.StdEncoding.EncodeToString(asset.Hash[0:])+"'")
+	}
+	if csp != nil && nonce == "" && len(hashes) > 0 {
+		allowInline(csp, tag, hashes...)
 	}
-	return template.HTML(styles.String())
+	return template.HTML(tags.String())
 }
 
-func (page Page) JS(w io.Writer) template.HTML {
-	// Generate Content-Security-Policy script-src
-	scripts := &strings.Builder{}
-	scriptHashes := &strings.Builder{}
-	for i, asset := range page.js {
-		if i > 0 {
-			scripts.WriteString("\n")
-			scriptHashes.WriteString(" ")
-		}
-		scripts.WriteString("<script>")
-		scripts.WriteString(asset.Data)
-		scripts.WriteString("</script>")
-		scriptHashes.WriteString("'sha256-")
-		scriptHashes.WriteString(base64.StdEncoding.EncodeToString(asset.Hash[0:]))
-		scriptHashes.WriteString("'")
-	}
-	if scriptHashes.Len() > 0 {
-		if w, ok := w.(http.ResponseWriter); ok {
-			_ = appendCSP(w, "script-src", scriptHashes.String())
-		}
+// newNonce generates a random nonce.
+func newNonce() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
 	}
-	return template.HTML(scripts.String())
+	// URL-safe base64 so that html/template does not escape the nonce when
+	// it is written into an attribute
+	return base64.RawURLEncoding.EncodeToString(b), nil
 }
 
-func listAllDeps(t *template.Template, name string) ([]string, error) {
-	t = t.Lookup(name) // set the main template to `name`
-	if t == nil {
-		return nil, fmt.Errorf(`no such template "%s"`, name)
-	}
-	var allnames = []string{t.Name()}
-	var set = make(map[string]struct{})
-	var root parse.Node = t.Tree.Root
-	var roots []parse.Node
-	for {
-		names := listDeps(root)
-		for _, name := range names {
-			if _, ok := set[name]; ok {
-				continue
-			}
-			set[name] = struct{}{}
-			allnames = append(allnames, name)
-			t = t.Lookup(name)
-			if t == nil {
-				return allnames, fmt.Errorf(`{{ template "%s" }} was referenced, but was not found`, name)
-			}
-			roots = append(roots, t.Tree.Root)
-		}
-		if len(roots) == 0 {
-			break
-		}
-		root, roots = roots[0], roots[1:]
+func executeTemplate(t *template.Template, bufpool *bpool.BufferPool, w io.Writer, name string, data interface{}) error {
+	tempbuf := bufpool.Get()
+	defer bufpool.Put(tempbuf)
+	err := t.ExecuteTemplate(tempbuf, name, data)
+	if err != nil {
+		return err
 	}
-	return allnames, nil
+	_, err = tempbuf.WriteTo(w)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// StreamError is returned by Render in streaming mode when a template fails
+// after the <head> has already been flushed to the client. At that point the
+// response status and the <head> are committed, so the caller can no longer
+// respond with an error page. Whatever was rendered after the <head> is
+// discarded, leaving the client with a truncated document: it is up to the
+// caller whether to append an error message or simply log the error.
+type StreamError struct {
+	Err error
 }
 
-func listDeps(node parse.Node) []string {
-	var names []string
-	switch node := node.(type) {
-	case *parse.TemplateNode:
-		names = append(names, node.Name)
-	case *parse.ListNode:
-		for _, n := range node.Nodes {
-			names = append(names, listDeps(n)...)
+func (e *StreamError) Error() string {
+	return "renderly: error after flushing <head>: " + e.Err.Error()
+}
+
+func (e *StreamError) Unwrap() error {
+	return e.Err
+}
+
+var headEnd = []byte("</head>")
+
+// headWriter buffers template output until the closing </head> tag is seen,
+// at which point everything up to and including the tag is written out and
+// flushed. Everything after the tag is buffered until the template finishes
+// executing.
+type headWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+	buf     *bytes.Buffer
+	flushed bool
+}
+
+// indexHeadEnd returns the index of the first headEnd in b, in any case, or
+// -1 if there is none. Only ASCII letters are folded, so unlike an index into
+// bytes.ToLower(b) (which can change the length of non-ASCII text) the index
+// is always an offset into b.
+func indexHeadEnd(b []byte) int {
+	for i := 0; i+len(headEnd) <= len(b); i++ {
+		if b[i] == '<' && bytes.EqualFold(b[i:i+len(headEnd)], headEnd) {
+			return i
 		}
 	}
-	return names
+	return -1
 }
 
-func appendCSP(w http.ResponseWriter, policy, value string) error {
-	const key = "Content-Security-Policy"
-	CSP := w.Header().Get(key)
-	if CSP == "" {
-		w.Header().Set(key, policy+" "+value)
-		return nil
-	}
-	CSP = strings.ReplaceAll(CSP, "\n", " ") // newlines screw up the regex matching, remove them
-	re, err := regexp.Compile(`(.*` + policy + `[^;]*)(;|$)(.*)`)
+func (hw *headWriter) Write(p []byte) (n int, err error) {
+	// Only the last len(headEnd)-1 bytes of the previous buffer need to be
+	// searched again, in case the tag straddles two writes
+	start := hw.buf.Len() - len(headEnd) + 1
+	if start < 0 {
+		start = 0
+	}
+	n, _ = hw.buf.Write(p)
+	if hw.flushed {
+		return n, nil
+	}
+	i := indexHeadEnd(hw.buf.Bytes()[start:])
+	if i < 0 {
+		return n, nil
+	}
+	_, err = hw.w.Write(hw.buf.Next(start + i + len(headEnd)))
 	if err != nil {
-		return err
+		return n, err
 	}
-	matches := re.FindStringSubmatch(CSP)
-	if len(matches) == 0 {
-		w.Header().Set(key, CSP+"; "+policy+" "+value)
-		return nil
-	}
-	newCSP := matches[1] + " " + value + matches[2] + matches[3]
-	w.Header().Set("Content-Security-Policy", newCSP)
-	return nil
+	hw.flusher.Flush()
+	hw.flushed = true
+	return n, nil
 }
 
-func executeTemplate(t *template.Template, bufpool *bpool.BufferPool, w io.Writer, name string, data interface{}) error {
-	tempbuf := bufpool.Get()
-	defer bufpool.Put(tempbuf)
-	err := t.ExecuteTemplate(tempbuf, name, data)
+// streamTemplate is like executeTemplate, except that it flushes the <head>
+// of the page as soon as it is rendered. If w does not implement http.Flusher,
+// streamTemplate falls back to executeTemplate.
+func streamTemplate(t *template.Template, bufpool *bpool.BufferPool, w io.Writer, name string, data interface{}) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return executeTemplate(t, bufpool, w, name, data)
+	}
+	hw := &headWriter{w: w, flusher: flusher, buf: bufpool.Get()}
+	defer bufpool.Put(hw.buf)
+	err := t.ExecuteTemplate(hw, name, data)
 	if err != nil {
+		if hw.flushed {
+			return &StreamError{Err: err}
+		}
 		return err
 	}
-	_, err = tempbuf.WriteTo(w)
+	_, err = hw.buf.WriteTo(w)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func categorize(names []string) (html, css, js []string) {
+func categorize(names []string) (html, css, js, md []string) {
 	for _, name := range names {
 		truncatedName := name
 		// if i := strings.IndexRune(name, '?'); i > 0 {
@@ -403,11 +530,13 @@ func categorize(names []string) (html, css, js []string) {
 			css = append(css, name)
 		case ".js":
 			js = append(js, name)
+		case ".md":
+			md = append(md, name)
 		default:
 			html = append(html, name)
 		}
 	}
-	return html, css, js
+	return html, css, js, md
 }
 
 func addParseTree(parent, child *template.Template, childName string) error {
@@ -467,37 +596,23 @@ func (ry *Renderly) ReadFile(filename string) ([]byte, error) {
 	}
 }
 
-func (ry *Renderly) Resolve(name string) (fs.FS, string) {
-	var fsys = ry.fs
-	if name != "" && name[0] == '~' {
-		i := strings.IndexRune(name, '/')
-		if i > 0 {
-			fsName := name[1:i]
-			altfs := ry.altfs[fsName]
-			if altfs != nil {
-				fsys = altfs
-			}
-		}
-		name = name[i+1:]
-	}
-	return fsys, name
-}
-
 // Open implements fs.FS, which can be converted to a http.Filesystem using http.FS
 func (ry *Renderly) Open(name string) (fs.File, error) {
-	var fsys = ry.fs
-	if name != "" && name[0] == '~' {
-		i := strings.IndexRune(name, '/')
-		if i > 0 {
-			fsName := name[1:i]
-			altfs := ry.altfs[fsName]
-			if altfs != nil {
-				fsys = altfs
-			}
-		}
-		name = name[i+1:]
+	return ry.fs.Open(name)
+}
+
+// Which returns the name of the layer that serves the file identified by name
+// (see Layers). If the renderly has no layers, every file is served by the
+// "base" layer.
+func (ry *Renderly) Which(name string) (string, error) {
+	if lfs, ok := ry.fs.(*LayeredFS); ok {
+		return lfs.Which(name)
+	}
+	_, err := fs.Stat(ry.fs, name)
+	if err != nil {
+		return "", err
 	}
-	return fsys.Open(name)
+	return "base", nil
 }
 
 func (ry *Renderly) FileServer() http.Handler {
@@ -12,6 +12,7 @@ import (
 	"sync"
 
 	"github.com/bokwoon95/weblog/pagemanager/erro"
+	"github.com/microcosm-cc/bluemonday"
 	"github.com/oxtoacart/bpool"
 )
 
@@ -19,21 +20,28 @@ type Renderly struct {
 	mu      *sync.RWMutex
 	bufpool *bpool.BufferPool
 	fs      fs.FS
-	altfs   map[string]fs.FS
 	funcs   map[string]interface{}
+	callers map[string]struct{}
 	opts    []string
+	// markdown
+	mdpolicy *bluemonday.Policy
 	// plugin
 	html      *template.Template
 	css       map[string][]*Asset
 	js        map[string][]*Asset
-	prehooks  map[string][]Prehook
-	posthooks map[string][]Posthook
+	prehooks  map[string][]prehook
+	posthooks map[string][]posthook
+	hookgen   int // incremented whenever the hooks change
+	// rendering
+	stream bool
+	nonce  bool
 	// fs cache
 	cacheenabled bool
 	cachepage    map[string]Page
 	cachehtml    map[string]*template.Template
 	cachecss     map[string]*Asset
 	cachejs      map[string]*Asset
+	cachemd      map[string]*Markdown
 	//
 	errorhandler func(http.ResponseWriter, *http.Request, error)
 }
@@ -44,29 +52,32 @@ type Asset struct {
 	External bool
 }
 
-type Prehook func(w io.Writer, r *http.Request, input interface{}) (output interface{}, err error)
-
-type Posthook func(io.Writer, *http.Request) error
-
 func New(fsys fs.FS, opts ...Option) (*Renderly, error) {
 	ry := &Renderly{
 		mu:      &sync.RWMutex{},
 		fs:      fsys,
-		altfs:   make(map[string]fs.FS),
 		bufpool: bpool.NewBufferPool(64),
 		funcs:   make(map[string]interface{}),
+		callers: make(map[string]struct{}),
 		// plugin
 		html:      template.New(""),
 		css:       make(map[string][]*Asset),
 		js:        make(map[string][]*Asset),
-		prehooks:  make(map[string][]Prehook),
-		posthooks: make(map[string][]Posthook),
+		prehooks:  make(map[string][]prehook),
+		posthooks: make(map[string][]posthook),
 		// fs cache
 		cachepage: make(map[string]Page),
 		cachehtml: make(map[string]*template.Template),
 		cachecss:  make(map[string]*Asset),
 		cachejs:   make(map[string]*Asset),
+		cachemd:   make(map[string]*Markdown),
+		// markdown
+		mdpolicy: markdownPolicy(),
 	}
+	ry.funcs["extends"] = fnExtends
+	ry.funcs["params"] = fnParams
+	ry.funcs["component"] = fnComponent
+	ry.callers["component"] = struct{}{}
 	var err error
 	for _, opt := range opts {
 		err = opt(ry)
@@ -113,6 +124,21 @@ func TemplateFuncs(funcmaps ...map[string]interface{}) Option {
 	}
 }
 
+// TemplateCallers marks the template functions with the given names as
+// functions that take a template name as their first argument and execute that
+// template. Lookup follows calls to these functions the same way it follows {{
+// template }} actions, so that the CSS/JS/Prehooks/Posthooks of the called
+// template get included in the page. Calls whose template name is not a string
+// constant are reported as a DynamicReference in the page's DependencyGraph.
+func TemplateCallers(names ...string) Option {
+	return func(ry *Renderly) error {
+		for _, name := range names {
+			ry.callers[name] = struct{}{}
+		}
+		return nil
+	}
+}
+
 func TemplateOpts(option ...string) Option {
 	return func(ry *Renderly) error {
 		ry.opts = option
@@ -175,9 +201,50 @@ func GlobalTemplates(fsys fs.FS, filenames ...string) Option {
 	}
 }
 
-func AltFS(name string, fsys fs.FS) Option {
+// Cache enables caching of pages, templates, CSS/JS assets and markdown, so
+// that files are only read and parsed the first time they are looked up.
+// Pages are evicted from the cache whenever the hooks they depend on change.
+func Cache(enable bool) Option {
 	return func(ry *Renderly) error {
-		ry.altfs[name] = fsys
+		ry.cacheenabled = enable
+		return nil
+	}
+}
+
+// Nonce enables the nonce-based Content-Security-Policy mode. By default the
+// CSS/JS assets of a page are allowed by the CSP through their sha256 hashes,
+// which leaves any other inline <script> or <style> in a template blocked.
+// In nonce mode Render generates a new nonce for every render, appends it to
+// the script-src and style-src of the CSP header, puts it on the generated
+// <script> and <style> tags and exposes it to templates as __nonce__:
+//
+//	<script nonce="{{ .__nonce__ }}">console.log("allowed")</script>
+func Nonce(enable bool) Option {
+	return func(ry *Renderly) error {
+		ry.nonce = enable
+		return nil
+	}
+}
+
+// Stream enables streaming mode: instead of buffering the entire page before
+// writing it out, Render flushes everything up to and including the closing
+// </head> tag as soon as it has been rendered (provided the writer implements
+// http.Flusher). This lets the browser start fetching stylesheets and fonts
+// while the rest of the page is still being rendered. See StreamError for what
+// happens if a template fails after the <head> has been flushed.
+func Stream(enable bool) Option {
+	return func(ry *Renderly) error {
+		ry.stream = enable
+		return nil
+	}
+}
+
+// Layers stacks the layers (ordered from highest to lowest) on top of the
+// filesystem passed to New, which becomes the lowest layer and is named
+// "base". Files are read from the highest layer that has them, see LayeredFS.
+func Layers(layers ...Layer) Option {
+	return func(ry *Renderly) error {
+		ry.fs = NewLayeredFS(append(layers, Layer{Name: "base", FS: ry.fs})...)
 		return nil
 	}
 }
@@ -219,12 +286,20 @@ func Plugins(plugins ...Plugin) Option {
 			}
 			ry.css[name] = append(ry.css[name], plugin.CSS...)
 			ry.js[name] = append(ry.js[name], plugin.JS...)
-			ry.prehooks[name] = append(ry.prehooks[name], plugin.Prehooks...)
-			ry.posthooks[name] = append(ry.posthooks[name], plugin.Posthooks...)
 			ry.css[""] = append(ry.css[""], plugin.GlobalCSS...)
 			ry.js[""] = append(ry.js[""], plugin.GlobalJS...)
-			ry.prehooks[""] = append(ry.prehooks[""], plugin.GlobalPrehooks...)
-			ry.posthooks[""] = append(ry.posthooks[""], plugin.GlobalPosthooks...)
+			for _, fn := range plugin.Prehooks {
+				ry.AddPrehook(name, "", fn)
+			}
+			for _, fn := range plugin.Posthooks {
+				ry.AddPosthook(name, "", fn)
+			}
+			for _, fn := range plugin.GlobalPrehooks {
+				ry.AddPrehook("", "", fn)
+			}
+			for _, fn := range plugin.GlobalPosthooks {
+				ry.AddPosthook("", "", fn)
+			}
 		}
 		return nil
 	}
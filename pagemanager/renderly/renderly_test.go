@@ -0,0 +1,515 @@
+package renderly
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/matryer/is"
+)
+
+const streamPage = `<!DOCTYPE html>
+<html>
+<head>
+  {{ .__css__ }}
+  <title>{{ .title }}</title>
+</head>
+<body>
+  {{ range .posts }}<p>{{ . }}</p>{{ end }}
+  {{ if .fail }}{{ errorf "oops" }}{{ end }}
+</body>
+</html>`
+
+var streamFS = fstest.MapFS{
+	"index.html": {Data: []byte(streamPage)},
+	"style.css":  {Data: []byte("body { color: red; }")},
+}
+
+// flushRecorder records what had been written to the response at the moment
+// Flush was first called.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushedBody string
+}
+
+func (rec *flushRecorder) Flush() {
+	if rec.flushedBody == "" {
+		rec.flushedBody = rec.Body.String()
+	}
+	rec.ResponseRecorder.Flush()
+}
+
+func Test_Stream(t *testing.T) {
+	is := is.New(t)
+	ry, err := New(streamFS, TemplateFuncs(FuncMap()), Stream(true))
+	is.NoErr(err)
+	page, err := ry.Lookup("index.html", "style.css")
+	is.NoErr(err)
+
+	t.Run("head is flushed before the body", func(t *testing.T) {
+		is := is.New(t)
+		rec := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+		r := httptest.NewRequest("GET", "/", nil)
+		data := map[string]interface{}{"title": "hello", "posts": []string{"a", "b"}}
+		err := page.Render(rec, r, data)
+		is.NoErr(err)
+		is.True(strings.HasSuffix(rec.flushedBody, "</head>"))
+		is.True(strings.Contains(rec.flushedBody, "body { color: red; }"))
+		is.True(strings.Contains(rec.Body.String(), "<p>b</p>"))
+	})
+
+	t.Run("head end is found in any case after non-ASCII text", func(t *testing.T) {
+		is := is.New(t)
+		ry, err := New(fstest.MapFS{
+			"upper.html": {Data: []byte("<html><head><title>\u0130stanbul \xff</title></HEAD><body>{{ .title }}</body></html>")},
+		}, Stream(true))
+		is.NoErr(err)
+		page, err := ry.Lookup("upper.html")
+		is.NoErr(err)
+		rec := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+		err = page.Render(rec, httptest.NewRequest("GET", "/", nil), map[string]interface{}{"title": "hello"})
+		is.NoErr(err)
+		is.Equal(rec.flushedBody, "<html><head><title>\u0130stanbul \xff</title></HEAD>")
+		is.Equal(rec.Body.String(), "<html><head><title>\u0130stanbul \xff</title></HEAD><body>hello</body></html>")
+	})
+
+	t.Run("error after head returns StreamError", func(t *testing.T) {
+		is := is.New(t)
+		rec := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+		r := httptest.NewRequest("GET", "/", nil)
+		data := map[string]interface{}{"title": "hello", "posts": []string{"a"}, "fail": true}
+		err := page.Render(rec, r, data)
+		var streamErr *StreamError
+		is.True(errors.As(err, &streamErr))
+		is.True(strings.Contains(err.Error(), "oops"))
+		is.True(strings.HasSuffix(rec.Body.String(), "</head>")) // body is discarded
+	})
+
+	t.Run("writers without Flush are buffered", func(t *testing.T) {
+		is := is.New(t)
+		buf := &strings.Builder{}
+		data := map[string]interface{}{"title": "hello", "posts": []string{"a"}, "fail": true}
+		err := page.Render(buf, nil, data)
+		is.True(err != nil)
+		var streamErr *StreamError
+		is.True(!errors.As(err, &streamErr))
+		is.Equal(buf.String(), "")
+	})
+}
+
+func benchmarkRender(b *testing.B, stream bool) {
+	ry, err := New(streamFS, TemplateFuncs(FuncMap()), Stream(stream))
+	if err != nil {
+		b.Fatal(err)
+	}
+	page, err := ry.Lookup("index.html", "style.css")
+	if err != nil {
+		b.Fatal(err)
+	}
+	posts := make([]string, 1000)
+	for i := range posts {
+		posts[i] = fmt.Sprintf("post number %d", i)
+	}
+	data := map[string]interface{}{"title": "hello", "posts": posts}
+	r := httptest.NewRequest("GET", "/", nil)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rec := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+		err = page.Render(rec, r, data)
+		if err != nil {
+			b.Fatal(err)
+		}
+		_, _ = io.Copy(io.Discard, rec.Body)
+	}
+}
+
+func BenchmarkRender_Buffered(b *testing.B) { benchmarkRender(b, false) }
+
+func BenchmarkRender_Stream(b *testing.B) { benchmarkRender(b, true) }
+
+var layoutFS = fstest.MapFS{
+	"layouts/base.html": {Data: []byte(`<html><head>{{ .__css__ }}<title>{{ block "title" . }}Base{{ end }}</title></head>` +
+		`<body>{{ block "body" . }}base body{{ end }}</body></html>`)},
+	"layouts/section.html": {Data: []byte(`{{ extends "base.html" }}` +
+		`{{ define "title" }}Section{{ end }}` +
+		`{{ define "body" }}<nav>section</nav>{{ template "content" . }}{{ end }}`)},
+	"page.html": {Data: []byte(`{{ extends "layouts/section.html" }}` +
+		`{{ define "content" }}<p>{{ .msg }}</p>{{ end }}`)},
+	"nocontent.html":   {Data: []byte(`{{ extends "layouts/section.html" }}`)},
+	"duplicate.html":   {Data: []byte(`{{ define "content" }}Other{{ end }}`)},
+	"cycle1.html":      {Data: []byte(`{{ extends "cycle2.html" }}`)},
+	"cycle2.html":      {Data: []byte(`{{ extends "cycle1.html" }}`)},
+	"noparent.html":    {Data: []byte(`{{ extends "nonexistent.html" }}`)},
+	"layouts/page.css": {Data: []byte(`nav { color: blue; }`)},
+}
+
+func Test_Layouts(t *testing.T) {
+	is := is.New(t)
+	ry, err := New(layoutFS)
+	is.NoErr(err)
+
+	t.Run("multi-level chain", func(t *testing.T) {
+		is := is.New(t)
+		page, err := ry.Lookup("page.html", "layouts/page.css")
+		is.NoErr(err)
+		buf := &strings.Builder{}
+		err = page.Render(buf, nil, map[string]interface{}{"msg": "hello"})
+		is.NoErr(err)
+		is.True(strings.Contains(buf.String(), "<title>Section</title>"))
+		is.True(strings.Contains(buf.String(), "<nav>section</nav><p>hello</p>"))
+		is.True(strings.Contains(buf.String(), "nav { color: blue; }"))
+	})
+
+	t.Run("missing block", func(t *testing.T) {
+		is := is.New(t)
+		_, err := ry.Lookup("nocontent.html")
+		is.True(err != nil)
+		is.True(strings.Contains(err.Error(), `"content"`))
+		is.True(strings.Contains(err.Error(), "layouts/base.html → layouts/section.html → nocontent.html"))
+	})
+
+	t.Run("duplicate block", func(t *testing.T) {
+		is := is.New(t)
+		_, err := ry.Lookup("page.html", "duplicate.html")
+		is.True(err != nil)
+		is.True(strings.Contains(err.Error(), `block "content"`))
+	})
+
+	t.Run("cycle", func(t *testing.T) {
+		is := is.New(t)
+		_, err := ry.Lookup("cycle1.html")
+		is.True(err != nil)
+		is.True(strings.Contains(err.Error(), "cycle"))
+	})
+
+	t.Run("missing parent", func(t *testing.T) {
+		is := is.New(t)
+		_, err := ry.Lookup("noparent.html")
+		is.True(err != nil)
+		is.True(strings.Contains(err.Error(), `noparent.html: {{ extends "nonexistent.html" }}`))
+	})
+}
+
+func Test_Dependencies(t *testing.T) {
+	is := is.New(t)
+	plugin := func(name, body, css string) Plugin {
+		return Plugin{
+			HTML: template.Must(template.New(name).Funcs(map[string]interface{}{"include": fnSlice}).Parse(body)),
+			CSS:  []*Asset{{Data: css}},
+		}
+	}
+	fsys := fstest.MapFS{
+		"page.html": {Data: []byte(`{{ .__css__ }}` +
+			`{{ if .a }}{{ template "in-if" }}{{ else }}{{ template "in-else" }}{{ end }}` +
+			`{{ range .b }}{{ with . }}{{ template "in-with" }}{{ end }}{{ end }}` +
+			`{{ include "via-func" }}{{ include .name }}`)},
+	}
+	ry, err := New(fsys,
+		TemplateFuncs(map[string]interface{}{"include": fnSlice}),
+		TemplateCallers("include"),
+		Plugins(
+			plugin("in-if", `if`, `.in-if {}`),
+			plugin("in-else", `else`, `.in-else {}`),
+			plugin("in-with", `{{ block "nested" . }}nested{{ end }}`, `.in-with {}`),
+			plugin("via-func", `func`, `.via-func {}`),
+		),
+	)
+	is.NoErr(err)
+	graph, err := ry.Dependencies("page.html")
+	is.NoErr(err)
+	var names []string
+	var css []string
+	for _, dep := range graph.Dependencies {
+		names = append(names, dep.Name+" ("+dep.Via+")")
+		for _, asset := range dep.CSS {
+			css = append(css, asset.Data)
+		}
+	}
+	is.Equal(names, []string{
+		"page.html (entry)",
+		"in-if (template)",
+		"in-else (template)",
+		"in-with (template)",
+		"via-func (include)",
+		"nested (template)",
+	})
+	is.Equal(css, []string{".in-if {}", ".in-else {}", ".in-with {}", ".via-func {}"})
+	is.Equal(len(graph.Dynamic), 1)
+	is.Equal(graph.Dynamic[0].Via, "include")
+	is.Equal(graph.Dynamic[0].Location, "page.html:1:185")
+}
+
+func Test_Components(t *testing.T) {
+	is := is.New(t)
+	fsys := fstest.MapFS{
+		"card.html": {Data: []byte(`{{ params "title!" "size=medium" "count:int=3" "author.name" }}` +
+			`<div class="{{ .size }}">{{ .title }} ({{ .count }}) by {{ .author.name }}</div>`)},
+		"page.html":        {Data: []byte(`{{ component "card.html" "title" .title "author.name" "bob" }}`)},
+		"missing.html":     {Data: []byte(`{{ component "card.html" "author.name" "bob" }}`)},
+		"unknown.html":     {Data: []byte(`{{ component "card.html" "title" "x" "colour" "red" }}`)},
+		"wrongtype.html":   {Data: []byte(`{{ component "card.html" "title" "x" "count" "three" }}`)},
+		"dynamicname.html": {Data: []byte(`{{ component "card.html" "title" "x" .key "red" }}`)},
+		"base.html":        {Data: []byte(`<body>{{ block "body" . }}{{ end }}</body>`)},
+		"middle.html": {Data: []byte(`{{ extends "base.html" }}{{ component "card.html" "colour" "red" }}` +
+			`{{ define "body" }}{{ template "content" . }}{{ end }}`)},
+		"extendsmiddle.html": {Data: []byte(`{{ extends "middle.html" }}{{ define "content" }}content{{ end }}`)},
+	}
+	ry, err := New(fsys)
+	is.NoErr(err)
+
+	t.Run("render", func(t *testing.T) {
+		is := is.New(t)
+		page, err := ry.Lookup("page.html", "card.html")
+		is.NoErr(err)
+		buf := &strings.Builder{}
+		err = page.Render(buf, nil, map[string]interface{}{"title": "<hello>"})
+		is.NoErr(err)
+		is.Equal(buf.String(), `<div class="medium">&lt;hello&gt; (3) by bob</div>`)
+	})
+
+	t.Run("lookup time errors", func(t *testing.T) {
+		for name, msg := range map[string]string{
+			"missing.html":   `missing required parameter "title"`,
+			"unknown.html":   `unknown parameter "colour"`,
+			"wrongtype.html": `parameter "count" must be an int`,
+			// component calls in a layout between the page and the root
+			// layout are checked too
+			"extendsmiddle.html": `middle.html:1:`,
+		} {
+			is := is.New(t)
+			_, err := ry.Lookup(name, "card.html")
+			is.True(err != nil)
+			is.True(strings.Contains(err.Error(), msg))
+		}
+	})
+
+	t.Run("render time errors", func(t *testing.T) {
+		is := is.New(t)
+		page, err := ry.Lookup("dynamicname.html", "card.html")
+		is.NoErr(err)
+		err = page.Render(io.Discard, nil, map[string]interface{}{"key": "colour"})
+		is.True(err != nil)
+		is.True(strings.Contains(err.Error(), `unknown parameter "colour"`))
+	})
+}
+
+func Test_fnMap(t *testing.T) {
+	is := is.New(t)
+	m := fnMap("a", 1, fnSlice("b", "c"), 2, "d")
+	is.Equal(m, map[string]interface{}{
+		"a": 1,
+		"b": map[string]interface{}{"c": 2},
+	})
+}
+
+func Test_Markdown(t *testing.T) {
+	is := is.New(t)
+	fsys := fstest.MapFS{
+		"post.html": {Data: []byte(`<h1>{{ .title }}</h1>{{ range .tags }}#{{ . }}{{ end }}` +
+			`<main>{{ .__content__ }}</main><footer>{{ index . "footer.md" }}</footer>`)},
+		"post.md": {Data: []byte("+++\ntitle = \"Hello\"\ntags = [\"go\", \"web\"]\n+++\n" +
+			"A [link](https://example.com)[^1].\n\n| a |\n|---|\n| 1 |\n\n[^1]: A footnote.\n")},
+		"yaml.md":   {Data: []byte("---\ntitle: Hello YAML\nauthor:\n  name: bob\n---\nbody\n")},
+		"footer.md": {Data: []byte("*the end*\n")},
+	}
+	ry, err := New(fsys)
+	is.NoErr(err)
+
+	page, err := ry.Lookup("post.html", "post.md", "footer.md")
+	is.NoErr(err)
+	buf := &strings.Builder{}
+	err = page.Render(buf, nil, nil)
+	is.NoErr(err)
+	out := buf.String()
+	is.True(strings.Contains(out, "<h1>Hello</h1>#go#web"))
+	is.True(strings.Contains(out, `<a href="https://example.com" rel="nofollow">link</a>`)) // sanitized by the UGC policy
+	is.True(strings.Contains(out, "<td>1</td>"))
+	is.True(strings.Contains(out, "A footnote."))
+	is.True(strings.Contains(out, "<footer><p><em>the end</em></p>\n</footer>"))
+
+	md, err := ry.parseMarkdownFile("yaml.md")
+	is.NoErr(err)
+	is.Equal(md.FrontMatter["title"], "Hello YAML")
+	is.Equal(md.FrontMatter["author"], map[string]interface{}{"name": "bob"})
+	is.Equal(string(md.HTML), "<p>body</p>\n")
+}
+
+func Test_Highlighting(t *testing.T) {
+	is := is.New(t)
+	fsys := fstest.MapFS{
+		"post.html": {Data: []byte(`{{ template "highlight/monokai" }}{{ .__css__ }}{{ .__content__ }}`)},
+		"post.md": {Data: []byte("```go {linenos=table,hl_lines=[2]}\n" +
+			"package main\n\nfunc main() {}\n```\n")},
+	}
+	ry, err := New(fsys, HighlightStyles("monokai", "github"))
+	is.NoErr(err)
+	page, err := ry.Lookup("post.html", "post.md")
+	is.NoErr(err)
+	buf := &strings.Builder{}
+	err = page.Render(buf, nil, nil)
+	is.NoErr(err)
+	out := buf.String()
+	is.True(strings.Contains(out, `/* KeywordNamespace */ .chroma .kn { color: #f92672 }`)) // monokai CSS
+	is.True(strings.Contains(out, `<span class="kn">package</span>`))                       // class-based highlighting
+	is.True(strings.Contains(out, `<span class="lnt">1`))                                   // line numbers
+	is.True(strings.Contains(out, `<span class="hl">`))                                     // highlighted line
+	is.True(!strings.Contains(out, `style="`))
+
+	_, err = New(fsys, HighlightStyles("nonexistent"))
+	is.True(err != nil)
+}
+
+func Test_LayeredFS(t *testing.T) {
+	is := is.New(t)
+	upper := fstest.MapFS{
+		"theme/page.html": {Data: []byte("upper")},
+		"theme/new.css":   {Data: []byte("new")},
+	}
+	lower := fstest.MapFS{
+		"theme/page.html":  {Data: []byte("lower")},
+		"theme/style.css":  {Data: []byte("style")},
+		"other/index.html": {Data: []byte("index")},
+	}
+	fsys := NewLayeredFS(Layer{Name: "upper", FS: upper}, Layer{Name: "lower", FS: lower})
+	b, err := fs.ReadFile(fsys, "theme/page.html")
+	is.NoErr(err)
+	is.Equal(string(b), "upper") // upper layers override lower layers
+	b, err = fs.ReadFile(fsys, "theme/style.css")
+	is.NoErr(err)
+	is.Equal(string(b), "style")
+	_, err = fs.ReadFile(fsys, "theme/missing.css")
+	is.True(errors.Is(err, fs.ErrNotExist))
+	entries, err := fs.ReadDir(fsys, "theme")
+	is.NoErr(err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	is.Equal(names, []string{"new.css", "page.html", "style.css"})
+	is.NoErr(fstest.TestFS(fsys, "theme/page.html", "theme/new.css", "theme/style.css", "other/index.html"))
+	layer, err := fsys.Which("theme/page.html")
+	is.NoErr(err)
+	is.Equal(layer, "upper")
+	layer, err = fsys.Which("theme/style.css")
+	is.NoErr(err)
+	is.Equal(layer, "lower")
+	_, err = fsys.Which("theme/missing.css")
+	is.True(errors.Is(err, fs.ErrNotExist))
+
+	// The filesystem passed to New is the base layer
+	ry, err := New(lower, Layers(Layer{Name: "upper", FS: upper}))
+	is.NoErr(err)
+	layer, err = ry.Which("other/index.html")
+	is.NoErr(err)
+	is.Equal(layer, "base")
+	page, err := ry.Lookup("theme/page.html")
+	is.NoErr(err)
+	buf := &strings.Builder{}
+	is.NoErr(page.Render(buf, nil, nil))
+	is.Equal(buf.String(), "upper")
+}
+
+func Test_Hooks(t *testing.T) {
+	is := is.New(t)
+	fsys := fstest.MapFS{
+		"page.html":   {Data: []byte(`{{ template "widget.html" . }}`)},
+		"widget.html": {Data: []byte(`{{ .greeting }}`)},
+		"other.html":  {Data: []byte(`{{ .greeting }}`)},
+	}
+	ry, err := New(fsys, Cache(true))
+	is.NoErr(err)
+	render := func(filenames ...string) (string, http.Header) {
+		rec := httptest.NewRecorder()
+		err := ry.Page(rec, httptest.NewRequest("GET", "/", nil), map[string]interface{}{"greeting": "hello"}, filenames...)
+		is.NoErr(err)
+		return rec.Body.String(), rec.Header()
+	}
+	body, _ := render("page.html", "widget.html")
+	is.Equal(body, "hello")
+
+	// Registering a hook evicts the cached pages that depend on the template
+	var info HookInfo
+	ry.AddPrehook("widget.html", "shout", func(w io.Writer, r *http.Request, input interface{}) (interface{}, error) {
+		info, _ = HookInfoFrom(r.Context())
+		data := input.(map[string]interface{})
+		data["greeting"] = strings.ToUpper(data["greeting"].(string))
+		return data, nil
+	})
+	body, _ = render("page.html", "widget.html")
+	is.Equal(body, "HELLO")
+	is.Equal(info.Template, "widget.html")
+	is.Equal(info.Page.Name(), "page.html")
+	body, _ = render("other.html")
+	is.Equal(body, "hello") // other.html does not depend on widget.html
+
+	// Posthooks are plain middlewares
+	ry.AddPosthook("", "header", func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			info, _ := HookInfoFrom(r.Context())
+			w.Header().Set("X-Rendered", info.Page.Name())
+			next.ServeHTTP(w, r)
+		})
+	})
+	_, header := render("other.html")
+	is.Equal(header.Get("X-Rendered"), "other.html")
+
+	// Replacing and removing hooks
+	ry.AddPrehook("widget.html", "shout", func(w io.Writer, r *http.Request, input interface{}) (interface{}, error) {
+		return map[string]interface{}{"greeting": "replaced"}, nil
+	})
+	body, _ = render("page.html", "widget.html")
+	is.Equal(body, "replaced")
+	is.True(ry.RemovePrehook("widget.html", "shout"))
+	is.True(!ry.RemovePrehook("widget.html", "shout"))
+	body, _ = render("page.html", "widget.html")
+	is.Equal(body, "hello")
+	is.True(ry.RemovePosthook("", "header"))
+	_, header = render("page.html", "widget.html")
+	is.Equal(header.Get("X-Rendered"), "")
+}
+
+func Test_Nonce(t *testing.T) {
+	is := is.New(t)
+	fsys := fstest.MapFS{
+		"page.html": {Data: []byte(`{{ .__css__ }}{{ .__js__ }}<script nonce="{{ .__nonce__ }}">inline()</script>`)},
+		"page.css":  {Data: []byte(`p { color: red; }`)},
+		"page.js":   {Data: []byte(`page()`)},
+	}
+	ry, err := New(fsys, Nonce(true))
+	is.NoErr(err)
+	nonces := make(map[string]struct{})
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		rec.Header().Set("Content-Security-Policy", "default-src 'self'; script-src-elem 'self' cdn.jsdelivr.net; style-src-elem 'self'")
+		err = ry.Page(rec, httptest.NewRequest("GET", "/", nil), nil, "page.html", "page.css", "page.js")
+		is.NoErr(err)
+		body, csp := rec.Body.String(), rec.Header().Get("Content-Security-Policy")
+		nonce := body[strings.Index(body, `nonce="`)+len(`nonce="`):]
+		nonce = nonce[:strings.IndexByte(nonce, '"')]
+		nonces[nonce] = struct{}{}
+		is.Equal(strings.Count(body, `nonce="`+nonce+`"`), 3)                                       // generated tags and the template's own tag
+		is.True(strings.Contains(csp, "script-src-elem 'self' cdn.jsdelivr.net 'nonce-"+nonce+"'")) // merged into the existing policy
+		is.True(strings.Contains(csp, "style-src-elem 'self' 'nonce-"+nonce+"'"))
+		is.True(!strings.Contains(csp, "sha256-")) // no hashes in nonce mode
+	}
+	is.Equal(len(nonces), 2) // a new nonce for every render
+
+	var bodies []string
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		err = ry.Page(rec, r.WithContext(ContextWithoutNonce(r.Context())), nil, "page.html", "page.css", "page.js")
+		is.NoErr(err)
+		bodies = append(bodies, rec.Body.String())
+		is.True(strings.Contains(rec.Header().Get("Content-Security-Policy"), "sha256-")) // assets allowed by hash
+	}
+	is.Equal(bodies[0], bodies[1]) // the same page every time
+	is.True(!strings.Contains(bodies[0], "nonce-"))
+}
@@ -23,4 +23,39 @@ type Route struct {
 	HandlerURL  sql.NullString
 	Content     sql.NullString
 	Template    sql.NullString
+	Args        sql.NullString
+	NoIndex     sql.NullBool   // keeps the page out of the sitemap and search engines
+	Source      sql.NullString // the file the page is synced from, see SyncPages
+}
+
+// AddRedirect makes pm_routes permanently redirect the URL from to the URL
+// to. Redirects that pointed at from are pointed at to instead and a redirect
+// away from to is removed, so that redirects never chain or loop. A pm_routes
+// entry at from that is not a redirect is left alone.
+func AddRedirect(tx *sql.Tx, from, to string) error {
+	if from == to {
+		return nil
+	}
+	err := RemoveRedirect(tx, to)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE pm_routes SET redirect_url = ? WHERE redirect_url = ?", to, from)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		"INSERT INTO pm_routes (url, redirect_url) VALUES (?, ?)"+
+			" ON CONFLICT (url) DO UPDATE SET redirect_url = EXCLUDED.redirect_url WHERE pm_routes.redirect_url IS NOT NULL",
+		from, to,
+	)
+	return err
+}
+
+// RemoveRedirect removes the pm_routes redirect away from the URL u, if any.
+// pm_routes is served before the routes of plugins, so a plugin that puts a
+// new page at u calls it to keep the page from being redirected away.
+func RemoveRedirect(tx *sql.Tx, u string) error {
+	_, err := tx.Exec("DELETE FROM pm_routes WHERE url = ? AND redirect_url IS NOT NULL", u)
+	return err
 }
@@ -0,0 +1,309 @@
+package pagemanager
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"html/template"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// SitemapURL is a page listed in the sitemap.
+type SitemapURL struct {
+	Path    string    // the URL path of the page
+	LastMod time.Time // when the page last changed, if known
+}
+
+// Sitemapper is implemented by plugins that have pages to list in the
+// sitemap. A pm_routes entry that disables, redirects or noindexes one of
+// those pages keeps it out of the sitemap.
+type Sitemapper interface {
+	SitemapURLs() ([]SitemapURL, error)
+}
+
+// sitemapSize is the most URLs in a sitemap. A site with more URLs gets a
+// sitemap index at /sitemap.xml pointing at /sitemap-1.xml, /sitemap-2.xml
+// and so on.
+var sitemapSize = 50000
+
+// BaseURL returns the scheme and host of the request, for building absolute
+// URLs.
+func BaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// SitemapURLs returns the pages of the site that search engines may index,
+// sorted by path: the pm_routes entries that serve a page (content, a
+// template or a handler) and the pages of the plugins that are Sitemappers.
+// Disabled routes, redirects and noindexed routes are left out.
+func (pm *PageManager) SitemapURLs() ([]SitemapURL, error) {
+	rows, err := pm.DB.Query("SELECT url, disabled, redirect_url, handler_url, content, template, noindex FROM pm_routes")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	urls := make(map[string]SitemapURL)
+	excluded := make(map[string]bool)
+	for rows.Next() {
+		var route Route
+		err = rows.Scan(&route.URL, &route.Disabled, &route.RedirectURL, &route.HandlerURL, &route.Content, &route.Template, &route.NoIndex)
+		if err != nil {
+			return nil, err
+		}
+		if route.Disabled.Bool || route.RedirectURL.Valid || route.NoIndex.Bool {
+			excluded[route.URL.String] = true
+			continue
+		}
+		if route.HandlerURL.Valid || route.Content.Valid || route.Template.Valid {
+			urls[route.URL.String] = SitemapURL{Path: route.URL.String}
+		}
+	}
+	err = rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	for _, plugin := range pm.plugins {
+		sitemapper, ok := plugin.(Sitemapper)
+		if !ok {
+			continue
+		}
+		pluginURLs, err := sitemapper.SitemapURLs()
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range pluginURLs {
+			if excluded[u.Path] {
+				continue
+			}
+			if u.LastMod.After(urls[u.Path].LastMod) || urls[u.Path].Path == "" {
+				urls[u.Path] = u
+			}
+		}
+	}
+	sitemap := make([]SitemapURL, 0, len(urls))
+	for _, u := range urls {
+		sitemap = append(sitemap, u)
+	}
+	sort.Slice(sitemap, func(i, j int) bool { return sitemap[i].Path < sitemap[j].Path })
+	return sitemap, nil
+}
+
+type sitemapURLSet struct {
+	XMLName xml.Name         `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	URLs    []sitemapElement `xml:"url"`
+}
+
+type sitemapIndex struct {
+	XMLName  xml.Name         `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 sitemapindex"`
+	Sitemaps []sitemapElement `xml:"sitemap"`
+}
+
+// sitemapElement is a <url> of a sitemap or a <sitemap> of a sitemap index.
+type sitemapElement struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+func lastmod(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// SitemapGet serves /sitemap.xml, the sitemap of the URLs in SitemapURLs. If
+// there are more than fit in one sitemap, it serves a sitemap index instead.
+func (pm *PageManager) SitemapGet(w http.ResponseWriter, r *http.Request) {
+	urls, err := pm.SitemapURLs()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	base := BaseURL(r)
+	if len(urls) <= sitemapSize {
+		writeSitemap(w, r, base, urls)
+		return
+	}
+	var index sitemapIndex
+	for n := 1; (n-1)*sitemapSize < len(urls); n++ {
+		var latest time.Time
+		for _, u := range sitemapPage(urls, n) {
+			if u.LastMod.After(latest) {
+				latest = u.LastMod
+			}
+		}
+		index.Sitemaps = append(index.Sitemaps, sitemapElement{
+			Loc:     base + "/sitemap-" + strconv.Itoa(n) + ".xml",
+			LastMod: lastmod(latest),
+		})
+	}
+	writeXML(w, r, index)
+}
+
+// SitemapPageGet serves the nth sitemap of the sitemap index, /sitemap-n.xml.
+func (pm *PageManager) SitemapPageGet(w http.ResponseWriter, r *http.Request) {
+	n, err := strconv.Atoi(chi.URLParam(r, "n"))
+	if err != nil || n < 1 {
+		http.NotFound(w, r)
+		return
+	}
+	urls, err := pm.SitemapURLs()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if (n-1)*sitemapSize >= len(urls) {
+		http.NotFound(w, r)
+		return
+	}
+	writeSitemap(w, r, BaseURL(r), sitemapPage(urls, n))
+}
+
+// sitemapPage returns the URLs in the nth sitemap of the sitemap index.
+func sitemapPage(urls []SitemapURL, n int) []SitemapURL {
+	start, end := (n-1)*sitemapSize, n*sitemapSize
+	if end > len(urls) {
+		end = len(urls)
+	}
+	return urls[start:end]
+}
+
+func writeSitemap(w http.ResponseWriter, r *http.Request, base string, urls []SitemapURL) {
+	var urlset sitemapURLSet
+	for _, u := range urls {
+		urlset.URLs = append(urlset.URLs, sitemapElement{Loc: base + u.Path, LastMod: lastmod(u.LastMod)})
+	}
+	writeXML(w, r, urlset)
+}
+
+func writeXML(w http.ResponseWriter, r *http.Request, v interface{}) {
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	enc := xml.NewEncoder(&b)
+	enc.Indent("", "  ")
+	err := enc.Encode(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	b.WriteString("\n")
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(b.Bytes()))
+}
+
+// robotsKey is the pm_kv key of the robots.txt set by the admin. Like every
+// pm_kv entry it can only be written by the admin, through AdminRobotsPost or
+// KVPost.
+const robotsKey = "robots.txt"
+
+// defaultRobots is the robots.txt of a site whose admin has not set one.
+const defaultRobots = "User-agent: *\nDisallow: /pm-admin/\n"
+
+// robotsTxt returns the robots.txt set by the admin, or defaultRobots.
+func (pm *PageManager) robotsTxt() (string, error) {
+	var robots sql.NullString
+	err := pm.DB.QueryRow("SELECT value FROM pm_kv WHERE key = ?", robotsKey).Scan(&robots)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+	if strings.TrimSpace(robots.String) == "" {
+		return defaultRobots, nil
+	}
+	return robots.String, nil
+}
+
+// RobotsGet serves /robots.txt. A Sitemap line pointing at /sitemap.xml is
+// added unless the robots.txt already has one.
+func (pm *PageManager) RobotsGet(w http.ResponseWriter, r *http.Request) {
+	robots, err := pm.robotsTxt()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	hasSitemap := false
+	for _, line := range strings.Split(robots, "\n") {
+		if strings.HasPrefix(strings.ToLower(strings.TrimSpace(line)), "sitemap:") {
+			hasSitemap = true
+			break
+		}
+	}
+	if !hasSitemap {
+		robots = strings.TrimRight(robots, "\n") + "\n\nSitemap: " + BaseURL(r) + "/sitemap.xml\n"
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, robots)
+}
+
+// AdminRobotsGet returns the robots.txt as set by the admin (without the
+// Sitemap line that RobotsGet adds).
+func (pm *PageManager) AdminRobotsGet(w http.ResponseWriter, r *http.Request) {
+	robots, err := pm.robotsTxt()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, robots)
+}
+
+type RobotsPostData struct {
+	RobotsTxt  string `json:"robots_txt"` // an empty robots.txt restores the default
+	RedirectTo string `json:"redirect_to"`
+}
+
+// AdminRobotsPost sets the robots.txt.
+func (pm *PageManager) AdminRobotsPost(w http.ResponseWriter, r *http.Request) {
+	data := RobotsPostData{}
+	err := decodeJSONBody(w, r, &data)
+	if err != nil {
+		var mr *malformedRequest
+		switch {
+		case errors.As(err, &mr):
+			http.Error(w, mr.msg, mr.status)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	robots := strings.ReplaceAll(data.RobotsTxt, "\r\n", "\n")
+	if robots != "" && !strings.HasSuffix(robots, "\n") {
+		robots += "\n"
+	}
+	_, err = pm.DB.Exec(
+		"INSERT INTO pm_kv (key, value) VALUES (?, ?) ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value",
+		robotsKey, robots,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, localRedirect(data.RedirectTo, "/pm-admin/robots.txt"), http.StatusSeeOther)
+}
+
+type noindexKey struct{}
+
+// IsNoIndex reports whether the pm_routes entry of the request's URL marks it
+// noindex.
+func IsNoIndex(r *http.Request) bool {
+	noindex, _ := r.Context().Value(noindexKey{}).(bool)
+	return noindex
+}
+
+// robotsMeta is the robots meta tag of a noindexed page.
+const robotsMeta = template.HTML(`<meta name="robots" content="noindex">`)
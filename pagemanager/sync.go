@@ -0,0 +1,284 @@
+package pagemanager
+
+import (
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/bokwoon95/weblog/pagemanager/renderly"
+	"github.com/pelletier/go-toml"
+)
+
+// Pages can be kept as HTML and markdown files in a directory (usually in
+// git) and synced into pm_routes with SyncPages. Every file is a page whose
+// URL is its path without the extension, with index files standing for their
+// directory:
+//
+//	index.md          /
+//	about.html        /about
+//	docs/index.md     /docs
+//	docs/install.md   /docs/install
+//
+// A file may start with TOML front matter delimited by +++ lines, or YAML
+// front matter delimited by --- lines (see renderly.ParseFrontMatter):
+//
+//	+++
+//	url = "/about-me"                  # overrides the URL of the file
+//	template = "plainsimple/page.html" # renders the page with a theme template
+//	noindex = true                     # see Route.NoIndex
+//	title = "About me"                 # anything else is passed to the template
+//	+++
+//
+// A page with a template is rendered with the file's content as __content__
+// and the rest of the front matter as its args. A page without a template is
+// served as is. Markdown is converted to HTML and sanitized, HTML is trusted.
+
+// SyncOptions are the options of SyncPages.
+type SyncOptions struct {
+	// DryRun returns the changes without making them.
+	DryRun bool
+	// Template is the template of the markdown files whose front matter does
+	// not set one, e.g. "plainsimple/page.html". If it is empty, markdown
+	// files without a template are served as an HTML fragment.
+	Template string
+}
+
+// SyncChange is a change that SyncPages makes to pm_routes.
+type SyncChange struct {
+	Action string   // "create", "update" or "disable"
+	URL    string   // the URL of the pm_routes entry
+	Source string   // the file the entry is synced from
+	Fields []string // the columns that an update changes
+}
+
+func (c SyncChange) String() string {
+	s := c.Action + " " + c.URL + " (" + c.Source + ")"
+	if len(c.Fields) > 0 {
+		s += ": " + strings.Join(c.Fields, ", ")
+	}
+	return s
+}
+
+// syncedPage is the pm_routes entry of a file.
+type syncedPage struct {
+	url      string
+	source   string
+	content  string
+	template sql.NullString
+	args     sql.NullString
+	noindex  sql.NullBool
+}
+
+// SyncPages syncs the HTML (.html) and markdown (.md) files in fsys into
+// pm_routes, and returns the changes sorted by URL. Entries are created for
+// new files, updated for changed files and disabled for removed files. Files
+// and directories whose names start with a dot are skipped.
+//
+// The entries that SyncPages creates remember their file in the source
+// column, and SyncPages never touches any other entry: a file whose URL
+// belongs to an entry that was not synced from a file is an error, and
+// nothing is synced.
+func (pm *PageManager) SyncPages(fsys fs.FS, opts SyncOptions) ([]SyncChange, error) {
+	pages, err := pm.readPages(fsys, opts.Template)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := pm.DB.Query("SELECT url, disabled, content, template, args, noindex, source FROM pm_routes")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	routes := make(map[string]Route)
+	for rows.Next() {
+		var route Route
+		err = rows.Scan(&route.URL, &route.Disabled, &route.Content, &route.Template, &route.Args, &route.NoIndex, &route.Source)
+		if err != nil {
+			return nil, err
+		}
+		routes[route.URL.String] = route
+	}
+	err = rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	var changes []SyncChange
+	synced := make(map[string]syncedPage) // the pages of the create and update changes, by URL
+	urls := make([]string, 0, len(pages))
+	for u := range pages {
+		urls = append(urls, u)
+	}
+	sort.Strings(urls)
+	for _, u := range urls {
+		page := pages[u]
+		route, ok := routes[page.url]
+		if !ok {
+			changes = append(changes, SyncChange{Action: "create", URL: page.url, Source: page.source})
+			synced[page.url] = page
+			continue
+		}
+		if !route.Source.Valid {
+			return nil, fmt.Errorf("%s: %s is already in pm_routes and was not synced from a file", page.source, page.url)
+		}
+		var fields []string
+		for _, field := range []struct {
+			name    string
+			changed bool
+		}{
+			{"disabled", route.Disabled.Bool},
+			{"content", route.Content.String != page.content},
+			{"template", route.Template != page.template},
+			{"args", route.Args != page.args},
+			{"noindex", route.NoIndex != page.noindex},
+			{"source", route.Source.String != page.source},
+		} {
+			if field.changed {
+				fields = append(fields, field.name)
+			}
+		}
+		if len(fields) > 0 {
+			changes = append(changes, SyncChange{Action: "update", URL: page.url, Source: page.source, Fields: fields})
+			synced[page.url] = page
+		}
+	}
+	for _, route := range routes {
+		if _, ok := pages[route.URL.String]; ok || !route.Source.Valid || route.Disabled.Bool {
+			continue
+		}
+		changes = append(changes, SyncChange{Action: "disable", URL: route.URL.String, Source: route.Source.String})
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].URL < changes[j].URL })
+	if opts.DryRun || len(changes) == 0 {
+		return changes, nil
+	}
+	tx, err := pm.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	for _, change := range changes {
+		page := synced[change.URL]
+		switch change.Action {
+		case "create":
+			_, err = tx.Exec(
+				"INSERT INTO pm_routes (url, content, template, args, noindex, source) VALUES (?, ?, ?, ?, ?, ?)",
+				page.url, page.content, page.template, page.args, page.noindex, page.source,
+			)
+		case "update":
+			_, err = tx.Exec(
+				"UPDATE pm_routes SET disabled = NULL, content = ?, template = ?, args = ?, noindex = ?, source = ? WHERE url = ?",
+				page.content, page.template, page.args, page.noindex, page.source, page.url,
+			)
+		case "disable":
+			_, err = tx.Exec("UPDATE pm_routes SET disabled = TRUE WHERE url = ?", change.URL)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// readPages reads the pages in fsys, by URL.
+func (pm *PageManager) readPages(fsys fs.FS, defaultTemplate string) (map[string]syncedPage, error) {
+	pages := make(map[string]syncedPage)
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if name != "." && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		ext := path.Ext(name)
+		if d.IsDir() || (ext != ".html" && ext != ".md") {
+			return nil
+		}
+		page, err := pm.readPage(fsys, name, defaultTemplate)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if other, ok := pages[page.url]; ok {
+			return fmt.Errorf("%s: %s is also the URL of %s", name, page.url, other.source)
+		}
+		pages[page.url] = page
+		return nil
+	})
+	return pages, err
+}
+
+// readPage reads the page in the file name.
+func (pm *PageManager) readPage(fsys fs.FS, name, defaultTemplate string) (syncedPage, error) {
+	page := syncedPage{source: name}
+	b, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return page, err
+	}
+	frontMatter, body, err := renderly.ParseFrontMatter(b)
+	if err != nil {
+		return page, err
+	}
+	page.url = "/" + strings.TrimSuffix(name, path.Ext(name))
+	if path.Base(page.url) == "index" {
+		page.url = path.Dir(page.url)
+	}
+	if v, ok := frontMatter["url"]; ok {
+		u, ok := v.(string)
+		if !ok || !strings.HasPrefix(u, "/") {
+			return page, fmt.Errorf("url: must be a string starting with /, got %v", v)
+		}
+		page.url = u
+		delete(frontMatter, "url")
+	}
+	if v, ok := frontMatter["template"]; ok {
+		template, ok := v.(string)
+		if !ok {
+			return page, fmt.Errorf("template: must be a string, got %v", v)
+		}
+		page.template = sql.NullString{String: template, Valid: template != ""}
+		delete(frontMatter, "template")
+	} else if path.Ext(name) == ".md" && defaultTemplate != "" {
+		page.template = sql.NullString{String: defaultTemplate, Valid: true}
+	}
+	if v, ok := frontMatter["noindex"]; ok {
+		noindex, ok := v.(bool)
+		if !ok {
+			return page, fmt.Errorf("noindex: must be a boolean, got %v", v)
+		}
+		page.noindex = sql.NullBool{Bool: noindex, Valid: true}
+		delete(frontMatter, "noindex")
+	}
+	if len(frontMatter) > 0 {
+		tree, err := toml.TreeFromMap(frontMatter)
+		if err != nil {
+			return page, err
+		}
+		args, err := tree.ToTomlString()
+		if err != nil {
+			return page, err
+		}
+		page.args = sql.NullString{String: args, Valid: true}
+	}
+	if path.Ext(name) == ".md" {
+		content, err := pm.Render.MarkdownHTML(body)
+		if err != nil {
+			return page, err
+		}
+		page.content = string(content)
+	} else {
+		page.content = string(body)
+	}
+	return page, nil
+}
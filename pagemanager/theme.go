@@ -0,0 +1,377 @@
+package pagemanager
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml"
+)
+
+// ThemeSchema is the version of the theme.toml schema understood by
+// pagemanager.
+//
+// A theme is a directory containing a theme.toml. The theme.toml starts with
+// the theme's metadata, followed by one table for every page in the theme
+// keyed by the page's filename (relative to the theme.toml):
+//
+//	schema = 1                    # required, must be ThemeSchema
+//	name = "plainsimple"          # optional metadata
+//	author = "Chua Bok Woon"
+//	version = "0.1.0"
+//	description = "A plain and simple theme"
+//	screenshot = "screenshot.png"
+//
+//	["post.html"]
+//	main_template = "base.html"   # optional, rendered instead of post.html
+//	include = ["header.html", "style.css", "post.js"]
+//	["post.html".args]            # optional, data passed to the page
+//	summary = true
+//	["post.html".sample]          # optional, extra data used by LintTheme
+//	title = "Hello World"
+//
+// Every path is relative to the directory of the theme.toml. Unknown keys and
+// values of the wrong type are errors. Pages without a table still render:
+// they include the .css, .js and .md files that share their basename.
+const ThemeSchema = 1
+
+const themeConfigFilename = "theme.toml"
+
+// ThemeConfig is a parsed theme.toml.
+type ThemeConfig struct {
+	// Filename is the path of the theme.toml inside its fs.FS.
+	Filename    string
+	Schema      int
+	Name        string
+	Author      string
+	Version     string
+	Description string
+	// Screenshot is the path of an image of the theme, relative to the
+	// theme.toml.
+	Screenshot string
+	// Pages is keyed by the page's filename relative to the theme.toml.
+	Pages map[string]PageSource
+}
+
+// Dir returns the directory of the theme.toml.
+func (cfg ThemeConfig) Dir() string {
+	return path.Dir(cfg.Filename)
+}
+
+// LoadThemeConfig reads and parses the theme.toml identified by filename.
+func LoadThemeConfig(fsys fs.FS, filename string) (ThemeConfig, error) {
+	b, err := fs.ReadFile(fsys, filename)
+	if err != nil {
+		return ThemeConfig{}, err
+	}
+	return parseThemeConfig(filename, b)
+}
+
+// parseThemeConfig parses the contents of a theme.toml. Errors cite the
+// filename, position and key that caused them.
+func parseThemeConfig(filename string, b []byte) (ThemeConfig, error) {
+	cfg := ThemeConfig{Filename: filename, Pages: make(map[string]PageSource)}
+	tree, err := toml.LoadBytes(b)
+	if err != nil {
+		return cfg, fmt.Errorf("%s: %w", filename, err)
+	}
+	keyErr := func(keys []string, format string, a ...interface{}) error {
+		pos := tree.GetPositionPath(keys)
+		return fmt.Errorf("%s:%d:%d: %s: %s", filename, pos.Line, pos.Col, tomlKey(keys), fmt.Sprintf(format, a...))
+	}
+	keys := tree.Keys()
+	sort.Strings(keys)
+	var hasSchema bool
+	for _, key := range keys {
+		value := tree.GetPath([]string{key})
+		switch key {
+		case "schema":
+			schema, ok := value.(int64)
+			if !ok {
+				return cfg, keyErr([]string{key}, "must be an integer, got %s", tomlType(value))
+			}
+			if schema != ThemeSchema {
+				return cfg, keyErr([]string{key}, "unsupported schema version %d (expected %d)", schema, ThemeSchema)
+			}
+			cfg.Schema, hasSchema = int(schema), true
+		case "name", "author", "version", "description", "screenshot":
+			str, ok := value.(string)
+			if !ok {
+				return cfg, keyErr([]string{key}, "must be a string, got %s", tomlType(value))
+			}
+			switch key {
+			case "name":
+				cfg.Name = str
+			case "author":
+				cfg.Author = str
+			case "version":
+				cfg.Version = str
+			case "description":
+				cfg.Description = str
+			case "screenshot":
+				cfg.Screenshot = str
+			}
+		default:
+			subTree, ok := value.(*toml.Tree)
+			if !ok {
+				return cfg, keyErr([]string{key}, "unknown key (pages must be tables keyed by their filename)")
+			}
+			src := PageSource{Name: key}
+			subKeys := subTree.Keys()
+			sort.Strings(subKeys)
+			for _, subKey := range subKeys {
+				value := subTree.GetPath([]string{subKey})
+				keys := []string{key, subKey}
+				switch subKey {
+				case "main_template":
+					str, ok := value.(string)
+					if !ok {
+						return cfg, keyErr(keys, "must be a string, got %s", tomlType(value))
+					}
+					src.MainTemplate = str
+				case "include":
+					list, ok := value.([]interface{})
+					if !ok {
+						return cfg, keyErr(keys, "must be an array of strings, got %s", tomlType(value))
+					}
+					for i, item := range list {
+						str, ok := item.(string)
+						if !ok {
+							return cfg, keyErr(keys, "item %d must be a string, got %s", i, tomlType(item))
+						}
+						src.Include = append(src.Include, str)
+					}
+				case "args", "sample":
+					table, ok := value.(*toml.Tree)
+					if !ok {
+						return cfg, keyErr(keys, "must be a table, got %s", tomlType(value))
+					}
+					if subKey == "args" {
+						src.Args = table.ToMap()
+					} else {
+						src.Sample = table.ToMap()
+					}
+				default:
+					return cfg, keyErr(keys, "unknown key")
+				}
+			}
+			cfg.Pages[key] = src
+		}
+	}
+	if !hasSchema {
+		return cfg, fmt.Errorf("%s: missing required key schema (the current version is %d)", filename, ThemeSchema)
+	}
+	return cfg, nil
+}
+
+// tomlKey formats keys as a dotted TOML key, quoting them where necessary.
+func tomlKey(keys []string) string {
+	parts := make([]string, len(keys))
+	for i, key := range keys {
+		parts[i] = key
+		for _, c := range key {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+				parts[i] = strconv.Quote(key)
+				break
+			}
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// tomlType describes the TOML type of a value returned by go-toml.
+func tomlType(value interface{}) string {
+	switch value.(type) {
+	case string:
+		return "a string"
+	case int64:
+		return "an integer"
+	case float64:
+		return "a float"
+	case bool:
+		return "a boolean"
+	case time.Time:
+		return "a datetime"
+	case *toml.Tree:
+		return "a table"
+	case []*toml.Tree:
+		return "an array of tables"
+	case []interface{}:
+		return "an array"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+// findThemeConfig returns the filename of the theme.toml nearest to filename,
+// searching its directory and every parent directory. It returns an empty
+// string if there is none.
+func findThemeConfig(fsys fs.FS, filename string) (string, error) {
+	dir := path.Dir(filename)
+	for {
+		name := path.Join(dir, themeConfigFilename)
+		_, err := fs.Stat(fsys, name)
+		if err == nil {
+			return name, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		if dir == "." || dir == "/" {
+			return "", nil
+		}
+		dir = path.Dir(dir)
+	}
+}
+
+// LintTheme checks the theme in the directory dir of fsys. It reports
+// problems with the theme.toml, missing main_template and include files,
+// {{ template }} references that do not resolve and pages that fail to render
+// with their args and sample data. Pages are linted in filename order.
+func LintTheme(fsys fs.FS, dir string) []error {
+	cfg, err := LoadThemeConfig(fsys, path.Join(dir, themeConfigFilename))
+	if err != nil {
+		return []error{err}
+	}
+	render, err := newRender(fsys, newHTMLPolicy())
+	if err != nil {
+		return []error{err}
+	}
+	var names []string
+	for name := range cfg.Pages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var errs []error
+	for _, name := range names {
+		src := cfg.resolve(cfg.Pages[name])
+		var missing bool
+		for _, filename := range src.Files() {
+			_, err := fs.Stat(fsys, filename)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %s: %w", cfg.Filename, tomlKey([]string{name}), err))
+				missing = true
+			}
+		}
+		if missing {
+			continue
+		}
+		page, err := render.Lookup(src.Files()...)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		data := make(map[string]interface{})
+		for k, v := range src.Args {
+			data[k] = v
+		}
+		for k, v := range src.Sample {
+			data[k] = v
+		}
+		err = page.Render(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), data)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// ListThemes returns the theme.toml of every theme in fsys, i.e. of every top
+// level directory that contains a theme.toml, in directory order.
+func ListThemes(fsys fs.FS) ([]ThemeConfig, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	var themes []ThemeConfig
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		filename := path.Join(entry.Name(), themeConfigFilename)
+		_, err := fs.Stat(fsys, filename)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return themes, err
+		}
+		cfg, err := LoadThemeConfig(fsys, filename)
+		if err != nil {
+			return themes, err
+		}
+		themes = append(themes, cfg)
+	}
+	return themes, nil
+}
+
+// SiteScope is the scope of the site's active theme. Plugins pass their own
+// scope (usually their namespace) to Theme, so that they can be themed
+// independently of the rest of the site.
+const SiteScope = ""
+
+// Theme returns the name of the theme that the pages of scope should be
+// rendered with. Admins may preview any theme on any page by adding a ?theme=
+// query parameter to the URL. Otherwise it is the active theme of the scope,
+// falling back to the active theme of the site. It returns an empty string if
+// no theme was activated.
+func (pm *PageManager) Theme(r *http.Request, scope string) (string, error) {
+	if theme := r.URL.Query().Get("theme"); theme != "" && pm.IsAdmin(r) {
+		return theme, nil
+	}
+	var theme string
+	query := "SELECT theme FROM pm_themes WHERE scope IN (?, ?) ORDER BY scope = ? DESC LIMIT 1"
+	err := pm.DB.QueryRow(query, scope, SiteScope, scope).Scan(&theme)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return theme, err
+}
+
+// SetTheme activates the installed theme for scope. An empty theme
+// deactivates the scope's theme, so that it falls back to the site's theme.
+func (pm *PageManager) SetTheme(scope, theme string) error {
+	if theme == "" {
+		_, err := pm.DB.Exec("DELETE FROM pm_themes WHERE scope = ?", scope)
+		return err
+	}
+	if !fs.ValidPath(theme) || strings.Contains(theme, "/") {
+		return fmt.Errorf("invalid theme name %q", theme)
+	}
+	_, err := fs.Stat(pm.Themes, path.Join(theme, themeConfigFilename))
+	if err != nil {
+		return fmt.Errorf("theme %s is not installed: %w", theme, err)
+	}
+	query := "INSERT INTO pm_themes (scope, theme) VALUES (?, ?) ON CONFLICT (scope) DO UPDATE SET theme = EXCLUDED.theme"
+	_, err = pm.DB.Exec(query, scope, theme)
+	return err
+}
+
+// themedTemplate swaps the theme of template (its first path element) for the
+// theme returned by Theme, provided that theme has a file of the same name.
+// Otherwise template is returned unchanged.
+func (pm *PageManager) themedTemplate(r *http.Request, scope, template string) (string, error) {
+	i := strings.IndexByte(template, '/')
+	if i < 0 {
+		return template, nil
+	}
+	theme, err := pm.Theme(r, scope)
+	if err != nil || theme == "" || theme == template[:i] {
+		return template, err
+	}
+	candidate := theme + template[i:]
+	f, err := pm.Render.Open(candidate)
+	if err != nil {
+		return template, nil
+	}
+	f.Close()
+	return candidate, nil
+}
@@ -58,24 +58,6 @@ var posts = []Post{
 	},
 }
 
-var funcs = map[string]interface{}{
-	"mapadd": func(base map[string]interface{}, args ...interface{}) map[string]interface{} {
-		newbase := make(map[string]interface{})
-		for key, value := range base {
-			newbase[key] = value
-		}
-		for i := 0; i < len(args); i += 2 {
-			if i+1 >= len(args) {
-				break
-			}
-			key := fmt.Sprint(args[i])
-			value := args[i+1]
-			newbase[key] = value
-		}
-		return newbase
-	},
-}
-
 func main() {
 	fsys := os.DirFS(renderly.AbsDir("."))
 	var opts []renderly.Option
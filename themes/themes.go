@@ -0,0 +1,10 @@
+// Package themes embeds the default themes into the binary, so that a
+// deployed binary renders without a ./themes directory next to it.
+package themes
+
+import "embed"
+
+// FS contains the default themes, each in its own top level directory.
+//
+//go:embed plainsimple/theme.toml plainsimple/*.html plainsimple/*.css plainsimple/*.js plainsimple/*.jpg
+var FS embed.FS